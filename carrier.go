@@ -0,0 +1,433 @@
+// Copyright (C) 2012 Stéphane Bunel. All rights reserved.
+// Use of this source code is governed by the license found in steganoWAV.go.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+type chunk_info struct {
+	id     string // Chunk ID
+	offset int64  // Position of chunk header in file
+	data   int64  // Position of chunk data in file
+	length int64  // Length of chunk in file, header and padding included
+	size   uint32 // Size of chunk data, pad byte not included
+}
+
+// Carrier is an audio file giving access to its PCM samples as integers. Algorithms only use
+// this interface, so new container formats are supported without changing them.
+type Carrier interface {
+	Parse(file *os.File, size int64, info *wave_info_struct) error  // Parses headers following magic and fills info
+	Format() string                                                 // Name of the container format
+	Size() int64                                                    // File size
+	Unsigned() bool                                                 // True if 8 bits samples are stored with a bias of 128
+	ReadSamples(first uint64, samples []int32) error                // Reads samples from sample index first
+	WriteSamples(first uint64, samples []int32) error               // Writes back samples at sample index first
+	ReadSamplesAt(first uint64, samples []int32, raw []byte) error  // Like ReadSamples through raw: safe for concurrent use
+	WriteSamplesAt(first uint64, samples []int32, raw []byte) error // Like WriteSamples through raw: safe for concurrent use
+	Sync() error                                                    // Commits changes to the file
+	Close() error                                                   // Releases the file
+}
+
+// chunk_carrier is a Carrier made of chunks. Chunk storage, chunk listing and --bext need it:
+// carriers without chunks (AU, FLAC) don't implement it.
+type chunk_carrier interface {
+	Carrier
+	Chunks() ([]chunk_info, error)                         // Lists every chunk, foreign ones included
+	ReadChunk(c chunk_info, offset int64, b []byte) error  // Reads data of chunk c from offset
+	AppendChunk(id string, size int, data io.Reader) error // Appends a chunk holding size bytes read from data
+	RemoveChunk(c chunk_info) error                        // Removes chunk c, keeping other ones
+	WriteChunk(c chunk_info, data []byte) error            // Replaces data of chunk c, moving following chunks
+	ChunkCapacity() uint32                                 // Largest data size of a chunk appended to the file
+	ListSubChunks() bool                                   // True if LIST chunks hold RIFF sub chunks
+}
+
+// chunk_layout tells how a container format stores its chunks.
+type chunk_layout interface {
+	firstChunk() (pos int64, header_size int64)                      // Position of the first chunk and size of chunk headers
+	parseChunkHeader(header []byte, pos int64) chunk_info            // Chunk whose header, read at pos, is in header
+	newChunkHeader(id string, size int) (header []byte, align int64) // Header of a chunk holding size bytes, and alignment of chunks
+	containerSize(size int64) (field []byte, pos int64)              // Size field of the container of a file of size bytes, and its position
+	maxSize() int64                                                  // Largest file size the container can tell
+}
+
+// carrier_format recognizes a container format by the first bytes of files.
+type carrier_format struct {
+	magic  string         // First bytes of files
+	create func() Carrier // Returns an empty carrier of this format
+}
+
+// pcm_file implements Carrier for files storing PCM samples in one block.
+type pcm_file struct {
+	file             *os.File          //
+	size             int64             // Should be < 2^32
+	info             *wave_info_struct //
+	first_sample_pos int64             // 44 for canonical RIFF/WAVE
+	buf              []byte            // Raw samples, reused by ReadSamples and WriteSamples
+}
+
+// chunk_file implements chunk_carrier for pcm_file made of chunks stored as told by layout.
+type chunk_file struct {
+	pcm_file
+	layout chunk_layout
+}
+
+var (
+	// Container formats recognized by parseHeaders
+	carrier_formats = []carrier_format{
+		{"RIFF", func() Carrier { return &riff_carrier{} }},
+		{"FORM", func() Carrier { return &aiff_carrier{} }},
+		{W64_RIFF_GUID, func() Carrier { return &w64_carrier{} }},
+		{AU_MAGIC, func() Carrier { return &au_carrier{} }},
+		{FLAC_MAGIC, func() Carrier { return &flac_carrier{} }},
+	}
+)
+
+//-----------------------------------------------------------------------
+//-- PCM FILES
+//-----------------------------------------------------------------------
+
+// Format returns the name of the container format.
+func (self *pcm_file) Format() string {
+	return self.info.format_name
+}
+
+// Size returns the size of file.
+func (self *pcm_file) Size() int64 {
+	return self.size
+}
+
+// Unsigned returns false: samples are signed unless the format tells otherwise.
+func (self *pcm_file) Unsigned() bool {
+	return false
+}
+
+// ReadSamples reads len(samples) samples starting at sample index first.
+func (self *pcm_file) ReadSamples(first uint64, samples []int32) (err error) {
+	return self.ReadSamplesAt(first, samples, self.rawBuffer(len(samples)))
+}
+
+// WriteSamples writes samples starting at sample index first.
+func (self *pcm_file) WriteSamples(first uint64, samples []int32) (err error) {
+	return self.WriteSamplesAt(first, samples, self.rawBuffer(len(samples)))
+}
+
+// ReadSamplesAt reads len(samples) samples starting at sample index first through raw, which must
+// hold them. Goroutines with their own raw buffer may call it at once.
+func (self *pcm_file) ReadSamplesAt(first uint64, samples []int32, raw []byte) (err error) {
+	var bps = uint64(self.info.bytes_per_sample)
+
+	raw = raw[0 : uint64(len(samples))*bps]
+	if first+uint64(len(samples)) > uint64(self.info.num_samples) {
+		return errors.New(fmt.Sprintf("Samples %d to %d are beyond the end of sound.", first, first+uint64(len(samples))))
+	}
+
+	if _, err = self.file.ReadAt(raw, self.first_sample_pos+int64(first*bps)); err != nil {
+		return err
+	}
+
+	for i := range samples {
+		samples[i] = self.decodeSample(raw[uint64(i)*bps:])
+	}
+
+	return nil
+}
+
+// WriteSamplesAt writes samples starting at sample index first through raw, which must hold them.
+// Goroutines with their own raw buffer may call it at once for distinct samples.
+func (self *pcm_file) WriteSamplesAt(first uint64, samples []int32, raw []byte) (err error) {
+	var bps = uint64(self.info.bytes_per_sample)
+
+	raw = raw[0 : uint64(len(samples))*bps]
+	if first+uint64(len(samples)) > uint64(self.info.num_samples) {
+		return errors.New(fmt.Sprintf("Samples %d to %d are beyond the end of sound.", first, first+uint64(len(samples))))
+	}
+
+	for i, v := range samples {
+		self.encodeSample(v, raw[uint64(i)*bps:])
+	}
+
+	_, err = self.file.WriteAt(raw, self.first_sample_pos+int64(first*bps))
+
+	return err
+}
+
+// rawBuffer returns a buffer for n raw samples. It is reused by following calls.
+func (self *pcm_file) rawBuffer(n int) []byte {
+	size := n * int(self.info.bytes_per_sample)
+	if cap(self.buf) < size {
+		self.buf = make([]byte, size)
+	}
+
+	return self.buf[0:size]
+}
+
+// decodeSample returns the value of the PCM sample stored at the beginning of b.
+// 8 bits WAVE samples are unsigned with a bias of 128.
+func (self *pcm_file) decodeSample(b []byte) int32 {
+	if self.info.big_endian {
+		switch self.info.bytes_per_sample {
+		case 1:
+			return int32(int8(b[0]))
+		case 2:
+			return int32(int16(binary.BigEndian.Uint16(b)))
+		case 3:
+			return int32(uint32(b[2])<<8|uint32(b[1])<<16|uint32(b[0])<<24) >> 8
+		}
+		return int32(binary.BigEndian.Uint32(b))
+	}
+
+	switch self.info.bytes_per_sample {
+	case 1:
+		if self.info.unsigned {
+			return int32(b[0]) - 128
+		}
+		return int32(int8(b[0]))
+	case 2:
+		return int32(int16(binary.LittleEndian.Uint16(b)))
+	case 3:
+		return int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+	}
+	return int32(binary.LittleEndian.Uint32(b))
+}
+
+// encodeSample stores value as a PCM sample at the beginning of b.
+func (self *pcm_file) encodeSample(value int32, b []byte) {
+	if self.info.big_endian {
+		switch self.info.bytes_per_sample {
+		case 1:
+			b[0] = byte(value)
+		case 2:
+			binary.BigEndian.PutUint16(b, uint16(value))
+		case 3:
+			b[0], b[1], b[2] = byte(value>>16), byte(value>>8), byte(value)
+		default:
+			binary.BigEndian.PutUint32(b, uint32(value))
+		}
+		return
+	}
+
+	switch self.info.bytes_per_sample {
+	case 1:
+		if self.info.unsigned {
+			value += 128
+		}
+		b[0] = byte(value)
+	case 2:
+		binary.LittleEndian.PutUint16(b, uint16(value))
+	case 3:
+		b[0], b[1], b[2] = byte(value), byte(value>>8), byte(value>>16)
+	default:
+		binary.LittleEndian.PutUint32(b, uint32(value))
+	}
+}
+
+// Sync commits changes to the file.
+func (self *pcm_file) Sync() error {
+	return self.file.Sync()
+}
+
+// Close closes the file.
+func (self *pcm_file) Close() error {
+	return self.file.Close()
+}
+
+//-----------------------------------------------------------------------
+//-- CHUNK FILES
+//-----------------------------------------------------------------------
+
+// Chunks returns every chunk of the file.
+func (self *chunk_file) Chunks() (chunks []chunk_info, err error) {
+	pos, size := self.layout.firstChunk()
+	header := make([]byte, size)
+
+	for pos+size <= self.size {
+		if _, err = self.file.ReadAt(header, pos); err != nil {
+			return nil, err
+		}
+
+		c := self.layout.parseChunkHeader(header, pos)
+		chunks = append(chunks, c)
+		pos += c.length
+	}
+
+	return chunks, nil
+}
+
+// ReadChunk reads len(b) bytes of chunk c data, from offset.
+func (self *chunk_file) ReadChunk(c chunk_info, offset int64, b []byte) (err error) {
+	_, err = self.file.ReadAt(b, c.data+offset)
+	return err
+}
+
+// AppendChunk appends a chunk holding size bytes read from data at the end of file. Data is copied
+// by CHUNK_MOVE_BUF steps, so it is never held in memory.
+func (self *chunk_file) AppendChunk(id string, size int, data io.Reader) (err error) {
+	var buff = make([]byte, CHUNK_MOVE_BUF)
+
+	if err = self.checkContainerSize(self.appendedSize(self.size, id, size)); err != nil {
+		return err
+	}
+
+	header, align := self.layout.newChunkHeader(id, size)
+	pos := (self.size + align - 1) / align * align
+	end := pos + int64(len(header)+size)
+	if _, err = self.file.WriteAt(append(make([]byte, pos-self.size), header...), self.size); err != nil {
+		return err
+	}
+	for p := pos + int64(len(header)); p < end; {
+		n, err := io.ReadFull(data, buff[0:min(int64(len(buff)), end-p)])
+		if err != nil {
+			return err
+		}
+		if _, err = self.file.WriteAt(buff[0:n], p); err != nil {
+			return err
+		}
+		p += int64(n)
+	}
+	if padding := (align - end%align) % align; padding != 0 {
+		if _, err = self.file.WriteAt(make([]byte, padding), end); err != nil {
+			return err
+		}
+		end += padding
+	}
+	self.size = end
+
+	return self.writeContainerSize()
+}
+
+// appendedSize returns the size of file once a chunk holding size bytes is appended after pos.
+func (self *chunk_file) appendedSize(pos int64, id string, size int) int64 {
+	header, align := self.layout.newChunkHeader(id, size)
+	pos = (pos+align-1)/align*align + int64(len(header)+size)
+
+	return (pos + align - 1) / align * align
+}
+
+// ChunkCapacity returns the largest data size of a chunk appended to the file, so that the file
+// size still fits in the size field of its container. A chunk size of 2^32-1 stands for larger chunks.
+func (self *chunk_file) ChunkCapacity() uint32 {
+	_, align := self.layout.newChunkHeader(CHUNK_DEFAULT, 0)
+	limit := self.layout.maxSize() / align * align
+	empty := self.appendedSize(self.size, CHUNK_DEFAULT, 0)
+	if empty >= limit {
+		return 0
+	}
+
+	return uint32(min(limit-empty, math.MaxUint32-1))
+}
+
+// ListSubChunks returns false: only RIFF/WAVE LIST chunks are known to hold RIFF sub chunks.
+func (self *chunk_file) ListSubChunks() bool {
+	return false
+}
+
+// RemoveChunk moves the end of file over chunk c then truncates the file.
+func (self *chunk_file) RemoveChunk(c chunk_info) (err error) {
+	var length = c.length
+
+	// Last chunk may lack its padding
+	if c.offset+length > self.size {
+		length = self.size - c.offset
+	}
+
+	if err = self.moveTail(c.offset+length, -length); err != nil {
+		return err
+	}
+
+	return self.writeContainerSize()
+}
+
+// WriteChunk replaces data of chunk c. Following chunks are moved when its length changes.
+func (self *chunk_file) WriteChunk(c chunk_info, data []byte) (err error) {
+	var length = c.length
+
+	header, align := self.layout.newChunkHeader(c.id, len(data))
+	chunk := append(header, data...)
+	for int64(len(chunk))%align != 0 {
+		chunk = append(chunk, 0)
+	}
+
+	// Last chunk may lack its padding
+	if c.offset+length > self.size {
+		length = self.size - c.offset
+	}
+
+	if err = self.checkContainerSize(self.size + int64(len(chunk)) - length); err != nil {
+		return err
+	}
+	if err = self.moveTail(c.offset+length, int64(len(chunk))-length); err != nil {
+		return err
+	}
+	if _, err = self.file.WriteAt(chunk, c.offset); err != nil {
+		return err
+	}
+
+	return self.writeContainerSize()
+}
+
+// moveTail moves the end of file, from pos, by delta bytes. The file is truncated or grown.
+func (self *chunk_file) moveTail(pos int64, delta int64) (err error) {
+	var (
+		buff = make([]byte, CHUNK_MOVE_BUF)
+		n    int
+	)
+
+	switch {
+	case delta < 0:
+		// Forward, so moved bytes are read before being overwritten
+		for p := pos; p < self.size; p += int64(n) {
+			if n, err = self.file.ReadAt(buff, p); err != nil && err != io.EOF {
+				return err
+			}
+			if _, err = self.file.WriteAt(buff[0:n], p+delta); err != nil {
+				return err
+			}
+		}
+		if err = self.file.Truncate(self.size + delta); err != nil {
+			return err
+		}
+	case delta > 0:
+		// Backward, for the same reason
+		for end := self.size; end > pos; end -= int64(n) {
+			n = int(min(int64(len(buff)), end-pos))
+			if _, err = self.file.ReadAt(buff[0:n], end-int64(n)); err != nil {
+				return err
+			}
+			if _, err = self.file.WriteAt(buff[0:n], end-int64(n)+delta); err != nil {
+				return err
+			}
+		}
+	}
+
+	self.size += delta
+	if pos <= self.first_sample_pos {
+		self.first_sample_pos += delta
+	}
+
+	return nil
+}
+
+// writeContainerSize updates the size field of the container with the file size.
+func (self *chunk_file) writeContainerSize() (err error) {
+	field, pos := self.layout.containerSize(self.size)
+	_, err = self.file.WriteAt(field, pos)
+
+	return err
+}
+
+// checkContainerSize returns an error if a file of size bytes would overflow the size field of
+// its container. Callers check it before writing anything.
+func (self *chunk_file) checkContainerSize(size int64) (err error) {
+	if size > self.layout.maxSize() {
+		return errors.New(fmt.Sprintf("File \"%s\" would be too big for %s format.", self.file.Name(), self.info.format_name))
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+// Copyright (C) 2012 Stéphane Bunel. All rights reserved.
+// Use of this source code is governed by the license found in steganoWAV.go.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+type aiff_carrier struct{ chunk_file }
+
+// form_layout is the chunk layout of AIFF files: big endian 32 bits sizes, word aligned chunks.
+type form_layout struct{}
+
+//-----------------------------------------------------------------------
+//-- AIFF CARRIER
+//-----------------------------------------------------------------------
+
+// Parse parses FORM chunks of AIFF and AIFF-C files.
+func (self *aiff_carrier) Parse(file *os.File, size int64, info *wave_info_struct) (err error) {
+	/*
+	 * http://www-mmsp.ece.mcgill.ca/Documents/AudioFormats/AIFF/AIFF.html
+	 */
+
+	var (
+		chunk      = []byte{0, 0, 0, 0}
+		header     = make([]byte, 16)
+		v32        uint32
+		num_frames uint32
+		ssnd_found bool
+	)
+
+	self.file, self.size, self.info, self.layout = file, size, info, form_layout{}
+
+	self.info.big_endian = true
+
+	// FORM chunk size
+	if err = binary.Read(self.file, binary.BigEndian, &v32); err != nil {
+		return err
+	}
+
+	// Like RIFF, a wrong FORM size is tolerated: trailing bytes are ignored, truncated chunks are clamped
+	form_end := int64(v32) + 8
+	switch {
+	case form_end < self.size:
+		self.info.warnings = append(self.info.warnings, fmt.Sprintf("FORM chunk ends at %d, %d bytes before the end of file.", form_end, self.size-form_end))
+	case form_end > self.size:
+		self.info.warnings = append(self.info.warnings, fmt.Sprintf("File is truncated. FORM chunk ends at %d, %d bytes after the end of file.", form_end, form_end-self.size))
+	}
+	end := min(form_end, self.size)
+
+	// FORM chunk type
+	if err = binary.Read(self.file, binary.BigEndian, &chunk); err != nil {
+		return err
+	}
+
+	switch string(chunk[:4]) {
+	case "AIFF":
+		self.info.format_name = "AIFF"
+	case "AIFC":
+		self.info.format_name = "AIFF-C"
+	default:
+		return errors.New("Not an AIFF file")
+	}
+
+	// Chunks are word aligned
+	for pos := int64(12); pos+8 <= end; {
+		if _, err = self.file.ReadAt(header[0:8], pos); err != nil {
+			return err
+		}
+		chunklen := binary.BigEndian.Uint32(header[4:])
+
+		switch string(header[:4]) {
+		case "COMM":
+			if num_frames, err = self.parseChunkCOMM(pos+8, chunklen); err != nil {
+				return err
+			}
+		case "SSND":
+			// <offset> of first sample and <block size>
+			if _, err = self.file.ReadAt(header[8:16], pos+8); err != nil {
+				return err
+			}
+			offset := int64(binary.BigEndian.Uint32(header[8:]))
+			if offset+8 > int64(chunklen) {
+				return errors.New("Damaged file. Bad offset in SSND chunk.")
+			}
+			self.first_sample_pos = pos + 16 + offset
+			data_size := int64(chunklen) - 8 - offset
+			if self.first_sample_pos+data_size > self.size {
+				available := max(self.size-self.first_sample_pos, 0)
+				self.info.warnings = append(self.info.warnings, fmt.Sprintf("Chunk \"SSND\" at %d is truncated to %d of %d bytes.", pos, available, data_size))
+				data_size = available
+			}
+			self.info.data_bloc_size = uint32(data_size)
+			ssnd_found = true
+		default:
+			self.info.extra_chunk = true
+		}
+
+		pos += 8 + int64(chunklen) + int64(chunklen%2)
+	}
+
+	if !ssnd_found || self.info.byte_per_bloc == 0 {
+		return errors.New("Damaged file. COMM or SSND chunk is missing.")
+	}
+
+	// SSND chunk may be padded after the last frame. Computed in uint64: the product may overflow
+	if frames_size := uint64(num_frames) * uint64(self.info.byte_per_bloc); frames_size < uint64(self.info.data_bloc_size) {
+		self.info.data_bloc_size = uint32(frames_size)
+	}
+
+	// Truncated recordings may end with a partial frame
+	self.info.data_bloc_size -= self.info.data_bloc_size % self.info.byte_per_bloc
+
+	return nil
+}
+
+// parseChunkCOMM parses the common chunk of an AIFF file, stored at pos. It returns the number of frames.
+func (self *aiff_carrier) parseChunkCOMM(pos int64, chunklen uint32) (num_frames uint32, err error) {
+	var comm = make([]byte, 22)
+
+	if chunklen < 18 || (self.info.format_name == "AIFF-C" && chunklen < 22) {
+		return 0, errors.New("Damaged file. COMM chunk is too short.")
+	}
+
+	if _, err = self.file.ReadAt(comm[0:18], pos); err != nil {
+		return 0, err
+	}
+
+	// <# of channels>, <# of frames>, <bits per sample> and <frequency> as 80 bits float
+	self.info.num_channels = uint32(binary.BigEndian.Uint16(comm[0:]))
+	num_frames = binary.BigEndian.Uint32(comm[2:])
+	sample_size := uint32(binary.BigEndian.Uint16(comm[6:]))
+	frequency := extendedToFloat(comm[8:18])
+
+	// Samples are stored in whole bytes
+	self.info.audio_format = 1
+	self.info.bits_per_sample = (sample_size + 7) / 8 * 8
+	self.info.sampling_frequency = uint32(frequency + 0.5)
+	self.info.byte_per_bloc = self.info.num_channels * self.info.bits_per_sample / 8
+	self.info.bytes_per_sec = self.info.sampling_frequency * self.info.byte_per_bloc
+
+	// <compression type> of AIFF-C
+	if self.info.format_name == "AIFF-C" {
+		if _, err = self.file.ReadAt(comm[18:22], pos+18); err != nil {
+			return 0, err
+		}
+		compression := string(comm[18:22])
+		switch compression {
+		case "NONE":
+		case "sowt":
+			self.info.big_endian = false
+		default:
+			self.info.audio_format = 0
+		}
+		self.info.format_name += " (" + compression + ")"
+	}
+
+	// Checked like fmt chunks: PCM fields are divided by. Compressed sounds are rejected by parseHeaders
+	if self.info.audio_format != 1 {
+		return num_frames, nil
+	}
+	switch {
+	case self.info.num_channels == 0:
+		return 0, errors.New("Damaged file. Number of channels is 0.")
+	case sample_size == 0 || sample_size > 32:
+		return 0, errors.New(fmt.Sprintf("Damaged file. Sample size (%d bits) must be 1 to 32 bits.", sample_size))
+	}
+
+	return num_frames, nil
+}
+
+// firstChunk returns the position of the chunk following the FORM header, and the size of chunk headers.
+func (self form_layout) firstChunk() (pos int64, header_size int64) {
+	return 12, 8
+}
+
+// parseChunkHeader returns the chunk whose header, read at pos, is in header.
+func (self form_layout) parseChunkHeader(header []byte, pos int64) (c chunk_info) {
+	size := binary.BigEndian.Uint32(header[4:])
+
+	return chunk_info{id: string(header[:4]), offset: pos, data: pos + 8, length: 8 + int64(size) + int64(size%2), size: size}
+}
+
+// newChunkHeader returns the header of a chunk holding size bytes. Chunks are word aligned.
+func (self form_layout) newChunkHeader(id string, size int) (header []byte, align int64) {
+	header = make([]byte, 8)
+	copy(header, id)
+	binary.BigEndian.PutUint32(header[4:], uint32(size))
+
+	return header, 2
+}
+
+// containerSize returns the FORM chunk size of a file of size bytes, and its position.
+func (self form_layout) containerSize(size int64) (field []byte, pos int64) {
+	field = make([]byte, 4)
+	binary.BigEndian.PutUint32(field, uint32(size-8))
+
+	return field, 4
+}
+
+// maxSize returns the size of a file whose FORM chunk size is the largest 32 bits value.
+func (self form_layout) maxSize() int64 {
+	return math.MaxUint32 + 8
+}
+
+// extendedToFloat converts an 80 bits IEEE 754 extended precision number (big endian) into float64.
+func extendedToFloat(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:]) & 0x7FFF)
+	mantissa := binary.BigEndian.Uint64(b[2:])
+
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+
+	value := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if b[0]&0x80 != 0 {
+		value = -value
+	}
+
+	return value
+}
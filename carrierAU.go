@@ -0,0 +1,69 @@
+// Copyright (C) 2012 Stéphane Bunel. All rights reserved.
+// Use of this source code is governed by the license found in steganoWAV.go.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+const (
+	AU_MAGIC = ".snd"
+)
+
+type au_carrier struct{ pcm_file }
+
+//-----------------------------------------------------------------------
+//-- AU CARRIER
+//-----------------------------------------------------------------------
+
+// Parse parses the header of Sun/NeXT AU files. Samples are big endian.
+func (self *au_carrier) Parse(file *os.File, size int64, info *wave_info_struct) (err error) {
+	var header = make([]byte, 20)
+
+	self.file, self.size, self.info = file, size, info
+
+	self.info.format_name = "Sun/NeXT AU"
+	self.info.big_endian = true
+
+	// <data offset>, <data size>, <encoding>, <frequency> and <# of channels>
+	if _, err = self.file.ReadAt(header, 4); err != nil {
+		return err
+	}
+	offset := binary.BigEndian.Uint32(header[0:])
+	data_size := binary.BigEndian.Uint32(header[4:])
+	encoding := binary.BigEndian.Uint32(header[8:])
+
+	if offset < 24 || int64(offset) > self.size {
+		return errors.New("Damaged file. Bad data offset.")
+	}
+
+	// Size may be unknown (~0)
+	if int64(offset)+int64(data_size) > self.size {
+		data_size = uint32(self.size - int64(offset))
+	}
+
+	// Linear PCM only
+	self.info.audio_format = 0
+	if encoding >= 2 && encoding <= 5 {
+		self.info.audio_format = 1
+		self.info.bits_per_sample = (encoding - 1) * 8
+	}
+	self.info.sampling_frequency = binary.BigEndian.Uint32(header[12:])
+	self.info.num_channels = binary.BigEndian.Uint32(header[16:])
+	self.info.byte_per_bloc = self.info.num_channels * self.info.bits_per_sample / 8
+	self.info.bytes_per_sec = self.info.sampling_frequency * self.info.byte_per_bloc
+
+	if self.info.byte_per_bloc == 0 {
+		return errors.New("Damaged file. No channel.")
+	}
+
+	// Annotation may follow header
+	self.info.extra_chunk = offset > 24
+	self.first_sample_pos = int64(offset)
+	self.info.data_bloc_size = data_size - data_size%self.info.byte_per_bloc
+
+	return nil
+}
@@ -0,0 +1,980 @@
+// Copyright (C) 2012 Stéphane Bunel. All rights reserved.
+// Use of this source code is governed by the license found in steganoWAV.go.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+)
+
+const (
+	FLAC_MAGIC               = "fLaC"
+	FLAC_STREAMINFO          = 0     // Type of STREAMINFO metadata block
+	FLAC_SEEKTABLE           = 3     // Type of SEEKTABLE metadata block
+	FLAC_BLOCK_SIZE          = 4096  // # of samples per channel in encoded frames
+	FLAC_MAX_BLOCK_SIZE      = 65536 // Largest block size of decoded frames
+	FLAC_MAX_ORDER           = 4     // Highest order of fixed predictors
+	FLAC_MAX_PARTITION_ORDER = 8     // Highest order of Rice partitions tried by encoder
+)
+
+// flac_carrier decodes a FLAC file to a temporary RIFF/WAVE file, then encodes it back on Sync.
+// Only samples of the temporary file are used: its chunks are not those of the FLAC file.
+type flac_carrier struct {
+	pcm_file              // Samples of temporary WAVE file
+	flac_file *os.File    //
+	flac_size int64       //
+	stream    flac_stream //
+}
+
+// flac_stream keeps what is needed to encode back a FLAC file decoded to a temporary WAVE file.
+type flac_stream struct {
+	file_name    string          // Path to FLAC file
+	metadata     []flac_metadata // Metadata blocks kept on encoding (all but STREAMINFO and SEEKTABLE)
+	sample_rate  uint32          //
+	channels     uint32          //
+	bits         uint32          // Bits per sample
+	total_frames uint64          // # of samples per channel
+	md5          [16]byte        // MD5 signature of decoded samples
+}
+
+type flac_metadata struct {
+	kind byte
+	data []byte
+}
+
+// bit_reader reads a FLAC stream MSB first. The first error is kept in err.
+type bit_reader struct {
+	r     *bufio.Reader
+	bits  uint64 // Pending bits are the n low bits
+	n     uint   //
+	crc8  uint8  // CRC-8 of bytes read since reset
+	crc16 uint16 // CRC-16 of bytes read since reset
+	err   error  //
+}
+
+// bit_writer writes a FLAC frame MSB first into buf.
+type bit_writer struct {
+	buf  []byte
+	bits uint64 // Pending bits are the n low bits
+	n    uint   //
+}
+
+var (
+	flac_crc8_table  = makeFLACCRCTable(8, 0x07)
+	flac_crc16_table = makeFLACCRCTable(16, 0x8005)
+	flac_fixed_coefs = [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}
+)
+
+//-----------------------------------------------------------------------
+//-- FLAC CARRIER
+//-----------------------------------------------------------------------
+
+// Parse decodes the FLAC file to a temporary RIFF/WAVE file, then parses it.
+func (self *flac_carrier) Parse(file *os.File, size int64, info *wave_info_struct) (err error) {
+	var wave riff_carrier
+
+	self.flac_file, self.flac_size = file, size
+	self.stream.file_name = file.Name()
+
+	temp, err := os.CreateTemp("", APP+"-*.wav")
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Seek(0, os.SEEK_SET); err == nil {
+		err = self.stream.decode(file, temp)
+	}
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return errors.New(fmt.Sprintf("Failed to decode FLAC: %s", err))
+	}
+
+	fi, err := temp.Stat()
+	if err == nil {
+		_, err = temp.Seek(4, os.SEEK_SET)
+	}
+	if err == nil {
+		err = wave.Parse(temp, fi.Size(), info)
+	}
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	self.pcm_file = wave.pcm_file
+	info.format_name = "FLAC (decoded to RIFF/WAVE)"
+
+	return nil
+}
+
+// Size returns the size of FLAC file.
+func (self *flac_carrier) Size() int64 {
+	return self.flac_size
+}
+
+// Unsigned returns true: 8 bits samples are decoded to the temporary WAVE file unsigned.
+func (self *flac_carrier) Unsigned() bool {
+	return true
+}
+
+// Sync encodes the temporary WAVE file to a new FLAC file replacing the original one once complete.
+func (self *flac_carrier) Sync() (err error) {
+	var name = self.stream.file_name
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(name), "."+APP+"-*.flac")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	pcm := io.NewSectionReader(self.file, self.first_sample_pos, int64(self.info.data_bloc_size))
+	if err = self.stream.encode(pcm, out); err != nil {
+		return err
+	}
+	if err = out.Chmod(fi.Mode()); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), name)
+}
+
+// Close closes FLAC file and removes the temporary WAVE file.
+func (self *flac_carrier) Close() error {
+	if self.file != nil {
+		self.file.Close()
+		os.Remove(self.file.Name())
+	}
+
+	return self.flac_file.Close()
+}
+
+//-----------------------------------------------------------------------
+//-- FLAC CODEC
+//-----------------------------------------------------------------------
+
+// decode reads the FLAC stream r and writes a canonical WAVE file to w.
+func (self *flac_stream) decode(r io.Reader, w *os.File) (err error) {
+	var (
+		header = make([]byte, 4)
+		br     = &bit_reader{r: bufio.NewReaderSize(r, 1<<16)}
+		hash   = md5.New()
+		frames uint64
+	)
+
+	if _, err = io.ReadFull(br.r, header); err != nil {
+		return err
+	}
+
+	if string(header) != FLAC_MAGIC {
+		return errors.New("Not a FLAC file")
+	}
+
+	// Metadata blocks. STREAMINFO is rebuilt and SEEKTABLE is wrong once re-encoded
+	for last := false; !last; {
+		if _, err = io.ReadFull(br.r, header); err != nil {
+			return err
+		}
+		last = header[0]&0x80 != 0
+		kind := header[0] & 0x7F
+		data := make([]byte, uint32(header[1])<<16|uint32(header[2])<<8|uint32(header[3]))
+		if _, err = io.ReadFull(br.r, data); err != nil {
+			return err
+		}
+
+		switch kind {
+		case FLAC_STREAMINFO:
+			if len(data) < 34 {
+				return errors.New("Damaged FLAC file. STREAMINFO is too short.")
+			}
+			v := binary.BigEndian.Uint64(data[10:])
+			self.sample_rate = uint32(v >> 44)
+			self.channels = uint32(v>>41&7) + 1
+			self.bits = uint32(v>>36&31) + 1
+			self.total_frames = v & (1<<36 - 1)
+			copy(self.md5[:], data[18:34])
+		case FLAC_SEEKTABLE:
+		default:
+			self.metadata = append(self.metadata, flac_metadata{kind: kind, data: data})
+		}
+	}
+
+	if self.bits != 8 && self.bits != 16 && self.bits != 24 {
+		return errors.New(fmt.Sprintf("FLAC files with %d bits samples are not supported.", self.bits))
+	}
+
+	// Samples are written after a WAVE header filled once all frames are decoded
+	var (
+		bps     = self.bits / 8
+		out     = bufio.NewWriterSize(w, 1<<16)
+		samples = make([][]int32, self.channels)
+		pcm     []byte
+	)
+	for ch := range samples {
+		samples[ch] = make([]int32, FLAC_MAX_BLOCK_SIZE)
+	}
+	out.Write(make([]byte, 44))
+
+	for {
+		n, err := self.decodeFrame(br, samples)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// Interleave as little endian signed samples, the MD5 input
+		pcm = pcm[:0]
+		for i := 0; i < n; i++ {
+			for ch := range samples {
+				v := samples[ch][i]
+				switch bps {
+				case 1:
+					pcm = append(pcm, byte(v))
+				case 2:
+					pcm = append(pcm, byte(v), byte(v>>8))
+				default:
+					pcm = append(pcm, byte(v), byte(v>>8), byte(v>>16))
+				}
+			}
+		}
+		hash.Write(pcm)
+
+		// 8 bits WAVE samples are unsigned
+		if bps == 1 {
+			for i := range pcm {
+				pcm[i] ^= 0x80
+			}
+		}
+		if _, err = out.Write(pcm); err != nil {
+			return err
+		}
+		frames += uint64(n)
+	}
+
+	if err = out.Flush(); err != nil {
+		return err
+	}
+
+	if self.total_frames != 0 && frames != self.total_frames {
+		return errors.New(fmt.Sprintf("Damaged FLAC file. %d frames decoded, %d expected.", frames, self.total_frames))
+	}
+	self.total_frames = frames
+
+	if self.md5 != [16]byte{} && !bytes.Equal(hash.Sum(nil), self.md5[:]) {
+		return errors.New("Damaged FLAC file. MD5 signature of decoded samples mismatch.")
+	}
+
+	header, err = waveHeader(self.channels, self.sample_rate, self.bits, frames*uint64(bps*self.channels))
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteAt(header, 0)
+
+	return err
+}
+
+// decodeFrame decodes the next frame of the stream into samples (one slice per channel).
+// It returns the number of decoded samples per channel, or io.EOF after the last frame.
+func (self *flac_stream) decodeFrame(br *bit_reader, samples [][]int32) (n int, err error) {
+	br.crc8, br.crc16 = 0, 0
+
+	// Sync code followed by a reserved bit and the blocking strategy
+	if sync := br.ReadBits(15); br.err != nil {
+		return 0, br.err
+	} else if sync != 0x7FFC {
+		return 0, errors.New("Damaged FLAC file. Frame sync code not found.")
+	}
+	br.ReadBits(1)
+	bs_code := br.ReadBits(4)
+	sr_code := br.ReadBits(4)
+	ch_code := br.ReadBits(4)
+	ss_code := br.ReadBits(3)
+	br.ReadBits(1)
+
+	// Frame (or sample) number, UTF-8 coded
+	if b0 := br.ReadBits(8); b0&0x80 != 0 {
+		l := bits.LeadingZeros8(^uint8(b0))
+		if l < 2 || l > 7 {
+			return 0, errors.New("Damaged FLAC file. Bad frame number.")
+		}
+		for ; l > 1; l-- {
+			if br.ReadBits(8)&0xC0 != 0x80 {
+				return 0, errors.New("Damaged FLAC file. Bad frame number.")
+			}
+		}
+	}
+
+	switch {
+	case bs_code == 1:
+		n = 192
+	case bs_code >= 2 && bs_code <= 5:
+		n = 576 << (bs_code - 2)
+	case bs_code == 6:
+		n = int(br.ReadBits(8)) + 1
+	case bs_code == 7:
+		n = int(br.ReadBits(16)) + 1
+	case bs_code >= 8:
+		n = 256 << (bs_code - 8)
+	default:
+		return 0, errors.New("Damaged FLAC file. Reserved block size.")
+	}
+
+	switch sr_code {
+	case 12:
+		br.ReadBits(8)
+	case 13, 14:
+		br.ReadBits(16)
+	case 15:
+		return 0, errors.New("Damaged FLAC file. Bad sample rate.")
+	}
+
+	if size := []uint32{self.bits, 8, 12, 0, 16, 20, 24, 32}[ss_code]; size != self.bits {
+		return 0, errors.New("Damaged FLAC file. Sample size differs from STREAMINFO.")
+	}
+
+	crc := br.crc8
+	if uint8(br.ReadBits(8)) != crc {
+		return 0, errors.New("Damaged FLAC file. Frame header CRC mismatch.")
+	}
+
+	if (ch_code < 8 && uint32(ch_code)+1 != self.channels) || (ch_code >= 8 && (ch_code > 10 || self.channels != 2)) {
+		return 0, errors.New("Damaged FLAC file. Bad channel assignment.")
+	}
+
+	// Subframes. Side channel needs one more bit
+	for ch := range samples {
+		bps := uint(self.bits)
+		if (ch == 1 && (ch_code == 8 || ch_code == 10)) || (ch == 0 && ch_code == 9) {
+			bps++
+		}
+		if err = br.readSubframe(samples[ch][:n], bps); err != nil {
+			return 0, err
+		}
+	}
+
+	// Frame footer is byte aligned
+	br.n -= br.n % 8
+	crc16 := br.crc16
+	if uint16(br.ReadBits(16)) != crc16 {
+		if br.err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, errors.New("Damaged FLAC file. Frame CRC mismatch.")
+	}
+
+	// Stereo decorrelation
+	if ch_code >= 8 {
+		a, b := samples[0][:n], samples[1][:n]
+		for i := range a {
+			switch ch_code {
+			case 8: // left, side
+				b[i] = a[i] - b[i]
+			case 9: // side, right
+				a[i] += b[i]
+			case 10: // mid, side
+				mid := a[i]<<1 | b[i]&1
+				a[i], b[i] = (mid+b[i])>>1, (mid-b[i])>>1
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// encode reads PCM samples (WAVE byte order) from pcm and writes them as a FLAC stream to w.
+func (self *flac_stream) encode(pcm io.Reader, w *os.File) (err error) {
+	var (
+		bps        = self.bits / 8
+		frame_size = int(bps * self.channels)
+		buf        = make([]byte, FLAC_BLOCK_SIZE*frame_size)
+		samples    = make([][]int32, self.channels)
+		hash       = md5.New()
+		out        = bufio.NewWriterSize(w, 1<<16)
+		fw         = &bit_writer{}
+		min_frame  = uint32(math.MaxUint32)
+		max_frame  uint32
+		frames     uint64
+	)
+
+	for ch := range samples {
+		samples[ch] = make([]int32, FLAC_BLOCK_SIZE)
+	}
+
+	// STREAMINFO is written last, once frame sizes and MD5 are known
+	out.Write([]byte(FLAC_MAGIC))
+	out.Write(make([]byte, 4+34))
+	for i, m := range self.metadata {
+		header := []byte{m.kind, byte(len(m.data) >> 16), byte(len(m.data) >> 8), byte(len(m.data))}
+		if i == len(self.metadata)-1 {
+			header[0] |= 0x80
+		}
+		out.Write(header)
+		out.Write(m.data)
+	}
+
+	for number := uint64(0); ; number++ {
+		read, err := io.ReadFull(pcm, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		n := read / frame_size
+		if n == 0 {
+			break
+		}
+
+		// MD5 of little endian signed samples
+		if bps == 1 {
+			for i := range buf[:read] {
+				buf[i] ^= 0x80
+			}
+		}
+		hash.Write(buf[:n*frame_size])
+
+		for i := 0; i < n; i++ {
+			for ch := range samples {
+				b := buf[(i*int(self.channels)+ch)*int(bps):]
+				switch bps {
+				case 1:
+					samples[ch][i] = int32(int8(b[0]))
+				case 2:
+					samples[ch][i] = int32(int16(binary.LittleEndian.Uint16(b)))
+				default:
+					samples[ch][i] = int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+				}
+			}
+		}
+
+		frame := make([][]int32, self.channels)
+		for ch := range frame {
+			frame[ch] = samples[ch][:n]
+		}
+		self.encodeFrame(fw, frame, number)
+		if _, err = out.Write(fw.buf); err != nil {
+			return err
+		}
+
+		if uint32(len(fw.buf)) < min_frame {
+			min_frame = uint32(len(fw.buf))
+		}
+		if uint32(len(fw.buf)) > max_frame {
+			max_frame = uint32(len(fw.buf))
+		}
+		frames += uint64(n)
+	}
+
+	if err = out.Flush(); err != nil {
+		return err
+	}
+
+	// STREAMINFO
+	var (
+		info       = make([]byte, 4+34)
+		block_size = uint64(FLAC_BLOCK_SIZE)
+	)
+	if frames < block_size {
+		block_size = frames
+	}
+	if frames == 0 {
+		min_frame = 0
+	}
+	info[3] = 34
+	if len(self.metadata) == 0 {
+		info[0] = 0x80
+	}
+	binary.BigEndian.PutUint16(info[4:], uint16(block_size))
+	binary.BigEndian.PutUint16(info[6:], uint16(block_size))
+	info[8], info[9], info[10] = byte(min_frame>>16), byte(min_frame>>8), byte(min_frame)
+	info[11], info[12], info[13] = byte(max_frame>>16), byte(max_frame>>8), byte(max_frame)
+	binary.BigEndian.PutUint64(info[14:], uint64(self.sample_rate)<<44|uint64(self.channels-1)<<41|uint64(self.bits-1)<<36|frames)
+	copy(info[22:], hash.Sum(nil))
+	_, err = w.WriteAt(info, int64(len(FLAC_MAGIC)))
+
+	return err
+}
+
+// encodeFrame encodes samples (one slice per channel) as the FLAC frame number into fw.
+func (self *flac_stream) encodeFrame(fw *bit_writer, samples [][]int32, number uint64) {
+	var (
+		n       = len(samples[0])
+		bps     = uint(self.bits)
+		ch_code = uint64(self.channels - 1)
+		bs_code = uint64(7)
+	)
+
+	if n == FLAC_BLOCK_SIZE {
+		bs_code = 12 // 256 << 4
+	}
+
+	// Stereo decorrelation: the pair of channels with the cheapest residuals
+	if self.channels == 2 {
+		left, right := samples[0], samples[1]
+		mid, side := make([]int32, n), make([]int32, n)
+		for i := range mid {
+			mid[i] = int32((int64(left[i]) + int64(right[i])) >> 1)
+			side[i] = left[i] - right[i]
+		}
+		_, l := bestFixedOrder(left)
+		_, r := bestFixedOrder(right)
+		_, m := bestFixedOrder(mid)
+		_, s := bestFixedOrder(side)
+		switch {
+		case m+s < l+r && m+s <= l+s && m+s <= s+r:
+			ch_code, samples = 10, [][]int32{mid, side}
+		case l+s < l+r && l+s <= s+r:
+			ch_code, samples = 8, [][]int32{left, side}
+		case s+r < l+r:
+			ch_code, samples = 9, [][]int32{side, right}
+		}
+	}
+
+	fw.Reset()
+
+	// Header: sync code, fixed block size, block size code, sample rate from STREAMINFO
+	fw.WriteBits(0x3FFE, 14)
+	fw.WriteBits(0, 2)
+	fw.WriteBits(bs_code, 4)
+	fw.WriteBits(0, 4)
+	fw.WriteBits(ch_code, 4)
+	fw.WriteBits(map[uint]uint64{8: 1, 16: 4, 24: 6}[bps], 3)
+	fw.WriteBits(0, 1)
+	fw.WriteUTF8(number)
+	if bs_code == 7 {
+		fw.WriteBits(uint64(n-1), 16)
+	}
+	fw.WriteBits(uint64(flacCRC8(fw.buf)), 8)
+
+	for ch := range samples {
+		sub_bps := bps
+		if (ch == 1 && (ch_code == 8 || ch_code == 10)) || (ch == 0 && ch_code == 9) {
+			sub_bps++
+		}
+		fw.writeSubframe(samples[ch], sub_bps)
+	}
+
+	// Footer
+	fw.Align()
+	fw.WriteBits(uint64(flacCRC16(fw.buf)), 16)
+}
+
+// fill reads one more byte from the stream and updates CRCs.
+func (self *bit_reader) fill() {
+	b, err := self.r.ReadByte()
+	if err != nil {
+		self.err = err
+		return
+	}
+
+	self.crc8 = uint8(flac_crc8_table[self.crc8^b])
+	self.crc16 = self.crc16<<8 ^ flac_crc16_table[byte(self.crc16>>8)^b]
+	self.bits = self.bits<<8 | uint64(b)
+	self.n += 8
+}
+
+// ReadBits returns the next n bits (n <= 32) of the stream, MSB first. It returns 0 once an error occurred.
+func (self *bit_reader) ReadBits(n uint) uint64 {
+	for self.n < n && self.err == nil {
+		self.fill()
+	}
+	if self.err != nil {
+		return 0
+	}
+
+	self.n -= n
+	return self.bits >> self.n & (1<<n - 1)
+}
+
+// ReadSigned returns the next n bits of the stream as a two's complement value.
+func (self *bit_reader) ReadSigned(n uint) int64 {
+	if n == 0 {
+		return 0
+	}
+	return int64(self.ReadBits(n)<<(64-n)) >> (64 - n)
+}
+
+// ReadUnary returns the number of 0 bits before the next 1 bit.
+func (self *bit_reader) ReadUnary() (q uint64) {
+	for self.err == nil {
+		if self.n == 0 {
+			self.fill()
+			continue
+		}
+
+		pending := self.bits & (1<<self.n - 1)
+		if pending == 0 {
+			q += uint64(self.n)
+			self.n = 0
+			continue
+		}
+
+		zeros := self.n - uint(bits.Len64(pending))
+		self.n -= zeros + 1
+		return q + uint64(zeros)
+	}
+
+	return 0
+}
+
+// readSubframe decodes a subframe of bps bits samples into s.
+func (self *bit_reader) readSubframe(s []int32, bps uint) (err error) {
+	var (
+		header = self.ReadBits(8)
+		kind   = header >> 1 & 0x3F
+		wasted uint
+	)
+
+	if header&0x80 != 0 {
+		return errors.New("Damaged FLAC file. Bad subframe header.")
+	}
+
+	if header&1 != 0 {
+		wasted = uint(self.ReadUnary()) + 1
+		if wasted >= bps {
+			return errors.New("Damaged FLAC file. Bad wasted bits.")
+		}
+		bps -= wasted
+	}
+
+	switch {
+	case kind == 0: // Constant
+		v := int32(self.ReadSigned(bps))
+		for i := range s {
+			s[i] = v
+		}
+	case kind == 1: // Verbatim
+		for i := range s {
+			s[i] = int32(self.ReadSigned(bps))
+		}
+	case kind >= 8 && kind <= 12: // Fixed predictor
+		order := int(kind - 8)
+		if order > len(s) {
+			return errors.New("Damaged FLAC file. Predictor order is greater than block size.")
+		}
+		for i := 0; i < order; i++ {
+			s[i] = int32(self.ReadSigned(bps))
+		}
+		if err = self.readResidual(s, order); err != nil {
+			return err
+		}
+		restoreSignal(s, flac_fixed_coefs[order], 0)
+	case kind >= 32: // LPC
+		order := int(kind - 31)
+		if order > len(s) {
+			return errors.New("Damaged FLAC file. Predictor order is greater than block size.")
+		}
+		for i := 0; i < order; i++ {
+			s[i] = int32(self.ReadSigned(bps))
+		}
+		precision := uint(self.ReadBits(4)) + 1
+		shift := self.ReadSigned(5)
+		if precision == 16 || shift < 0 {
+			return errors.New("Damaged FLAC file. Bad LPC coefficients.")
+		}
+		coefs := make([]int64, order)
+		for i := range coefs {
+			coefs[i] = self.ReadSigned(precision)
+		}
+		if err = self.readResidual(s, order); err != nil {
+			return err
+		}
+		restoreSignal(s, coefs, uint(shift))
+	default:
+		return errors.New("Damaged FLAC file. Reserved subframe type.")
+	}
+
+	if wasted != 0 {
+		for i := range s {
+			s[i] <<= wasted
+		}
+	}
+
+	if self.err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return self.err
+}
+
+// readResidual decodes the Rice coded residual of s, following the order warm-up samples.
+func (self *bit_reader) readResidual(s []int32, order int) (err error) {
+	var (
+		method          = self.ReadBits(2)
+		partition_order = uint(self.ReadBits(4))
+		partition_size  = len(s) >> partition_order
+	)
+
+	if method > 1 {
+		return errors.New("Damaged FLAC file. Reserved residual coding method.")
+	}
+
+	if partition_size<<partition_order != len(s) || partition_size < order {
+		return errors.New("Damaged FLAC file. Bad residual partition order.")
+	}
+
+	param_bits := uint(4 + method)
+	escape := uint64(1)<<param_bits - 1
+	i := order
+	for p := 1; p <= 1<<partition_order; p++ {
+		k := uint(self.ReadBits(param_bits))
+		if uint64(k) == escape {
+			raw := uint(self.ReadBits(5))
+			for ; i < p*partition_size; i++ {
+				s[i] = int32(self.ReadSigned(raw))
+			}
+			continue
+		}
+		for ; i < p*partition_size; i++ {
+			u := self.ReadUnary()<<k | self.ReadBits(k)
+			s[i] = int32(u>>1) ^ -int32(u&1)
+		}
+	}
+
+	return self.err
+}
+
+// Reset empties the writer.
+func (self *bit_writer) Reset() {
+	self.buf = self.buf[:0]
+	self.bits, self.n = 0, 0
+}
+
+// WriteBits appends the n (n <= 32) low bits of v, MSB first.
+func (self *bit_writer) WriteBits(v uint64, n uint) {
+	self.bits = self.bits<<n | v&(1<<n-1)
+	self.n += n
+	for self.n >= 8 {
+		self.n -= 8
+		self.buf = append(self.buf, byte(self.bits>>self.n))
+	}
+}
+
+// WriteUnary appends q bits 0 followed by a bit 1.
+func (self *bit_writer) WriteUnary(q uint64) {
+	for ; q >= 32; q -= 32 {
+		self.WriteBits(0, 32)
+	}
+	self.WriteBits(1, uint(q)+1)
+}
+
+// WriteUTF8 appends v coded like an UTF-8 character (up to 36 bits).
+func (self *bit_writer) WriteUTF8(v uint64) {
+	if v < 0x80 {
+		self.WriteBits(v, 8)
+		return
+	}
+
+	n := uint(2)
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	self.WriteBits(0xFF00>>n&0xFF|v>>(6*(n-1)), 8)
+	for i := int(n) - 2; i >= 0; i-- {
+		self.WriteBits(0x80|v>>(6*uint(i))&0x3F, 8)
+	}
+}
+
+// Align pads with 0 bits up to the next byte boundary.
+func (self *bit_writer) Align() {
+	if self.n != 0 {
+		self.WriteBits(0, 8-self.n)
+	}
+}
+
+// writeSubframe encodes s (bps bits samples) with the best fixed predictor,
+// as a constant subframe or verbatim if nothing is smaller.
+func (self *bit_writer) writeSubframe(s []int32, bps uint) {
+	var constant = true
+
+	for i := range s {
+		if s[i] != s[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		self.WriteBits(0, 8)
+		self.WriteBits(uint64(s[0]), bps)
+		return
+	}
+
+	order, _ := bestFixedOrder(s)
+	residual := make([]uint64, len(s))
+	coefs := flac_fixed_coefs[order]
+	for i := order; i < len(s); i++ {
+		prediction := int64(0)
+		for j, c := range coefs {
+			prediction += c * int64(s[i-1-j])
+		}
+		r := int64(s[i]) - prediction
+		residual[i] = uint64(r<<1 ^ r>>63)
+	}
+	method, partition_order, params, size := riceParameters(residual, order)
+
+	if size+uint64(order)*uint64(bps) >= uint64(len(s))*uint64(bps) {
+		self.WriteBits(1<<1, 8)
+		for _, v := range s {
+			self.WriteBits(uint64(v), bps)
+		}
+		return
+	}
+
+	self.WriteBits(uint64(8+order)<<1, 8)
+	for _, v := range s[:order] {
+		self.WriteBits(uint64(v), bps)
+	}
+
+	self.WriteBits(method, 2)
+	self.WriteBits(uint64(partition_order), 4)
+	partition_size := len(s) >> partition_order
+	i := order
+	for p, k := range params {
+		self.WriteBits(uint64(k), 4+uint(method))
+		for ; i < (p+1)*partition_size; i++ {
+			self.WriteUnary(residual[i] >> k)
+			self.WriteBits(residual[i], k)
+		}
+	}
+}
+
+// bestFixedOrder returns the order of the fixed FLAC predictor giving the smallest residual, and its sum of absolute values.
+func bestFixedOrder(s []int32) (order int, cost uint64) {
+	var sums [FLAC_MAX_ORDER + 1]uint64
+
+	for i := FLAC_MAX_ORDER; i < len(s); i++ {
+		e0 := int64(s[i])
+		e1 := e0 - int64(s[i-1])
+		e2 := e1 - (int64(s[i-1]) - int64(s[i-2]))
+		e3 := e2 - (int64(s[i-1]) - 2*int64(s[i-2]) + int64(s[i-3]))
+		e4 := e3 - (int64(s[i-1]) - 3*int64(s[i-2]) + 3*int64(s[i-3]) - int64(s[i-4]))
+		for j, e := range []int64{e0, e1, e2, e3, e4} {
+			if e < 0 {
+				e = -e
+			}
+			sums[j] += uint64(e)
+		}
+	}
+
+	cost = sums[0]
+	for j := 1; j <= FLAC_MAX_ORDER && j < len(s); j++ {
+		if sums[j] < cost {
+			order, cost = j, sums[j]
+		}
+	}
+
+	return order, cost
+}
+
+// riceParameters chooses the partition order and the Rice parameters coding residual (zigzag values,
+// following order warm-up samples). It returns the coding method and the estimated size in bits.
+func riceParameters(residual []uint64, order int) (method uint64, partition_order uint, params []uint, size uint64) {
+	size = math.MaxUint64
+
+	for p := uint(0); p <= FLAC_MAX_PARTITION_ORDER; p++ {
+		partition_size := len(residual) >> p
+		if partition_size<<p != len(residual) || partition_size <= order {
+			break
+		}
+
+		var (
+			p_params = make([]uint, 1<<p)
+			p_size   = uint64(0)
+			p_method = uint64(0)
+		)
+		for i := range p_params {
+			start := i * partition_size
+			if i == 0 {
+				start = order
+			}
+			sum, count := uint64(0), uint64((i+1)*partition_size-start)
+			for _, u := range residual[start : (i+1)*partition_size] {
+				sum += u
+			}
+
+			// Parameter k such as mean of values is about 2^k
+			k := uint(0)
+			for k < 30 && count<<(k+1) <= sum {
+				k++
+			}
+			if k > 14 {
+				p_method = 1
+			}
+			p_params[i] = k
+			p_size += count*uint64(k+1) + sum>>k
+		}
+		p_size += uint64(len(p_params)) * (4 + p_method)
+
+		if p_size < size {
+			method, partition_order, params, size = p_method, p, p_params, p_size
+		}
+	}
+
+	return method, partition_order, params, size + 6
+}
+
+// restoreSignal replaces the residual of s, following the warm-up samples, by the signal predicted with coefs.
+func restoreSignal(s []int32, coefs []int64, shift uint) {
+	for i := len(coefs); i < len(s); i++ {
+		prediction := int64(0)
+		for j, c := range coefs {
+			prediction += c * int64(s[i-1-j])
+		}
+		s[i] += int32(prediction >> shift)
+	}
+}
+
+// makeFLACCRCTable returns the lookup table of the CRC of width bits (8 or 16) with polynomial poly.
+func makeFLACCRCTable(width uint, poly uint16) (table [256]uint16) {
+	var (
+		top  = uint16(1) << (width - 1)
+		mask = uint16(uint32(1)<<width - 1)
+	)
+
+	for i := range table {
+		crc := uint16(i) << (width - 8)
+		for j := 0; j < 8; j++ {
+			if crc&top != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc & mask
+	}
+
+	return table
+}
+
+// flacCRC8 returns the CRC-8 of a FLAC frame header.
+func flacCRC8(b []byte) (crc uint8) {
+	for _, v := range b {
+		crc = uint8(flac_crc8_table[crc^v])
+	}
+	return crc
+}
+
+// flacCRC16 returns the CRC-16 of a FLAC frame.
+func flacCRC16(b []byte) (crc uint16) {
+	for _, v := range b {
+		crc = crc<<8 ^ flac_crc16_table[byte(crc>>8)^v]
+	}
+	return crc
+}
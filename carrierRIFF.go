@@ -0,0 +1,338 @@
+// Copyright (C) 2012 Stéphane Bunel. All rights reserved.
+// Use of this source code is governed by the license found in steganoWAV.go.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	WAVE_FORMAT_EXTENSIBLE = 0xFFFE // Audio format of fmt chunks whose extra params hold the actual format
+)
+
+type riff_carrier struct{ chunk_file }
+
+// riff_layout is the chunk layout of RIFF/WAVE files: little endian 32 bits sizes, word aligned chunks.
+type riff_layout struct{}
+
+//-----------------------------------------------------------------------
+//-- RIFF/WAVE CARRIER
+//-----------------------------------------------------------------------
+
+// Parse parses RIFF/WAVE chunks.
+func (self *riff_carrier) Parse(file *os.File, size int64, info *wave_info_struct) (err error) {
+	/*
+	 * http://www.lightlink.com/tjweber/StripWav/WAVE.html#WAVE
+	 *
+	 * The *canonical* WAVE format starts with the RIFF header:
+	 * http://ccrma.stanford.edu/courses/422/projects/WaveFormat/
+	 */
+
+	var (
+		header     = make([]byte, 12)
+		fmt_found  bool
+		data_found bool
+	)
+
+	self.file, self.size, self.info, self.layout = file, size, info, riff_layout{}
+
+	self.info.format_name = "RIFF/WAVE"
+
+	// RIFF chunk size and format
+	if _, err = self.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+
+	if string(header[8:12]) != "WAVE" {
+		return errors.New("Not a WAVE file")
+	}
+
+	chunks, warnings, err := self.walkChunks()
+	if err != nil {
+		return err
+	}
+	self.info.warnings = warnings
+
+	for _, c := range chunks {
+		switch {
+		case c.id == "fmt " && !fmt_found:
+			if c.size > CHUNK_MOVE_BUF {
+				return errors.New("Damaged file. fmt chunk is too big.")
+			}
+			data := make([]byte, c.size)
+			if err = self.ReadChunk(c, 0, data); err != nil {
+				return err
+			}
+			self.info.canonical = c.size == 16 // canonical format if chunklen == 16
+			if err = self.parseChunkFmt(data); err != nil {
+				return err
+			}
+			fmt_found = true
+		case c.id == "data" && !data_found:
+			self.first_sample_pos = c.data
+			self.info.data_bloc_size = c.size
+			data_found = true
+		case c.id == "fmt " || c.id == "data":
+			self.info.warnings = append(self.info.warnings, fmt.Sprintf("Extra \"%s\" chunk at %d ignored.", c.id, c.offset))
+			self.info.extra_chunk = true
+		default:
+			self.info.extra_chunk = true
+		}
+	}
+
+	if !fmt_found || !data_found {
+		return errors.New("Damaged file. fmt or data chunk is missing.")
+	}
+
+	// Truncated recordings may end with a partial frame
+	if self.info.byte_per_bloc != 0 {
+		self.info.data_bloc_size -= self.info.data_bloc_size % self.info.byte_per_bloc
+	}
+
+	return nil
+}
+
+// walkChunks returns every chunk of the RIFF/WAVE file in file order, those following the RIFF
+// chunk included. Well known deviations are tolerated and described by warnings: RIFF size
+// different from file size, missing pad byte after odd sized chunks and truncated chunks.
+func (self *riff_carrier) walkChunks() (chunks []chunk_info, warnings []string, err error) {
+	var header = make([]byte, 8)
+
+	// RIFF chunk size
+	if _, err = self.file.ReadAt(header, 0); err != nil {
+		return nil, nil, err
+	}
+
+	switch riff_end := 8 + int64(binary.LittleEndian.Uint32(header[4:])); {
+	case riff_end < self.size:
+		warnings = append(warnings, fmt.Sprintf("RIFF chunk ends at %d, %d bytes before the end of file.", riff_end, self.size-riff_end))
+	case riff_end > self.size:
+		warnings = append(warnings, fmt.Sprintf("File is truncated. RIFF chunk ends at %d, %d bytes after the end of file.", riff_end, riff_end-self.size))
+	}
+
+	for pos := int64(12); pos < self.size; {
+		if pos+8 > self.size {
+			warnings = append(warnings, fmt.Sprintf("%d trailing bytes at %d ignored.", self.size-pos, pos))
+			break
+		}
+		if _, err = self.file.ReadAt(header, pos); err != nil {
+			return nil, nil, err
+		}
+		c := self.layout.parseChunkHeader(header, pos)
+
+		// Some writers omit the pad byte (0) of odd sized chunks
+		if last := len(chunks) - 1; last >= 0 && chunks[last].size%2 == 1 {
+			if _, err = self.file.ReadAt(header, pos-1); err != nil {
+				return nil, nil, err
+			}
+			if unpadded := self.layout.parseChunkHeader(header, pos-1); (header[0] != 0 || !validChunkID(c.id)) && validChunkID(unpadded.id) {
+				warnings = append(warnings, fmt.Sprintf("Pad byte missing after odd sized chunk \"%s\" at %d.", chunks[last].id, chunks[last].offset))
+				chunks[last].length--
+				c = unpadded
+			}
+		}
+
+		if !validChunkID(c.id) {
+			warnings = append(warnings, fmt.Sprintf("%d bytes at %d don't form a chunk. Ignored.", self.size-pos, pos))
+			break
+		}
+
+		if c.data+int64(c.size) > self.size {
+			warnings = append(warnings, fmt.Sprintf("Chunk \"%s\" at %d is truncated to %d of %d bytes.", c.id, c.offset, self.size-c.data, c.size))
+			c.size = uint32(self.size - c.data)
+			c.length = self.size - c.offset
+		} else if c.offset+c.length > self.size {
+			warnings = append(warnings, fmt.Sprintf("Pad byte missing after odd sized chunk \"%s\" at %d.", c.id, c.offset))
+			c.length = self.size - c.offset
+		}
+
+		chunks = append(chunks, c)
+		pos = c.offset + c.length
+	}
+
+	return chunks, warnings, nil
+}
+
+// Chunks returns every chunk of the RIFF/WAVE file.
+func (self *riff_carrier) Chunks() (chunks []chunk_info, err error) {
+	chunks, _, err = self.walkChunks()
+	return chunks, err
+}
+
+// AppendChunk appends a chunk after the last chunk of file. Trailing zero bytes are replaced by
+// the new chunk. Other trailing bytes would hide it from chunk walkers. Size of a truncated last
+// chunk is fixed, otherwise it would include the new chunk.
+func (self *riff_carrier) AppendChunk(id string, size int, data io.Reader) (err error) {
+	var (
+		end   = int64(12)
+		field = make([]byte, 4)
+	)
+
+	chunks, _, err := self.walkChunks()
+	if err != nil {
+		return err
+	}
+	if last := len(chunks) - 1; last >= 0 {
+		end = chunks[last].offset + chunks[last].length
+	}
+
+	// Checked before anything is written, so a failure leaves the file untouched
+	if err = self.checkContainerSize(self.appendedSize(min(end, self.size), id, size)); err != nil {
+		return err
+	}
+
+	if last := len(chunks) - 1; last >= 0 {
+		if _, err = self.file.ReadAt(field, chunks[last].offset+4); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(field) != chunks[last].size {
+			binary.LittleEndian.PutUint32(field, chunks[last].size)
+			if _, err = self.file.WriteAt(field, chunks[last].offset+4); err != nil {
+				return err
+			}
+		}
+	}
+
+	if end < self.size {
+		trailing := make([]byte, self.size-end)
+		if self.size-end > CHUNK_MOVE_BUF {
+			trailing = trailing[0:CHUNK_MOVE_BUF]
+		}
+		if _, err = self.file.ReadAt(trailing, end); err != nil {
+			return err
+		}
+		if int64(len(trailing)) != self.size-end || !bytes.Equal(trailing, make([]byte, len(trailing))) {
+			return errors.New(fmt.Sprintf("%d bytes at %d don't form a chunk. A chunk appended after them would be lost.", self.size-end, end))
+		}
+		if err = self.file.Truncate(end); err != nil {
+			return err
+		}
+		self.size = end
+	}
+
+	return self.chunk_file.AppendChunk(id, size, data)
+}
+
+// Unsigned returns true: 8 bits RIFF/WAVE samples are unsigned.
+func (self *riff_carrier) Unsigned() bool {
+	return true
+}
+
+// ListSubChunks returns true: LIST chunks of RIFF/WAVE files hold RIFF sub chunks.
+func (self *riff_carrier) ListSubChunks() bool {
+	return true
+}
+
+// firstChunk returns the position of the chunk following the RIFF header, and the size of chunk headers.
+func (self riff_layout) firstChunk() (pos int64, header_size int64) {
+	return 12, 8
+}
+
+// parseChunkHeader returns the chunk whose header, read at pos, is in header.
+func (self riff_layout) parseChunkHeader(header []byte, pos int64) (c chunk_info) {
+	size := binary.LittleEndian.Uint32(header[4:])
+
+	return chunk_info{id: string(header[:4]), offset: pos, data: pos + 8, length: 8 + int64(size) + int64(size%2), size: size}
+}
+
+// newChunkHeader returns the header of a chunk holding size bytes. Chunks are word aligned.
+func (self riff_layout) newChunkHeader(id string, size int) (header []byte, align int64) {
+	header = make([]byte, 8)
+	copy(header, id)
+	binary.LittleEndian.PutUint32(header[4:], uint32(size))
+
+	return header, 2
+}
+
+// containerSize returns the RIFF chunk size of a file of size bytes, and its position.
+func (self riff_layout) containerSize(size int64) (field []byte, pos int64) {
+	field = make([]byte, 4)
+	binary.LittleEndian.PutUint32(field, uint32(size-8))
+
+	return field, 4
+}
+
+// maxSize returns the size of a file whose RIFF chunk size is the largest 32 bits value.
+func (self riff_layout) maxSize() int64 {
+	return math.MaxUint32 + 8
+}
+
+// parseChunkFmt parses data of the fmt chunk of RIFF/WAVE and Wave64 files.
+func (self *pcm_file) parseChunkFmt(data []byte) (err error) {
+	if len(data) < 16 {
+		return errors.New("Damaged file. fmt chunk is too small.")
+	}
+
+	// <audio format> 1 = PCM not compressed
+	self.info.audio_format = uint32(binary.LittleEndian.Uint16(data[0:]))
+
+	// <# of channels>
+	self.info.num_channels = uint32(binary.LittleEndian.Uint16(data[2:]))
+
+	// <Frequency>
+	self.info.sampling_frequency = binary.LittleEndian.Uint32(data[4:])
+
+	// <Bytes per second>
+	self.info.bytes_per_sec = binary.LittleEndian.Uint32(data[8:])
+
+	// <byte per bloc>
+	self.info.byte_per_bloc = uint32(binary.LittleEndian.Uint16(data[12:]))
+
+	// <Bits per sample>
+	self.info.bits_per_sample = uint32(binary.LittleEndian.Uint16(data[14:]))
+
+	// <extra params size> (16 bits). WAVE_FORMAT_EXTENSIBLE extra params are <valid bits per sample>,
+	// <channel mask> and the sub format GUID, starting with the actual audio format.
+	if self.info.audio_format == WAVE_FORMAT_EXTENSIBLE && len(data) >= 40 && binary.LittleEndian.Uint16(data[16:]) >= 22 {
+		self.info.audio_format = uint32(binary.LittleEndian.Uint16(data[24:]))
+	}
+
+	// Other formats are rejected by parseHeaders. PCM fields are divided by: check them once here.
+	// Samples take whole bytes, 12 bits samples take 2 bytes.
+	if self.info.audio_format != 1 {
+		return nil
+	}
+	bytes_per_sample := (self.info.bits_per_sample + 7) / 8
+	switch {
+	case self.info.num_channels == 0:
+		return errors.New("Damaged file. Number of channels is 0.")
+	case bytes_per_sample == 0 || bytes_per_sample > 4:
+		return errors.New(fmt.Sprintf("Damaged file. Sample size (%d bits) must be 1 to 32 bits.", self.info.bits_per_sample))
+	case self.info.byte_per_bloc != self.info.num_channels*bytes_per_sample:
+		return errors.New(fmt.Sprintf("Damaged file. Block align (%d) differs from %d channels of %d bytes.",
+			self.info.byte_per_bloc, self.info.num_channels, bytes_per_sample))
+	}
+	self.info.bits_per_sample = bytes_per_sample * 8
+
+	return nil
+}
+
+// waveHeader returns a canonical RIFF/WAVE header for data_size bytes of PCM samples.
+func waveHeader(channels uint32, rate uint32, bits uint32, data_size uint64) (header []byte, err error) {
+	if data_size+36 > math.MaxUint32 {
+		return nil, errors.New("Sound would be too big for RIFF format.")
+	}
+
+	header = make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(data_size+36))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1)
+	binary.LittleEndian.PutUint16(header[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:], rate)
+	binary.LittleEndian.PutUint32(header[28:], rate*channels*bits/8)
+	binary.LittleEndian.PutUint16(header[32:], uint16(channels*bits/8))
+	binary.LittleEndian.PutUint16(header[34:], uint16(bits))
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(data_size))
+
+	return header, nil
+}
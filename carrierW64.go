@@ -0,0 +1,193 @@
+// Copyright (C) 2012 Stéphane Bunel. All rights reserved.
+// Use of this source code is governed by the license found in steganoWAV.go.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	W64_RIFF_GUID   = "riff\x2E\x91\xCF\x11\xA5\xD6\x28\xDB\x04\xC1\x00\x00"
+	W64_GUID_SUFFIX = "\xF3\xAC\xD3\x11\x8C\xD1\x00\xC0\x4F\x8E\xDB\x8A" // GUIDs of Wave64 chunks are their RIFF ID followed by this suffix
+)
+
+type w64_carrier struct{ chunk_file }
+
+// w64_layout is the chunk layout of Wave64 files: GUID IDs, 64 bits sizes including the header,
+// 8 bytes aligned chunks.
+type w64_layout struct{}
+
+//-----------------------------------------------------------------------
+//-- WAVE64 CARRIER
+//-----------------------------------------------------------------------
+
+// Parse parses chunks of Sony Wave64 files: RIFF like chunks with GUID IDs and 64 bits sizes.
+func (self *w64_carrier) Parse(file *os.File, size int64, info *wave_info_struct) (err error) {
+	var (
+		header     = make([]byte, 24)
+		data_found bool
+	)
+
+	self.file, self.size, self.info, self.layout = file, size, info, w64_layout{}
+
+	self.info.format_name = "Sony Wave64"
+
+	// riff chunk size (whole file) followed by wave GUID
+	if _, err = self.file.ReadAt(header, 16); err != nil {
+		return err
+	}
+
+	if string(header[8:24]) != "wave"+W64_GUID_SUFFIX {
+		return errors.New("Not a Wave64 file")
+	}
+
+	chunks, warnings, err := self.walkChunks()
+	if err != nil {
+		return err
+	}
+	self.info.warnings = warnings
+
+	for _, c := range chunks {
+		switch c.id {
+		case "fmt ":
+			if c.size > CHUNK_MOVE_BUF {
+				return errors.New("Damaged file. fmt chunk is too big.")
+			}
+			data := make([]byte, c.size)
+			if err = self.ReadChunk(c, 0, data); err != nil {
+				return err
+			}
+			self.info.canonical = c.size == 16 // canonical format if chunklen == 16
+			if err = self.parseChunkFmt(data); err != nil {
+				return err
+			}
+		case "data":
+			if c.size == math.MaxUint32 {
+				return errors.New("Sound is too big (more than 4 GiB).")
+			}
+			self.first_sample_pos = c.data
+			self.info.data_bloc_size = c.size
+			data_found = true
+		default:
+			self.info.extra_chunk = true
+		}
+	}
+
+	if !data_found || self.info.byte_per_bloc == 0 {
+		return errors.New("Damaged file. fmt or data chunk is missing.")
+	}
+
+	// Truncated recordings may end with a partial frame
+	self.info.data_bloc_size -= self.info.data_bloc_size % self.info.byte_per_bloc
+
+	return nil
+}
+
+// walkChunks returns every chunk of the Wave64 file in file order. Like RIFF, a riff size different
+// from the file size and a truncated data chunk are tolerated and described by warnings. Other chunks
+// must fit in the file.
+func (self *w64_carrier) walkChunks() (chunks []chunk_info, warnings []string, err error) {
+	var header = make([]byte, 24)
+
+	// riff chunk size, whole file included
+	if _, err = self.file.ReadAt(header[0:8], 16); err != nil {
+		return nil, nil, err
+	}
+
+	switch riff_end := binary.LittleEndian.Uint64(header); {
+	case riff_end < uint64(self.size):
+		warnings = append(warnings, fmt.Sprintf("riff chunk ends at %d, %d bytes before the end of file.", riff_end, uint64(self.size)-riff_end))
+	case riff_end > uint64(self.size):
+		warnings = append(warnings, fmt.Sprintf("File is truncated. riff chunk ends at %d, %d bytes after the end of file.", riff_end, riff_end-uint64(self.size)))
+	}
+
+	for pos := int64(40); pos < self.size; {
+		if pos+24 > self.size {
+			warnings = append(warnings, fmt.Sprintf("%d trailing bytes at %d ignored.", self.size-pos, pos))
+			break
+		}
+		if _, err = self.file.ReadAt(header, pos); err != nil {
+			return nil, nil, err
+		}
+		c := self.layout.parseChunkHeader(header, pos)
+
+		// Sizes are compared in uint64: a size close to 2^64 must not wrap to a small length
+		switch size := binary.LittleEndian.Uint64(header[16:]); {
+		case size < 24:
+			return nil, nil, errors.New(fmt.Sprintf("Damaged file. Chunk \"%s\" at %d is smaller than its header (%d bytes).", c.id, c.offset, size))
+		case size > uint64(self.size-c.offset) && c.id == "data":
+			warnings = append(warnings, fmt.Sprintf("Chunk \"%s\" at %d is truncated to %d of %d bytes.", c.id, c.offset, self.size-c.data, size-24))
+			c.size = uint32(min(self.size-c.data, math.MaxUint32))
+			c.length = self.size - c.offset
+		case size > uint64(self.size-c.offset):
+			return nil, nil, errors.New(fmt.Sprintf("Damaged file. Chunk \"%s\" at %d runs past the end of file (%d bytes).", c.id, c.offset, size))
+		case c.offset+c.length > self.size:
+			warnings = append(warnings, fmt.Sprintf("Padding missing after chunk \"%s\" at %d.", c.id, c.offset))
+			c.length = self.size - c.offset
+		}
+
+		chunks = append(chunks, c)
+		pos = c.offset + c.length
+	}
+
+	return chunks, warnings, nil
+}
+
+// Chunks returns every chunk of the Wave64 file.
+func (self *w64_carrier) Chunks() (chunks []chunk_info, err error) {
+	chunks, _, err = self.walkChunks()
+	return chunks, err
+}
+
+// Unsigned returns true: 8 bits Wave64 samples are unsigned, like RIFF/WAVE ones.
+func (self *w64_carrier) Unsigned() bool {
+	return true
+}
+
+// firstChunk returns the position of the chunk following the riff header, and the size of chunk headers.
+func (self w64_layout) firstChunk() (pos int64, header_size int64) {
+	return 40, 24
+}
+
+// parseChunkHeader returns the chunk whose header, read at pos, is in header. IDs of chunks
+// whose GUID doesn't come from a RIFF ID are the GUID in hexadecimal.
+func (self w64_layout) parseChunkHeader(header []byte, pos int64) (c chunk_info) {
+	c = chunk_info{id: string(header[:4]), offset: pos, data: pos + 24}
+	if string(header[4:16]) != W64_GUID_SUFFIX {
+		c.id = fmt.Sprintf("%X", header[:16])
+	}
+
+	// Size includes the header. It is computed in uint64 and clamped, so the length can't wrap
+	size := min(max(binary.LittleEndian.Uint64(header[16:]), 24), math.MaxInt64&^7)
+	c.length = int64((size + 7) &^ 7)
+	c.size = uint32(min(size-24, math.MaxUint32))
+
+	return c
+}
+
+// newChunkHeader returns the header of a chunk holding size bytes. Chunks are 8 bytes aligned.
+func (self w64_layout) newChunkHeader(id string, size int) (header []byte, align int64) {
+	header = make([]byte, 24)
+	copy(header, id+W64_GUID_SUFFIX)
+	binary.LittleEndian.PutUint64(header[16:], uint64(24+size))
+
+	return header, 8
+}
+
+// containerSize returns the riff chunk size of a file of size bytes, and its position.
+func (self w64_layout) containerSize(size int64) (field []byte, pos int64) {
+	field = make([]byte, 8)
+	binary.LittleEndian.PutUint64(field, uint64(size))
+
+	return field, 16
+}
+
+// maxSize returns the largest file size: the riff chunk size is a 64 bits value.
+func (self w64_layout) maxSize() int64 {
+	return math.MaxInt64
+}
@@ -55,24 +55,77 @@
 //--           * Fix size checking calculation
 //--           * --info option shows more informations when --payload is given.
 //--           * Version 1.3.2
+//-- Unreleased
+//--           * Add new option: --algorithm=<lsb|phase|chunk|reversible>
+//--             phase hides a small payload in the phase of the first FFT segment, chunk stores it
+//--             AES encrypted in a RIFF chunk, reversible expands prediction errors so extract
+//--             --restore gives back the original samples
+//--           * Add new actions: --watermark and --detect-watermark (spread spectrum, keyed PN sequence)
+//--           * Hidden data is framed by a header: magic, size and CRC-32. --hide refuses to overwrite
+//--             hidden data unless --force is given. Add new option: --scan
+//--           * Add new options: --passphrase and --keep. A passphrase selects a slot of samples spread
+//--             over the file, holding AES encrypted data. Several slots can share the same file.
+//--           * Add AIFF/AIFF-C, FLAC, Sony Wave64 and Sun/NeXT AU support through a Carrier interface.
+//--             Container format is sniffed from the first bytes of file. Each format has its own
+//--             carrier*.go file. Chunk operations are in the optional chunk_carrier interface.
+//--           * 8 bits samples are kept off extreme values. RIFF parser walks every chunk and tolerates
+//--             common deviations with warnings.
+//--           * Add new options: --chunks, --output, --bext, --offset-key and --format=<text|json>.
+//--             --offset accepts frames, timestamps and percentages, and 0.
+//--           * Command line is made of a command followed by its options. Legacy --<action> options are
+//--             still accepted. Exit codes tell error classes.
+//--           * Add new commands: analyze, compare, plan, verify, wipe and batch. hide verifies its result.
+//--           * Progress bar and Ctrl-C cancellation. lsb hide and extract process segments in parallel.
+//--           * Benchmarks in steganoWAV_test.go. Profiling options are documented: --cpuprofile,
+//--             --memprofile and --memprofilerate
+//--           * Payloads of passphrase slots, chunks and reversible hides are streamed: memory doesn't grow
+//--             with payload size.
 //
 // Building:
-// go build -ldflags "-s" steganoWAV.go
+// go build -ldflags "-s" steganoWAV.go carrier*.go
+//
+// Testing:
+// go test steganoWAV.go carrier*.go steganoWAV_test.go
 //
 
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"math"
+	"math/bits"
+	"math/cmplx"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"runtime/pprof"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf16"
 )
 
 const (
@@ -88,19 +141,211 @@ const (
 	ACTION_INFO
 	ACTION_EXTRACT
 	ACTION_HIDE
+	ACTION_WATERMARK
+	ACTION_DETECT_WATERMARK
+	ACTION_STRIP
+	ACTION_CHUNKS
+	ACTION_ANALYZE
+	ACTION_COMPARE
+	ACTION_PLAN
+	ACTION_VERIFY
+	ACTION_WIPE
+	ACTION_BATCH
+)
+
+const (
+	EXIT_OK        = 0  // Success
+	EXIT_FAILURE   = 1  // Action failed, like a write
+	EXIT_USAGE     = 2  // Bad command line
+	EXIT_IO        = 3  // A file can't be read or written
+	EXIT_FORMAT    = 4  // WAVE Audio file is not supported or damaged
+	EXIT_CAPACITY  = 5  // Payload doesn't fit in WAVE Audio file
+	EXIT_NOT_FOUND = 6  // No hidden data, slot or watermark found, or hidden data is corrupted
+	EXIT_EXISTS    = 7  // Hiding would overwrite hidden data without --force
+	EXIT_VERIFY    = 8  // Extracted data differ from payload
+	EXIT_CANCELED  = 9  // Interrupted before the end
+	EXIT_DIFFER    = 10 // compare found altered samples
+)
+
+const (
+	ALGO_LSB        = "lsb"        // Payload bits replace the LSBs of consecutive samples
+	ALGO_PHASE      = "phase"      // Payload bits are coded in the phase of the first FFT segment
+	ALGO_CHUNK      = "chunk"      // Payload is stored in a RIFF chunk appended to the file
+	ALGO_REVERSIBLE = "reversible" // Payload bits are hidden by prediction error expansion. Original samples can be restored
+)
+
+const (
+	FRAME_MAGIC        = "sWAV"  // Obfuscated with payload, it marks the beginning of hidden data
+	FRAME_HEADER_SIZE  = 12      // Magic, payload size and payload CRC-32
+	SCAN_WINDOW        = 1 << 20 // # of samples read at once when scanning for hidden data
+	VERIFY_MAX_OFFSETS = 16      // # of offsets of differing bytes reported by verify
+)
+
+const (
+	SLOT_NONCES         = 256           // # of placements tried for one passphrase
+	SLOT_IV_SIZE        = aes.BlockSize // Random IV of AES-CTR, stored in clear before the encrypted frame
+	SLOT_KDF_ITERATIONS = 100000        // PBKDF2-SHA256 iterations deriving slot keys from --passphrase
+	POSITION_BATCH      = 1 << 16       // # of positions generated, sorted and visited at once
+	POSITION_RUN_GAP    = 64            // Largest gap between two positions read in the same run of samples
+)
+
+const (
+	REVERSIBLE_SIDE_SAMPLES = 32                          // # of samples whose LSB holds the threshold of expanded errors
+	REVERSIBLE_SIDE_SIZE    = REVERSIBLE_SIDE_SAMPLES / 8 // Original LSBs of side samples, hidden before payload
+)
+
+const (
+	OFFSET_SAMPLES = "samples" // Integer: samples count, whatever the number of channels
+	OFFSET_FRAMES  = "frames"  // Integer followed by f
+	OFFSET_TIME    = "time"    // [hh:]mm:ss[.fff], or seconds followed by s
+	OFFSET_PERCENT = "percent" // Percentage of sound duration followed by %
+
+	OFFSET_KDF_ITERATIONS = 100000 // PBKDF2-SHA256 iterations deriving offsets from --offset-key
+	OFFSET_CANDIDATES     = 64     // # of derived offsets, tried in order until payload fits
+)
+
+const (
+	CHUNK_DEFAULT    = "JUNK"  // Default ID of chunks holding a payload
+	CHUNK_MOVE_BUF   = 65536   // Buffer size used to move data when a chunk is removed
+	CHUNK_DECODE_MAX = 1 << 24 // Larger chunks are listed but not decoded
+)
+
+const (
+	PROGRESS_PERIOD = 100 * time.Millisecond // Min time between two draws of the progress bar
+	PROGRESS_WIDTH  = 30                     // # of characters of the progress bar
+)
+
+const (
+	ENGINE_SEGMENT = 1 << 20 // # of payload bytes of a segment processed at once by a goroutine
+	FIB_PERIOD     = 384     // Period of the Fibonacci generator modulo 256, whatever the seed
+)
+
+const (
+	MEMPROFILE_RATE = 512 * 1024 // Default bytes allocated between two samples of the heap profile
+)
+
+const (
+	FORMAT_TEXT = "text" // Output for humans
+	FORMAT_JSON = "json" // Output for programs
+)
+
+// Fixed priors of plan, not measured on carriers: phase coding adds no noise to measure, and a chunk
+// alters no sample. They only rank these algorithms against lsb and reversible scores.
+const (
+	PLAN_PHASE_SCORE = 50 // Detectability of a fully coded phase segment: relative phases are kept, coded ones are ±π/2
+	PLAN_CHUNK_SCORE = 75 // Detectability of a payload chunk: no distortion, but shown by any chunk listing
+)
+
+const (
+	PHASE_SEGMENT_LEN   = 8192                   // # of frames per FFT segment. Must be a power of 2
+	PHASE_MIN_MAGNITUDE = PHASE_SEGMENT_LEN / 16 // Lower bound of coded bins magnitude to survive PCM rounding
+)
+
+const (
+	WATERMARK_BITS        = 48   // 32 bits of recipient ID followed by 16 bits of keyed check
+	WATERMARK_SLOT_FRAMES = 1024 // # of frames spreading one bit. Bits are repeated over the whole file
+	WATERMARK_STRENGTH    = 0.01 // Watermark amplitude relative to the local RMS (-40 dB)
 )
 
 type PayloadBloc []byte
-type SamplesBloc []byte
+type SamplesBloc []int32
+
+// progress_func is called by long operations after every bloc, with bytes of payload processed out of
+// total and the estimated time left (0 while unknown). done == 0 starts a new operation.
+type progress_func func(done, total int64, eta time.Duration)
+
+// position_func returns the position of the i-th sample of a list of samples, computed on demand
+// so that long lists are never held in memory.
+type position_func func(i uint64) uint64
 
 type global_data struct {
-	action       uint   // Action to run
-	wave_file    string // Path to WAVE/PCM file	
-	payload_file string // Path to data file
-	density      uint32 // Bits used per bytes to hide data: 1, 2, 4 or 8
-	offset       uint32 // In sample. This is one of your SECRET
-	obfuscate    uint8  // Fibonacci generator for payload obfuscation
-	cpuprofile   string // output cpuprofile into this file 
+	action         uint        // Action to run
+	wave_file      string      // Path to WAVE/PCM file
+	payload_file   string      // Path to data file
+	density        uint32      // Bits used per bytes to hide data: 1, 2, 4 or 8
+	offset         offset_spec // Start of hidden data. This is one of your SECRET
+	offset_key     string      // If given, start of hidden data is derived from it
+	obfuscate      uint8       // Fibonacci generator for payload obfuscation
+	cpuprofile     string      // If != "" then write a CPU profile to this file
+	memprofile     string      // If != "" then write a heap profile to this file once the command is done
+	memprofilerate int         // Bytes allocated between two samples of the heap profile
+	algorithm      string      // Hiding algorithm: ALGO_LSB, ALGO_PHASE, ALGO_CHUNK or ALGO_REVERSIBLE
+	key            string      // Secret key of watermark PN sequence
+	recipient_id   uint32      // Recipient ID carried by watermark
+	chunk_id       string      // ID of chunk holding payload with ALGO_CHUNK
+	force          bool        // Overwrite hidden data found in target region
+	scan           bool        // --info scans for regions holding hidden data
+	passphrase     string      // If given, selects a slot at keyed sample positions
+	keep           string_list // Passphrases of slots to keep intact while hiding
+	format         string      // Output format: FORMAT_TEXT or FORMAT_JSON
+	output         string      // If != "" then modify a copy of wave_file written to output
+	bext           string_list // Broadcast WAV fields to update, as field=value
+	compare_file   string      // Path to WAVE Audio file compared with wave_file
+	carriers       string_list // WAVE Audio files given to plan
+	payload_size   int64       // Size of payload given to plan instead of a file
+	sha256         string      // Digest of payload given to verify instead of a file
+	no_verify      bool        // hide doesn't extract back payload
+	cover_file     string      // Path to original WAVE Audio file whose samples wipe restores
+	restore_file   string      // If != "" then extract writes a copy of wave_file with original samples
+	manifest       string      // Path to CSV or JSON list of items run by batch
+	glob           string      // Pattern of WAVE Audio files run by batch instead of a manifest
+	batch_action   string      // Action of batch items not giving one: info, hide or extract
+	jobs           int         // # of batch items run at once
+	no_progress    bool        // hide, extract and verify don't draw a progress bar on a terminal
+	command        string      // Name of command given on command line, or command whose help is asked
+}
+
+// progress_bar draws the progress reported to a progress_func on a terminal line.
+type progress_bar struct {
+	output io.Writer //
+	label  string    // Operation shown before the bar
+	last   time.Time // Last draw
+	drawn  bool      // If true then the line holds the bar
+}
+
+// exit_error is an error telling the exit code of its class.
+type exit_error struct {
+	code int
+	err  error
+}
+
+// cli_command is a command of the command line, with the options it accepts.
+type cli_command struct {
+	name    string
+	action  uint
+	legacy  bool     // If true then --<name> is accepted as action option
+	usage   string   // One line summary
+	options []string // Names of accepted options
+}
+
+// offset_spec is a flag.Value holding the position given by --offset. It is converted to a sample
+// index once the WAVE Audio file is parsed.
+type offset_spec struct {
+	unit  string  // OFFSET_SAMPLES, OFFSET_FRAMES, OFFSET_TIME or OFFSET_PERCENT
+	value float64 // Samples or frames count, seconds or percentage
+	text  string  // As given
+}
+
+// string_list is a flag.Value collecting every occurrence of a repeatable option.
+type string_list []string
+
+// batch_item is an action run by batch on one WAVE Audio file, with its own options. Options
+// not given by the manifest are taken from the command line.
+type batch_item struct {
+	action       string      // info, hide or extract
+	wave_file    string      //
+	payload_file string      //
+	algorithm    string      //
+	chunk_id     string      //
+	density      uint32      //
+	offset       offset_spec //
+	offset_key   string      //
+	obfuscate    uint8       //
+	passphrase   string      //
+	output       string      // hide: modified copy of wave_file. extract: payload, default to wave_file + ".payload"
+	force        bool        //
+	no_verify    bool        //
+	err          error       // If != nil then the manifest gives a bad value for this item
 }
 
 type wave_info_struct struct {
@@ -112,23 +357,300 @@ type wave_info_struct struct {
 	bits_per_sample    uint32 //
 	data_bloc_size     uint32 //
 	// Computed values
+	format_name      string        // RIFF/WAVE, AIFF or AIFF-C
+	big_endian       bool          // Samples byte order
+	unsigned         bool          // true for 8 bits samples stored with a bias of 128 (see Carrier.Unsigned)
 	canonical        bool          // true if fmt chunk size == 16
 	extra_chunk      bool          // true if an extra chunk was skipped
+	warnings         []string      // Deviations from the format tolerated by the parser
 	bytes_per_sample uint32        // = bits_per_sample >> 3
 	num_samples      uint32        // Total number of samples
+	num_frames       uint32        // Total number of frames (one sample per channel)
 	sound_duration   time.Duration //
 }
 
+// pn_generator is a keyed pseudo noise generator of +1/-1 chips (SHA-256 in counter mode).
+type pn_generator struct {
+	key     []byte
+	counter uint64
+	block   [sha256.Size]byte
+	bit     uint
+}
+
+// chunk_node is a chunk of the RIFF tree with its decoded content, as printed by --chunks.
+type chunk_node struct {
+	ID       string        `json:"id"`
+	Offset   int64         `json:"offset"`
+	Size     uint32        `json:"size"`
+	Padding  int64         `json:"padding"`
+	ListType string        `json:"list_type,omitempty"` // Type of LIST chunks
+	Fields   []chunk_field `json:"fields,omitempty"`    // Decoded content, in chunk order
+	Children []chunk_node  `json:"children,omitempty"`  // Sub chunks of LIST chunks
+}
+
+// chunk_field is a decoded value of a chunk. A name may be repeated, like cue points.
+type chunk_field struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+type chunks_report struct {
+	File   string       `json:"file"`
+	Format string       `json:"format"`
+	Chunks []chunk_node `json:"chunks"`
+}
+
+// info_report is printed by info with --format=json.
+type info_report struct {
+	File     string           `json:"file"`
+	Format   string           `json:"format"`
+	Size     int64            `json:"size"`
+	Wave     wave_report      `json:"wave"`
+	Warnings []string         `json:"warnings"`
+	Hiding   hiding_report    `json:"hiding"`
+	Payload  *payload_report  `json:"payload,omitempty"` // If --payload is given
+	Regions  *[]region_report `json:"regions,omitempty"` // If --scan is given
+}
+
+type wave_report struct {
+	AudioFormat    uint32  `json:"audio_format"`
+	Channels       uint32  `json:"channels"`
+	SamplingRate   uint32  `json:"sampling_rate"`
+	BytesPerSecond uint32  `json:"bytes_per_second"`
+	BlockAlign     uint32  `json:"block_align"`
+	BitsPerSample  uint32  `json:"bits_per_sample"`
+	BigEndian      bool    `json:"big_endian"`
+	Canonical      bool    `json:"canonical"`
+	Samples        uint32  `json:"samples"`
+	Frames         uint32  `json:"frames"`
+	SoundSize      uint32  `json:"sound_size"`
+	Duration       float64 `json:"duration"` // Seconds
+}
+
+// hiding_report tells how the algorithm places data and how much it can hide.
+type hiding_report struct {
+	Algorithm      string  `json:"algorithm"`
+	Placement      string  `json:"placement"`                  // offset, offset_key, passphrase, segment or chunk
+	Density        uint32  `json:"density,omitempty"`          // lsb only
+	SamplesPerByte uint32  `json:"samples_per_byte,omitempty"` // lsb only
+	MaxAlteration  float64 `json:"max_alteration,omitempty"`   // lsb and reversible only. Percentage of 15% of full sample dynamic
+	Threshold      int64   `json:"threshold,omitempty"`        // reversible only. Prediction errors below it carry one bit
+	Capacity       uint32  `json:"capacity"`                   // Max payload size in bytes
+}
+
+// payload_report locates a payload. Start and Stop are unknown for slots and chunks.
+type payload_report struct {
+	File    string           `json:"file,omitempty"`
+	Size    int64            `json:"size"`
+	SHA256  string           `json:"sha256,omitempty"`
+	Samples uint32           `json:"samples,omitempty"` // # of samples altered, frame header included
+	Start   *position_report `json:"start,omitempty"`
+	Stop    *position_report `json:"stop,omitempty"`
+	Data    []byte           `json:"data,omitempty"` // Extracted payload (base64) if not written to --output
+}
+
+type position_report struct {
+	Sample    uint32 `json:"sample"`
+	Frame     uint32 `json:"frame"`
+	Timestamp string `json:"timestamp"`
+}
+
+// region_report is a region holding hidden data. Slots are spread over the file: they only have a size.
+type region_report struct {
+	Start *uint32 `json:"start,omitempty"` // First sample, or chunk position in file with chunk algorithm
+	Stop  *uint32 `json:"stop,omitempty"`  // Sample (or position) following the last one
+	Size  uint32  `json:"size"`
+}
+
+// action_report is printed by hide and extract with --format=json.
+type action_report struct {
+	Action     string         `json:"action"`
+	File       string         `json:"file"`
+	Output     string         `json:"output,omitempty"`
+	Hiding     hiding_report  `json:"hiding"`
+	Payload    payload_report `json:"payload"`
+	Written    int64          `json:"bytes_written,omitempty"` // hide only
+	Duration   float64        `json:"duration"`                // Seconds
+	Throughput float64        `json:"throughput"`              // Bytes of WAVE Audio file (hide) or payload (extract) per second
+	Verify     *verify_report `json:"verify,omitempty"`        // hide only, unless --no-verify is given
+	Restored   string         `json:"restored,omitempty"`      // extract only. Copy of WAVE Audio file with original samples
+}
+
+// plan_report is printed by plan: every configuration of every carrier, and the recommended one.
+type plan_report struct {
+	PayloadSize    int64          `json:"payload_size"`
+	Carriers       []plan_carrier `json:"carriers"`
+	Recommendation []plan_part    `json:"recommendation"` // One part per carrier used. Empty if payload fits nowhere
+}
+
+type plan_carrier struct {
+	File       string        `json:"file"`
+	Error      string        `json:"error,omitempty"` // If != "" then file can't be used as carrier
+	Format     string        `json:"format,omitempty"`
+	Bits       uint32        `json:"bits_per_sample,omitempty"`
+	Samples    uint32        `json:"samples,omitempty"`
+	Duration   float64       `json:"duration,omitempty"`    // Seconds
+	NoiseFloor float64       `json:"noise_floor,omitempty"` // RMS of samples minus the mean of their neighbours
+	Options    []plan_option `json:"options,omitempty"`
+}
+
+// plan_option is a configuration of a carrier. Detectability is a heuristic score from 0 to 100.
+type plan_option struct {
+	Algorithm     string   `json:"algorithm"`
+	Density       uint32   `json:"density,omitempty"`
+	Capacity      uint32   `json:"capacity"`
+	Distortion    *float64 `json:"distortion,omitempty"` // dBFS of noise added over the whole file. lsb and reversible only
+	Detectability float64  `json:"detectability"`
+	Prior         bool     `json:"prior,omitempty"` // True if Detectability is a fixed prior (phase and chunk), not measured on the carrier
+	Fits          bool     `json:"fits"`
+}
+
+type plan_part struct {
+	File          string  `json:"file"`
+	Algorithm     string  `json:"algorithm"`
+	Density       uint32  `json:"density,omitempty"`
+	Size          int64   `json:"size"` // Bytes of payload hidden in this carrier
+	Detectability float64 `json:"detectability"`
+}
+
+// verify_report is the result of verify, printed by verify and hide.
+type verify_report struct {
+	File           string  `json:"file"`
+	Size           int64   `json:"size"`            // Bytes extracted
+	ExpectedSize   int64   `json:"expected_size"`   // -1 if only the digest is known
+	SHA256         string  `json:"sha256"`          // Of extracted bytes
+	ExpectedSHA256 string  `json:"expected_sha256"` //
+	Differing      int64   `json:"differing"`       // # of bytes differing. -1 if unknown: only the digest is known
+	Offsets        []int64 `json:"offsets"`         // Offsets of first bytes differing
+	Match          bool    `json:"match"`
+}
+
+// batch_report is printed by batch: one result per item, in manifest order.
+type batch_report struct {
+	Jobs     int            `json:"jobs"`
+	Items    int            `json:"items"`
+	Failed   int            `json:"failed"`
+	Duration float64        `json:"duration"` // Seconds
+	Results  []batch_result `json:"results"`
+}
+
+// batch_result is the outcome of one batch item. Code and Class are the exit code and its class
+// the same command would give.
+type batch_result struct {
+	Item     int             `json:"item"` // From 1
+	Action   string          `json:"action"`
+	File     string          `json:"file"`
+	Output   string          `json:"output,omitempty"`
+	Ok       bool            `json:"ok"`
+	Code     int             `json:"code"`
+	Class    string          `json:"class,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Hiding   *hiding_report  `json:"hiding,omitempty"`        // hide and extract
+	Payload  *payload_report `json:"payload,omitempty"`       // hide and extract
+	Written  int64           `json:"bytes_written,omitempty"` // hide only
+	Info     *info_report    `json:"info,omitempty"`          // info only
+	Duration float64         `json:"duration"`                // Seconds
+}
+
+// error_report is printed instead of error messages with --format=json.
+type error_report struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Class   string `json:"class"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// bext_field is the location of a fixed size text field in a bext chunk.
+type bext_field struct {
+	start, end int
+	layout     string // If != "" then time layout the value must match
+}
+
+type cue_point struct {
+	ID           uint32 `json:"id"`
+	Position     uint32 `json:"position"`
+	Chunk        string `json:"chunk"`
+	ChunkStart   uint32 `json:"chunk_start"`
+	BlockStart   uint32 `json:"block_start"`
+	SampleOffset uint32 `json:"sample_offset"`
+}
+
+type sample_loop struct {
+	ID        uint32 `json:"id"`
+	Type      uint32 `json:"type"` // 0: forward, 1: alternating, 2: backward
+	Start     uint32 `json:"start"`
+	End       uint32 `json:"end"`
+	Fraction  uint32 `json:"fraction"`
+	PlayCount uint32 `json:"play_count"` // 0: infinite
+}
+
+type hidden_region struct {
+	start uint32 // First sample, or chunk position in file with ALGO_CHUNK
+	stop  uint32 // Sample (or position) following the last one
+	size  uint32 // Payload size
+}
+
+// verify_writer is an io.Writer comparing bytes written to it with the payload of expected,
+// or only their digest if expected is nil.
+type verify_writer struct {
+	expected io.Reader
+	digest   hash.Hash
+	size     int64   // # of bytes written
+	count    int64   // # of bytes differing from expected, missing or extra bytes included
+	offsets  []int64 // Offsets of first bytes differing
+	read     int64   // # of bytes read from expected
+	buf      []byte
+}
+
+// write_counter is an io.Writer counting bytes written to it.
+type write_counter struct {
+	n uint32
+}
+
+// keyed_permutation is a pseudo random permutation of [0, n): a Feistel network with cycle walking.
+type keyed_permutation struct {
+	n         uint64
+	half_bits uint
+	keys      [4]uint64
+}
+
+// slot_struct locates and encrypts a payload selected by a passphrase. A slot is an interval
+// of the order of samples of its passphrase, holding a random IV followed by the frame header
+// and payload encrypted with AES-CTR.
+type slot_struct struct {
+	nonce uint8              // # of placement tried until no collision with other slots
+	size  uint32             // Payload size, set once found
+	start uint64             // First index of slot in order
+	order *keyed_permutation // Pseudo random order of all samples, keyed by passphrase
+	block cipher.Block       // AES cipher of slot
+	iv    []byte             // IV of AES-CTR, random for each hide
+}
+
+// slot_key is derived once from a passphrase by PBKDF2: placements of its slots are derived
+// from key, and use order.
+type slot_key struct {
+	key   []byte             // PBKDF2 of passphrase
+	order *keyed_permutation // Order of samples of slots of passphrase
+}
+
+// error_predictor predicts interleaved samples from the two previous samples of their channel.
+type error_predictor struct {
+	previous []int64 // Previous sample of every channel, then the ones before
+	channels int
+	index    int // # of samples pushed
+}
+
 type wave_handler_struct struct {
-	wave_info                  wave_info_struct // wave_info_struct
-	wave_file_name             string           // Path to WAVE Audio file
-	wave_file_size             int64            // Should be < 2^32
-	wave_file                  *os.File         // *os.File
-	wave_start_offset          uint32           // = gd.offset counted in sample
-	wave_start_offset_in_bytes uint32           // = gd.offset * wave_info.bytes_per_sample
-	wave_first_sample_pos      uint32           // 44 for canonical RIFF/WAVE
-
-	payload_file_name        string   // Path to data file
+	wave_info         wave_info_struct // wave_info_struct
+	wave_file_name    string           // Path to WAVE Audio file
+	temp_file_name    string           // If != "" then copy of WAVE Audio file renamed to wave_file_name by Sync
+	temp_files        []string         // Copies of stdin, removed by Free
+	carrier           Carrier          // Container format of WAVE Audio file
+	offset            offset_spec      // Start of hidden data, as given
+	wave_start_offset uint32           // = offset counted in sample
+
+	payload_file_name        string   // Path to data file, or - for stdin
 	payload_file_size        int64    // Should be < 2^32
 	payload_file             *os.File // *os.File
 	payload_max_size         uint32   // # of byte that could be hidden in WAVE Audio file
@@ -139,15 +661,98 @@ type wave_handler_struct struct {
 	samples_max_offset      uint32 // Maximum offset to write one SampleBloc + bloc size
 
 	bloc_size    uint32 // Read data by bloc_size step ! Must be set at struct creation
+	algorithm    string // ALGO_LSB, ALGO_PHASE, ALGO_CHUNK or ALGO_REVERSIBLE
 	density      uint32 // Number of bits used per sample to hide payload
 	obfuscate    bool   // If true then use a Fibonacci generator to obfuscate Steg payload.
 	fib_2, fib_1 uint8  // Fibonacci registers
+
+	phase_start_frame uint32 // First frame of the phase coded segment
+
+	reversible_errors    map[int64]uint32 // Histogram of prediction errors of samples following side samples
+	reversible_max       int64            // Largest threshold keeping samples off extreme values
+	reversible_threshold int64            // Prediction errors in [-threshold, threshold) carry one bit
+	reversible_carriers  uint64           // # of samples carrying a bit with threshold
+
+	passphrase        string               // If != "" then hide in the slot selected by passphrase
+	offset_key        string               // If != "" then start of hidden data is the first fitting offset_candidates
+	offset_candidates []uint32             // Offsets derived from offset_key
+	slot_keys         map[string]*slot_key // Keys derived from passphrases, by passphrase
+
+	ctx            context.Context // If != nil then hiding and extraction stop between blocs once it is done
+	progress       progress_func   // If != nil then hiding and extraction report their progress after every bloc
+	progress_start time.Time       // Start of the operation reported to progress
+
+	workers      int    // If > 1 then # of goroutines hiding and extracting payload segments, else payload is processed bloc by bloc
+	segment_size uint32 // # of payload bytes per segment. 0 means ENGINE_SEGMENT
 }
 
 var (
 	VERSION   = fmt.Sprintf("%d.%d.%d", MAJOR, MINOR, REVISION)
-	EngSuffix = []string{"B", "KiB", "MiB", "GiB"}
+	EngSuffix = []string{"B", "KiB", "MiB", "GiB", "TiB"}
 	gd        = &global_data{}
+
+	// Commands of the command line. Options are described by optionUsage
+	cli_commands = []cli_command{
+		{"help", ACTION_HELP, false, "Show this command summary, or options of given command.", nil},
+		{"version", ACTION_VERSION, true, "Show version informations.", nil},
+		{"info", ACTION_INFO, true, "Print informations about given WAVE Audio file (need --wave option).",
+			[]string{"wave", "payload", "algorithm", "chunk", "density", "offset", "offset-key", "obfuscate", "passphrase", "scan", "format"}},
+		{"extract", ACTION_EXTRACT, true, "Extract data from given WAVE Audio file to stdout (need --wave, --offset options).",
+			[]string{"wave", "algorithm", "chunk", "density", "offset", "offset-key", "obfuscate", "passphrase", "format", "output", "restore",
+				"jobs", "no-progress"}},
+		{"hide", ACTION_HIDE, true, "Hide data into given WAVE Audio file (need --payload, --wave, --offset options).",
+			[]string{"wave", "payload", "algorithm", "chunk", "density", "offset", "offset-key", "obfuscate", "passphrase", "keep", "force", "format",
+				"output", "bext", "no-verify", "jobs", "no-progress"}},
+		{"watermark", ACTION_WATERMARK, true, "Add a spread spectrum watermark carrying a recipient ID (need --wave, --key, --id options).",
+			[]string{"wave", "key", "id", "output", "bext"}},
+		{"detect-watermark", ACTION_DETECT_WATERMARK, true, "Detect watermark and print its recipient ID (need --wave, --key options).",
+			[]string{"wave", "key"}},
+		{"strip", ACTION_STRIP, true, "Remove chunks holding a payload for given --passphrase (need --wave, --passphrase options).",
+			[]string{"wave", "passphrase", "output", "bext"}},
+		{"chunks", ACTION_CHUNKS, true, "Print every chunk of given WAVE Audio file and decode metadata chunks (need --wave option).",
+			[]string{"wave", "format"}},
+		{"analyze", ACTION_ANALYZE, false, "Look for data hidden with any density for given --obfuscate seed (need --wave option).",
+			[]string{"wave", "obfuscate", "passphrase"}},
+		{"compare", ACTION_COMPARE, false, "Count samples differing between two WAVE Audio files (need --wave, --with options).",
+			[]string{"wave", "with"}},
+		{"verify", ACTION_VERIFY, false, "Check that hidden data extracts back to payload (need --wave, --payload or --sha256 options).",
+			[]string{"wave", "payload", "sha256", "algorithm", "chunk", "density", "offset", "offset-key", "obfuscate", "passphrase", "format",
+				"jobs", "no-progress"}},
+		{"wipe", ACTION_WIPE, false, "Erase hidden data from given WAVE Audio file (need --wave and the options used to hide).",
+			[]string{"wave", "algorithm", "chunk", "density", "offset", "offset-key", "obfuscate", "passphrase", "cover", "output", "bext"}},
+		{"plan", ACTION_PLAN, false, "Recommend the least detectable configuration fitting payload (need --payload or --size, and carriers).",
+			[]string{"wave", "payload", "size", "format"}},
+		{"batch", ACTION_BATCH, false, "Run info, hide or extract on every item of a manifest or file matching a pattern (need --manifest or --glob).",
+			[]string{"manifest", "glob", "action", "jobs", "payload", "algorithm", "chunk", "density", "offset", "offset-key", "obfuscate",
+				"passphrase", "force", "no-verify", "format"}},
+	}
+
+	// Fields of bext chunks updated by --bext. time_reference and coding_history are handled apart
+	bext_fields = map[string]bext_field{
+		"description":          {0, 256, ""},
+		"originator":           {256, 288, ""},
+		"originator_reference": {288, 320, ""},
+		"origination_date":     {320, 330, "2006-01-02"},
+		"origination_time":     {330, 338, "15:04:05"},
+	}
+
+	// Columns of batch manifests. carrier and key are aliases of wave and offset_key
+	batch_columns = []string{"action", "wave", "carrier", "payload", "algorithm", "chunk", "density", "offset", "offset_key", "key",
+		"obfuscate", "passphrase", "output", "force", "no_verify"}
+
+	// Classes of exit codes, as named in json error objects
+	exit_classes = map[int]string{
+		EXIT_FAILURE:   "failure",
+		EXIT_USAGE:     "usage",
+		EXIT_IO:        "io",
+		EXIT_FORMAT:    "format",
+		EXIT_CAPACITY:  "capacity",
+		EXIT_NOT_FOUND: "not_found",
+		EXIT_EXISTS:    "exists",
+		EXIT_VERIFY:    "verify",
+		EXIT_CANCELED:  "canceled",
+		EXIT_DIFFER:    "differ",
+	}
 )
 
 //-----------------------------------------------------------------------
@@ -162,24 +767,41 @@ func (self *wave_handler_struct) OpenWave(filename string, write bool) (err erro
 		flags = os.O_RDWR
 	}
 
-	// Open WAV file
+	// Open WAV file. Stdin is copied first: carriers need random access
 	self.wave_file_name = filename
-	if self.wave_file, err = os.OpenFile(filename, flags, 0); err != nil {
+	path := filename
+	if filename == "-" {
+		if path, err = self.copyStdin(); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(path, flags, 0)
+	if err != nil {
 		return err
 	}
 
 	// Get system file size
-	if fi, err := self.wave_file.Stat(); err == nil {
-		self.wave_file_size = fi.Size()
-	} else {
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
 		return err
 	}
 
-	// Decode WAVE header
-	if err = self.parseHeaders(); err != nil {
+	// Decode WAVE header. Once created, carrier owns file
+	if err = self.parseHeaders(file, fi.Size()); err != nil {
+		if self.carrier == nil {
+			file.Close()
+		}
 		return err
 	}
 
+	// File is about to be modified
+	if write {
+		for _, warning := range self.wave_info.warnings {
+			fmt.Fprintf(os.Stderr, "Warning: \"%s\": %s\n", filename, warning)
+		}
+	}
+
 	return nil
 }
 
@@ -190,8 +812,14 @@ func (self *wave_handler_struct) OpenPayload(filename string) (err error) {
 		file_size int64
 	)
 
-	// Open Payload file
-	f, err = os.OpenFile(filename, os.O_RDONLY, 0)
+	// Open Payload file. Stdin is copied first: its size is needed before hiding
+	path := filename
+	if filename == "-" {
+		if path, err = self.copyStdin(); err != nil {
+			return err
+		}
+	}
+	f, err = os.OpenFile(path, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
@@ -209,12 +837,50 @@ func (self *wave_handler_struct) OpenPayload(filename string) (err error) {
 	self.payload_file = f
 
 	// Compute and check room space.
-	self.samples_to_hide_payload = uint32(self.payload_file_size+4) * self.samples_for_one_byte
-	if self.samples_to_hide_payload > self.wave_info.num_samples {
+	if self.algorithm == ALGO_PHASE {
+		if self.payload_file_size > int64(self.payload_max_size) {
+			return errors.New(fmt.Sprintf("Payload (%s) is too big to be phase coded in (%s). Max is %d bytes\n", self.payload_file_name, self.wave_file_name, self.payload_max_size))
+		}
+		return nil
+	}
+
+	if self.algorithm == ALGO_CHUNK {
+		if self.payload_file_size > int64(self.payload_max_size) {
+			return errors.New(fmt.Sprintf("Payload (%s) is too big to be stored in a chunk of (%s)\n", self.payload_file_name, self.wave_file_name))
+		}
+		return nil
+	}
+
+	// Smallest threshold fitting payload alters samples the least
+	if self.algorithm == ALGO_REVERSIBLE {
+		if self.payload_file_size > int64(self.payload_max_size) {
+			return errors.New(fmt.Sprintf("Payload (%s) is too big to be hidden reversibly in (%s). Max is %d bytes\n", self.payload_file_name, self.wave_file_name, self.payload_max_size))
+		}
+		bits := uint64(self.payload_file_size+FRAME_HEADER_SIZE+REVERSIBLE_SIDE_SIZE) * 8
+		self.reversible_threshold, _ = reversibleThreshold(self.reversible_errors, self.reversible_max, bits)
+		self.reversible_carriers = bits
+		return nil
+	}
+
+	// Computed in uint64: payloads of 512 MiB and more would wrap around in uint32
+	samples := uint64(self.payload_file_size+FRAME_HEADER_SIZE) * uint64(self.samples_for_one_byte)
+	if samples > uint64(self.wave_info.num_samples) {
 		return errors.New(fmt.Sprintf("Payload (%s) is too big to be hidden in (%s)\n", self.payload_file_name, self.wave_file_name))
 	}
+	self.samples_to_hide_payload = uint32(samples)
+
+	// Slots don't depend on offset
+	if self.passphrase != "" {
+		if self.payload_file_size > int64(self.payload_max_size) {
+			return errors.New(fmt.Sprintf("Payload (%s) is too big to be hidden in a slot of (%s)\n", self.payload_file_name, self.wave_file_name))
+		}
+		return nil
+	}
 
 	self.samples_max_offset = self.wave_info.num_samples - self.samples_to_hide_payload
+	if self.offset_key != "" {
+		return self.selectKeyedOffset()
+	}
 	if self.wave_start_offset > self.samples_max_offset {
 		return errors.New(fmt.Sprintf("Offset (%d) is too big. Max is %d for \"%s\"\n", self.wave_start_offset, self.samples_max_offset, self.wave_file_name))
 	}
@@ -233,8 +899,10 @@ func (self *wave_handler_struct) PrintWAVInfo(output *os.File) (err error) {
 	msg = fmt.Sprintf("WAVE Audio file informations\n")
 	msg += fmt.Sprintf("============================\n")
 	msg += fmt.Sprintf("  File path                      : \"%s\"\n", self.wave_file_name)
-	msg += fmt.Sprintf("  File size                      : %s (%d bytes)\n", intToSuffixedStr(uint32(self.wave_file_size)), self.wave_file_size)
+	msg += fmt.Sprintf("  File size                      : %s (%d bytes)\n", int64ToSuffixedStr(self.carrier.Size()), self.carrier.Size())
+	msg += fmt.Sprintf("  Container format               : %s\n", self.carrier.Format())
 	msg += fmt.Sprintf("  Canonical format               : %v\n", self.wave_info.canonical && !self.wave_info.extra_chunk)
+	msg += fmt.Sprintf("  Sample byte order              : %s\n", map[bool]string{false: "little endian", true: "big endian"}[self.wave_info.big_endian])
 	msg += fmt.Sprintf("  Audio format                   : %d\n", self.wave_info.audio_format)
 	msg += fmt.Sprintf("  Number of channels             : %d\n", self.wave_info.num_channels)
 	msg += fmt.Sprintf("  Sampling rate                  : %d Hz\n", self.wave_info.sampling_frequency)
@@ -242,29 +910,103 @@ func (self *wave_handler_struct) PrintWAVInfo(output *os.File) (err error) {
 	msg += fmt.Sprintf("  Sample size                    : %d bits (%d bytes)\n", self.wave_info.bits_per_sample, self.wave_info.bytes_per_sample)
 	// Computed values:
 	msg += fmt.Sprintf("  Number of samples              : %d\n", self.wave_info.num_samples)
+	msg += fmt.Sprintf("  Number of frames               : %d\n", self.wave_info.num_frames)
 	msg += fmt.Sprintf("  Sound size                     : %s (%d bytes)\n", intToSuffixedStr(self.wave_info.data_bloc_size), self.wave_info.data_bloc_size)
-	msg += fmt.Sprintf("  Sound duration                 : %v\n", self.wave_info.sound_duration)
+	msg += fmt.Sprintf("  Sound duration                 : %v (%s)\n", self.wave_info.sound_duration, self.frameTimestamp(self.wave_info.num_frames))
+	//
+	if len(self.wave_info.warnings) != 0 {
+		msg += fmt.Sprintf("\nWarnings\n")
+		msg += fmt.Sprintf("========\n")
+		for _, warning := range self.wave_info.warnings {
+			msg += fmt.Sprintf("  %s\n", warning)
+		}
+	}
+	// AU and FLAC files have no chunks
+	if chunked, ok := self.carrier.(chunk_carrier); ok {
+		chunks, err := chunked.Chunks()
+		if err != nil {
+			return err
+		}
+		msg += fmt.Sprintf("\nChunks informations\n")
+		msg += fmt.Sprintf("===================\n")
+		for _, c := range chunks {
+			msg += fmt.Sprintf("  \"%s\" at %-10d             : %s (%d bytes)", c.id, c.offset, intToSuffixedStr(c.size), c.size)
+			if padding := c.length - (c.data - c.offset) - int64(c.size); padding != 0 {
+				msg += fmt.Sprintf(", %d padding byte(s)", padding)
+			}
+			if self.algorithm == ALGO_CHUNK {
+				if payload, err := self.chunkPayload(c); err != nil {
+					return err
+				} else if payload != nil {
+					msg += fmt.Sprintf(", holds a payload of %d bytes", len(payload))
+				}
+			}
+			msg += "\n"
+		}
+	}
 	//
 	msg += fmt.Sprintf("\nHiding informations\n")
 	msg += fmt.Sprintf("===================\n")
-	msg += fmt.Sprintf("  Density                        : %d bits per sample\n", self.density)
-	msg += fmt.Sprintf("    Samples for hide one byte    : %d\n", self.samples_for_one_byte)
-	msg += fmt.Sprintf("    Max sample alteration        : %.5f%% at 15%% of full sample dynamic\n", max_disto)
-	msg += fmt.Sprintf("    Max payload size             : %s (%d bytes)\n", intToSuffixedStr(self.payload_max_size), self.payload_max_size)
+	msg += fmt.Sprintf("  Algorithm                      : %s\n", self.algorithm)
+	if self.algorithm == ALGO_CHUNK {
+		msg += fmt.Sprintf("    Max payload size             : %s (%d bytes)\n", intToSuffixedStr(self.payload_max_size), self.payload_max_size)
+	} else if self.algorithm == ALGO_PHASE {
+		segment_duration := time.Duration(float64(PHASE_SEGMENT_LEN) / float64(self.wave_info.sampling_frequency) * float64(time.Second))
+		msg += fmt.Sprintf("  Segment length                 : %d frames (%v)\n", PHASE_SEGMENT_LEN, segment_duration)
+		msg += fmt.Sprintf("    Coded segment at frame       : %d (%s)\n", self.phase_start_frame, self.frameTimestamp(self.phase_start_frame))
+		msg += fmt.Sprintf("    Max payload size             : %s (%d bytes)\n", intToSuffixedStr(self.payload_max_size), self.payload_max_size)
+	} else if self.algorithm == ALGO_REVERSIBLE {
+		msg += fmt.Sprintf("  Expansion threshold            : %d (max %d)\n", self.reversible_threshold, self.reversible_max)
+		msg += fmt.Sprintf("    Samples carrying a bit       : %d\n", self.reversible_carriers)
+		msg += fmt.Sprintf("    Max sample alteration        : %.5f%% at 15%% of full sample dynamic\n",
+			100.0*float64(self.reversible_threshold)/sample_dynamic_at_x_percent)
+		msg += fmt.Sprintf("    Max payload size             : %s (%d bytes)\n", intToSuffixedStr(self.payload_max_size), self.payload_max_size)
+	} else {
+		if self.passphrase != "" {
+			msg += fmt.Sprintf("  Placement                      : keyed by passphrase\n")
+		} else if self.offset_key != "" {
+			msg += fmt.Sprintf("  Placement                      : offset derived from key\n")
+		}
+		msg += fmt.Sprintf("  Density                        : %d bits per sample\n", self.density)
+		msg += fmt.Sprintf("    Samples for hide one byte    : %d\n", self.samples_for_one_byte)
+		msg += fmt.Sprintf("    Max sample alteration        : %.5f%% at 15%% of full sample dynamic\n", max_disto)
+		msg += fmt.Sprintf("    Max payload size             : %s (%d bytes)\n", intToSuffixedStr(self.payload_max_size), self.payload_max_size)
+	}
 	//
-	if self.payload_file != nil {
+	if self.payload_file != nil && self.algorithm == ALGO_CHUNK {
+		msg += fmt.Sprintf("\nPayload informations\n")
+		msg += fmt.Sprintf("====================\n")
+		msg += fmt.Sprintf("    File path                    : \"%s\"\n", self.payload_file_name)
+		msg += fmt.Sprintf("    File size                    : %s (%d bytes)\n", int64ToSuffixedStr(self.payload_file_size), self.payload_file_size)
+	} else if self.payload_file != nil && self.algorithm == ALGO_REVERSIBLE {
+		start := self.wave_start_offset
+		msg += fmt.Sprintf("\nPayload informations\n")
+		msg += fmt.Sprintf("====================\n")
+		msg += fmt.Sprintf("    File path                    : \"%s\"\n", self.payload_file_name)
+		msg += fmt.Sprintf("    File size                    : %s (%d bytes)\n", int64ToSuffixedStr(self.payload_file_size), self.payload_file_size)
+		msg += fmt.Sprintf("    Start at sample              : %d (%s)\n", start, self.frameTimestamp(start/self.wave_info.num_channels))
+		msg += fmt.Sprintf("    Stop at sample               : %d (%s)\n", self.wave_info.num_samples, self.frameTimestamp(self.wave_info.num_frames))
+	} else if self.payload_file != nil && self.algorithm == ALGO_PHASE {
+		msg += fmt.Sprintf("\nPayload informations\n")
+		msg += fmt.Sprintf("====================\n")
+		msg += fmt.Sprintf("    File path                    : \"%s\"\n", self.payload_file_name)
+		msg += fmt.Sprintf("    File size                    : %s (%d bytes)\n", int64ToSuffixedStr(self.payload_file_size), self.payload_file_size)
+		msg += fmt.Sprintf("    Start at frame               : %d (%s)\n", self.phase_start_frame, self.frameTimestamp(self.phase_start_frame))
+		msg += fmt.Sprintf("    Stop at frame                : %d (%s)\n", self.phase_start_frame+PHASE_SEGMENT_LEN, self.frameTimestamp(self.phase_start_frame+PHASE_SEGMENT_LEN))
+	} else if self.payload_file != nil {
 		samples_to_hide_payload_percent := float64(self.samples_to_hide_payload) / float64(self.wave_info.num_samples) * 100
-		hidden_start_time := time.Duration(float64(self.wave_start_offset_in_bytes)/float64(self.wave_info.bytes_per_sec)) * time.Second
+		start := self.wave_start_offset
+		stop := self.wave_start_offset + self.samples_to_hide_payload
 
 		msg += fmt.Sprintf("\nPayload informations\n")
 		msg += fmt.Sprintf("====================\n")
 		msg += fmt.Sprintf("    File path                    : \"%s\"\n", self.payload_file_name)
-		msg += fmt.Sprintf("    File size                    : %s (%d bytes)\n", intToSuffixedStr(uint32(self.payload_file_size)), self.payload_file_size)
+		msg += fmt.Sprintf("    File size                    : %s (%d bytes)\n", int64ToSuffixedStr(self.payload_file_size), self.payload_file_size)
 		msg += fmt.Sprintf("    Samples to hide payload      : %d (%.2f%%)\n", self.samples_to_hide_payload, samples_to_hide_payload_percent)
 		msg += fmt.Sprintf("    Max samples offset           : %d\n", self.wave_info.num_samples-self.samples_to_hide_payload)
-		msg += fmt.Sprintf("    User samples offset          : %d (%v)\n", self.wave_start_offset, hidden_start_time)
-		msg += fmt.Sprintf("    Start at sample              : %d\n", self.wave_start_offset)
-		msg += fmt.Sprintf("    Stop at sample               : %d\n", self.wave_start_offset+self.samples_to_hide_payload)
+		msg += fmt.Sprintf("    User samples offset          : %d (frame %d)\n", start, start/self.wave_info.num_channels)
+		msg += fmt.Sprintf("    Start at sample              : %d (%s)\n", start, self.frameTimestamp(start/self.wave_info.num_channels))
+		msg += fmt.Sprintf("    Stop at sample               : %d (%s)\n", stop, self.frameTimestamp(stop/self.wave_info.num_channels))
 	}
 
 	fmt.Fprintln(output, msg)
@@ -272,230 +1014,473 @@ func (self *wave_handler_struct) PrintWAVInfo(output *os.File) (err error) {
 }
 
 // HidePayload
+// Payload is hidden by self.workers goroutines if > 1, else bloc by bloc. If self.ctx is done before
+// the end, the frame header is erased so the part already hidden can't be extracted.
 func (self *wave_handler_struct) HidePayload(sample_offset uint32) (err error) {
 	var (
-		payload_bloc_size  = self.bloc_size
-		samples_bloc_size  = payload_bloc_size * self.samples_for_one_byte * self.wave_info.bytes_per_sample
-		payload_bloc       = make(PayloadBloc, payload_bloc_size)
-		samples_bloc       = make(SamplesBloc, samples_bloc_size)
-		byte_offset        = sample_offset * self.wave_info.bytes_per_sample // Offset is expressed as sample count
-		s_pos              = int64(self.wave_first_sample_pos + byte_offset)
-		payload_bytes_read int
-		samples_bytes_read int
+		s_pos = uint64(sample_offset) // Offset is expressed as sample count
+		done  int64
 	)
 
-	// Seek to desired sample offset
-	if s_pos, err = self.wave_file.Seek(int64(s_pos), os.SEEK_SET); err != nil {
-		return err
+	if err = self.progressStep(0, self.payload_file_size); err != nil {
+		return &exit_error{EXIT_CANCELED, errors.New("Canceled before hiding anything.")}
 	}
 
-	//-------------- Write len of payload
-	buff := new(bytes.Buffer)
-	err = binary.Write(buff, binary.LittleEndian, uint32(self.payload_file_size))
-	steg_bloc := make(SamplesBloc, uint32(buff.Len())*self.samples_for_one_byte*self.wave_info.bytes_per_sample)
-	var size_bloc PayloadBloc = buff.Bytes()
-	if samples_bytes_read, err = self.wave_file.Read(steg_bloc[0:]); err != nil {
+	//-------------- Write frame header
+	size_bloc, err := self.payloadFrameHeader()
+	if err != nil {
+		return err
+	}
+	steg_bloc := make(SamplesBloc, uint32(len(size_bloc))*self.samples_for_one_byte)
+	self.resetObfuscation()
+	if err = self.carrier.ReadSamples(s_pos, steg_bloc); err != nil {
 		return err
 	}
-	s_pos, err = self.wave_file.Seek(int64(-samples_bytes_read), os.SEEK_CUR)
 	self.StegBloc(&size_bloc, &steg_bloc)
-	if _, err = self.wave_file.Write(steg_bloc[0:samples_bytes_read]); err != nil {
+	if err = self.carrier.WriteSamples(s_pos, steg_bloc); err != nil {
 		return err
 	}
+	s_pos += uint64(len(steg_bloc))
 	//--------------
 
-	// Read first payload bloc
-	if payload_bytes_read, err = self.payload_file.Read(payload_bloc[0:]); err != nil {
-		if err != io.EOF {
+	if self.workers > 1 {
+		done, err = self.hideSegments(s_pos)
+	} else {
+		done, err = self.hideBlocs(s_pos)
+	}
+
+	if err != nil && self.ctx != nil && err == self.ctx.Err() {
+		if err = self.scrambleFrameHeader(sample_offset); err != nil {
 			return err
 		}
+		return &exit_error{EXIT_CANCELED, errors.New(fmt.Sprintf("Canceled after hiding %s of %s: frame header erased, nothing can be extracted.",
+			int64ToSuffixedStr(done), int64ToSuffixedStr(self.payload_file_size)))}
 	}
 
-	// Read first samples bloc
-	if samples_bytes_read, err = self.wave_file.Read(samples_bloc[0:]); err != nil {
+	return err
+}
+
+// hideBlocs hides payload in samples from s_pos, one bloc after the other. Returns the # of bytes hidden.
+func (self *wave_handler_struct) hideBlocs(s_pos uint64) (done int64, err error) {
+	var (
+		payload_bloc_size  = self.bloc_size
+		samples_bloc_size  = payload_bloc_size * self.samples_for_one_byte
+		payload_bloc       = make(PayloadBloc, payload_bloc_size)
+		samples_bloc       = make(SamplesBloc, samples_bloc_size)
+		payload_bytes_read int
+	)
+
+	// Read first payload bloc
+	if payload_bytes_read, err = self.payload_file.Read(payload_bloc[0:]); err != nil {
 		if err != io.EOF {
-			return err
+			return done, err
 		}
 	}
 
 	// Loop until payload EOF
 	for payload_bytes_read != 0 {
-		// Steg
-		self.StegBloc(&payload_bloc, &samples_bloc)
+		// Steg only bytes read, so samples following payload are left untouched
+		payload_read := payload_bloc[0:payload_bytes_read]
+		samples_used := samples_bloc[0 : uint32(payload_bytes_read)*self.samples_for_one_byte]
+		if err = self.carrier.ReadSamples(s_pos, samples_used); err != nil {
+			return done, err
+		}
+		self.StegBloc(&payload_read, &samples_used)
 
 		// Write
-		if s_pos, err = self.wave_file.Seek(int64(-samples_bytes_read), os.SEEK_CUR); err != nil {
-			return err
+		if err = self.carrier.WriteSamples(s_pos, samples_used); err != nil {
+			return done, err
 		}
+		s_pos += uint64(len(samples_used))
 
-		if _, err = self.wave_file.Write(samples_bloc[0:samples_bytes_read]); err != nil {
-			return err
+		// Stop between blocs. Once the last bloc is written, payload is hidden anyway
+		done += int64(payload_bytes_read)
+		if err = self.progressStep(done, self.payload_file_size); err != nil && done < self.payload_file_size {
+			return done, err
 		}
 
-		s_pos, err = self.wave_file.Seek(0, os.SEEK_CUR)
-
-		// Read next blocs
+		// Read next bloc
 		if payload_bytes_read, err = self.payload_file.Read(payload_bloc[0:]); err != nil {
 			if err != io.EOF {
-				return err
-			}
-		}
-
-		if payload_bytes_read > 0 {
-			if samples_bytes_read, err = self.wave_file.Read(samples_bloc[0:]); err != nil {
-				if err != io.EOF {
-					return err
-				}
+				return done, err
 			}
 		}
 	}
-	self.wave_file.Sync()
 
-	return nil
+	return done, nil
 }
 
 // Extract payload
-func (self *wave_handler_struct) ExtractPayload(offset uint32, output *os.File) (err error) {
+// Payload is extracted by self.workers goroutines if > 1, else bloc by bloc. It is written in order.
+func (self *wave_handler_struct) ExtractPayload(offset uint32, output io.Writer) (err error) {
 	var (
-		payload_bloc_size  = self.bloc_size
-		samples_bloc_size  = payload_bloc_size * self.samples_for_one_byte * self.wave_info.bytes_per_sample
-		payload_bloc       = make(PayloadBloc, payload_bloc_size)
-		samples_bloc       = make(SamplesBloc, samples_bloc_size)
-		byte_to_read       uint32
-		wave_file          = self.wave_file
-		p_size             uint32
-		samples_bytes_read int
+		header_size uint32 = FRAME_HEADER_SIZE
+		p_size      uint32
+		p_crc       uint32
+		framed      bool
+		crc         = crc32.NewIEEE()
+		done        int64
 	)
 
-	// Jump to beginning of hidden data.
-	offset *= uint32(self.wave_info.bytes_per_sample)
-	if _, err = wave_file.Seek(int64(self.wave_first_sample_pos+offset), os.SEEK_SET); err != nil {
-		return err
+	if offset >= self.wave_info.num_samples {
+		return errors.New(fmt.Sprintf("Offset (%d) is too big. Max is %d for \"%s\"", offset, self.wave_info.num_samples-1, self.wave_file_name))
 	}
+	max_size := (self.wave_info.num_samples - offset) / self.samples_for_one_byte
 
-	// Get size of hidden data to extract (in bytes)
-	payload := make(PayloadBloc, 4) // uint32
-	samples := make(SamplesBloc, 4*self.samples_for_one_byte*self.wave_info.bytes_per_sample)
-	buff := bytes.NewBuffer(payload)
-	if samples_bytes_read, err = self.wave_file.Read(samples[0:]); err != nil {
+	// Get frame header of hidden data
+	self.resetObfuscation()
+	header, err := self.unstegAt(offset, FRAME_HEADER_SIZE)
+	if err != nil {
 		return err
 	}
-	self.UnstegBloc(&samples, &payload)
-	if err = binary.Read(buff, binary.LittleEndian, &p_size); err != nil {
-		return err
+
+	if p_size, p_crc, framed = parseFrameHeader(header); framed {
+		max_size -= FRAME_HEADER_SIZE
+	} else {
+		// Version 1.3 only stored the size of hidden data
+		self.resetObfuscation()
+		if header, err = self.unstegAt(offset, 4); err != nil {
+			return err
+		}
+		p_size = binary.LittleEndian.Uint32(header)
+		header_size = 4
+		max_size -= 4
 	}
-	//fmt.Fprintf(os.Stderr, "Read payload of size %d (--%d--)\n", p_size, samples_bytes_read)
 
 	// Check Consistency of data_size
-	if p_size > self.payload_max_size {
+	if p_size > max_size {
 		return errors.New(fmt.Sprintf("Consistency error. "+
 			"Size of data to extract (%s) is bigger than maximum (%s) payload. Maybe a wrong offset ?",
-			intToSuffixedStr(p_size), intToSuffixedStr(self.payload_max_size)))
+			intToSuffixedStr(p_size), intToSuffixedStr(max_size)))
 	}
 
-	byte_to_read = (p_size * self.samples_for_one_byte * self.wave_info.bytes_per_sample)
-	for byte_to_read != 0 {
-
-		if byte_to_read < uint32(len(samples_bloc)) {
-			p_len := byte_to_read / self.wave_info.bytes_per_sample / self.samples_for_one_byte
-			samples_bloc = samples_bloc[0:byte_to_read]
-			payload_bloc = payload_bloc[0:p_len]
-		}
-
-		if samples_bytes_read, err = self.wave_file.Read(samples_bloc[0:]); err != nil {
-			if err != io.EOF {
-				return err
-			}
+	s_pos := uint64(offset + header_size*self.samples_for_one_byte)
+	if err = self.progressStep(0, int64(p_size)); err == nil {
+		if self.workers > 1 {
+			done, err = self.extractSegments(s_pos, header_size, p_size, io.MultiWriter(crc, output))
+		} else {
+			done, err = self.extractBlocs(s_pos, p_size, io.MultiWriter(crc, output))
 		}
+	}
 
-		byte_to_read -= uint32(samples_bytes_read)
+	if err != nil && self.ctx != nil && err == self.ctx.Err() {
+		return &exit_error{EXIT_CANCELED, errors.New(fmt.Sprintf("Canceled after extracting %s of %s.",
+			int64ToSuffixedStr(done), intToSuffixedStr(p_size)))}
+	}
+	if err != nil {
+		return err
+	}
 
-		self.UnstegBloc(&samples_bloc, &payload_bloc)
-		output.Write(payload_bloc[0:])
+	if framed && crc.Sum32() != p_crc {
+		return errors.New("CRC error. Extracted data is corrupted. Maybe a wrong offset or obfuscation seed ?")
 	}
 
 	return nil
 }
 
-// parseHeaders parses the file headers and collect informations.
-func (self *wave_handler_struct) parseHeaders() (err error) {
-	/*
-	 * http://www.lightlink.com/tjweber/StripWav/WAVE.html#WAVE
-	 *
-	 * The *canonical* WAVE format starts with the RIFF header:
-	 * http://ccrma.stanford.edu/courses/422/projects/WaveFormat/
-	 */
-
+// extractBlocs writes to output p_size bytes extracted from samples following s_pos, one bloc after
+// the other. Returns the # of bytes extracted.
+func (self *wave_handler_struct) extractBlocs(s_pos uint64, p_size uint32, output io.Writer) (done int64, err error) {
 	var (
-		chunk            = []byte{0, 0, 0, 0}
-		wave_file        = self.wave_file
-		v32              uint32
-		parse_next_chunk = true
+		payload_bloc_size = self.bloc_size
+		samples_bloc_size = payload_bloc_size * self.samples_for_one_byte
+		payload_bloc      = make(PayloadBloc, payload_bloc_size)
+		samples_bloc      = make(SamplesBloc, samples_bloc_size)
+		samples_to_read   = p_size * self.samples_for_one_byte
 	)
 
-	// RIFF chunk
-	if err = binary.Read(wave_file, binary.LittleEndian, &chunk); err != nil {
-		return err
-	}
+	for samples_to_read != 0 {
+		if samples_to_read < uint32(len(samples_bloc)) {
+			samples_bloc = samples_bloc[0:samples_to_read]
+			payload_bloc = payload_bloc[0 : samples_to_read/self.samples_for_one_byte]
+		}
 
-	if string(chunk[:4]) != "RIFF" {
-		return errors.New("Not a RIFF file")
-	}
+		if err = self.carrier.ReadSamples(s_pos, samples_bloc); err != nil {
+			return done, err
+		}
 
-	// RIFF chunk size
-	if err = binary.Read(wave_file, binary.LittleEndian, &v32); err != nil {
-		return err
-	}
+		s_pos += uint64(len(samples_bloc))
+		samples_to_read -= uint32(len(samples_bloc))
 
-	if v32+8 != uint32(self.wave_file_size) {
-		return errors.New("Damaged file. Chunk size != file size.")
-	}
+		self.UnstegBloc(&samples_bloc, &payload_bloc)
+		if _, err = output.Write(payload_bloc[0:]); err != nil {
+			return done, err
+		}
 
-	// RIFF chunk format
-	if err = binary.Read(wave_file, binary.LittleEndian, &chunk); err != nil {
-		return err
+		done += int64(len(payload_bloc))
+		if err = self.progressStep(done, int64(p_size)); err != nil && samples_to_read != 0 {
+			return done, err
+		}
 	}
 
-	if string(chunk[:4]) != "WAVE" {
-		return errors.New("Not a WAVE file")
-	}
+	return done, nil
+}
 
-	for parse_next_chunk {
-		// Read next chunkID
-		if err = binary.Read(wave_file, binary.BigEndian, &chunk); err != nil {
-			return err
+// ScanHiddenData returns the regions holding valid hidden data for current algorithm,
+// density and obfuscation seed.
+func (self *wave_handler_struct) ScanHiddenData() (regions []hidden_region, err error) {
+	var (
+		spb        = self.samples_for_one_byte
+		mask       = byte(1<<self.density) - 1
+		overlap    = uint32(len(FRAME_MAGIC)) * spb
+		samples    = make(SamplesBloc, SCAN_WINDOW+overlap)
+		lsb        = make([]byte, SCAN_WINDOW+overlap)
+		magic      = PayloadBloc(FRAME_MAGIC)
+		skip_until uint32
+	)
+
+	switch self.algorithm {
+	case ALGO_CHUNK:
+		chunked, err := self.chunkCarrier()
+		if err != nil {
+			return nil, err
 		}
-		// and it's size in bytes
-		if err = binary.Read(wave_file, binary.LittleEndian, &v32); err != nil {
-			return err
+		chunks, err := chunked.Chunks()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range chunks {
+			payload, err := self.chunkPayload(c)
+			if err != nil {
+				return nil, err
+			}
+			if payload != nil {
+				regions = append(regions, hidden_region{uint32(c.offset), uint32(c.data) + c.size, uint32(len(payload))})
+			}
+		}
+		return regions, nil
+	case ALGO_PHASE:
+		counter := &write_counter{}
+		if self.payload_max_size != 0 && self.ExtractPayloadPhase(counter) == nil {
+			start := self.phase_start_frame * self.wave_info.num_channels
+			regions = append(regions, hidden_region{start, start + PHASE_SEGMENT_LEN*self.wave_info.num_channels, counter.n})
 		}
-		chunklen := v32
+		return regions, nil
+	case ALGO_REVERSIBLE:
+		counter := &write_counter{}
+		if self.ExtractPayloadReversible(counter, false) == nil {
+			regions = append(regions, hidden_region{self.wave_start_offset, self.wave_info.num_samples, counter.n})
+		}
+		return regions, nil
+	}
 
-		switch string(chunk[:4]) {
-		case "fmt ":
-			self.wave_info.canonical = chunklen == 16 // canonical format if chunklen == 16
-			if err = self.parseChunkFmt(); err != nil {
-				return err
+	// Obfuscated magic
+	self.resetObfuscation()
+	self.obfuscateBloc(&magic)
+
+	for start := uint32(0); start < self.wave_info.num_samples; start += SCAN_WINDOW {
+		n := self.wave_info.num_samples - start
+		if n > SCAN_WINDOW+overlap {
+			n = SCAN_WINDOW + overlap
+		}
+		if err = self.carrier.ReadSamples(uint64(start), samples[0:n]); err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < n; i++ {
+			lsb[i] = byte(samples[i]) & mask
+		}
+
+		// Look for magic at every sample
+		for k := uint32(0); k < SCAN_WINDOW && k+overlap <= n; k++ {
+			if start+k < skip_until {
+				continue
 			}
-		case "data":
-			parse_next_chunk = false
-			size, _ := wave_file.Seek(0, os.SEEK_CUR)
-			self.wave_first_sample_pos = uint32(size)
-			self.wave_info.data_bloc_size = uint32(chunklen)
-		default:
-			//fmt.Fprintf(os.Stderr, "Skip unused chunk \"%s\" (%d bytes).\n", chunk, v32)
-			self.wave_info.extra_chunk = true
-			if _, err = wave_file.Seek(int64(chunklen), os.SEEK_CUR); err != nil {
+
+			j := 0
+			for ; j < len(magic); j++ {
+				var b byte
+				for i := uint32(0); i < spb; i++ {
+					b = b<<self.density | lsb[k+uint32(j)*spb+i]
+				}
+				if b != magic[j] {
+					break
+				}
+			}
+			if j < len(magic) {
+				continue
+			}
+
+			// Check the whole frame
+			counter := &write_counter{}
+			if self.ExtractPayload(start+k, counter) != nil {
+				continue
+			}
+			skip_until = start + k + (FRAME_HEADER_SIZE+counter.n)*spb
+			regions = append(regions, hidden_region{start + k, skip_until, counter.n})
+		}
+	}
+
+	return regions, nil
+}
+
+// CheckOverwrite returns an error if hiding payload would overwrite hidden data found for current key.
+func (self *wave_handler_struct) CheckOverwrite() (err error) {
+	var (
+		start = self.wave_start_offset
+		stop  = start + self.samples_to_hide_payload
+	)
+
+	if self.passphrase != "" && self.algorithm != ALGO_CHUNK {
+		if slot, err := self.findSlot(self.passphrase); err != nil {
+			return err
+		} else if slot != nil {
+			return errors.New(fmt.Sprintf("\"%s\" already holds a slot of %d bytes for this passphrase. Use --force to overwrite it.",
+				self.wave_file_name, slot.size))
+		}
+		return nil
+	}
+
+	regions, err := self.ScanHiddenData()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range regions {
+		if self.algorithm == ALGO_LSB && (r.stop <= start || r.start >= stop) {
+			continue
+		}
+		return errors.New(fmt.Sprintf("\"%s\" already holds %d bytes of hidden data at %d. Use --force to overwrite them.",
+			self.wave_file_name, r.size, r.start))
+	}
+
+	return nil
+}
+
+// PrintHiddenRegions prints regions holding hidden data for current key.
+func (self *wave_handler_struct) PrintHiddenRegions(output *os.File) (err error) {
+	var msg string
+
+	msg = fmt.Sprintf("Hidden data\n")
+	msg += fmt.Sprintf("===========\n")
+
+	if self.passphrase != "" && self.algorithm != ALGO_CHUNK {
+		slot, err := self.findSlot(self.passphrase)
+		if err != nil {
+			return err
+		}
+		if slot != nil {
+			msg += fmt.Sprintf("  Slot (placement #%d)           : %s (%d bytes)\n", slot.nonce, intToSuffixedStr(slot.size), slot.size)
+		} else {
+			msg += fmt.Sprintf("  No slot found for this passphrase.\n")
+		}
+		fmt.Fprintln(output, msg)
+		return nil
+	}
+
+	regions, err := self.ScanHiddenData()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range regions {
+		if self.algorithm == ALGO_CHUNK {
+			msg += fmt.Sprintf("  Chunk at byte %-10d             : %s (%d bytes)\n", r.start, intToSuffixedStr(r.size), r.size)
+		} else {
+			msg += fmt.Sprintf("  Samples %10d to %-10d   : %s (%d bytes)\n", r.start, r.stop, intToSuffixedStr(r.size), r.size)
+		}
+	}
+	if len(regions) == 0 {
+		msg += fmt.Sprintf("  No hidden data found for this key.\n")
+	}
+
+	fmt.Fprintln(output, msg)
+	return nil
+}
+
+// payloadFrameHeader returns the frame header of payload. Payload file is read to compute its CRC-32, then rewound.
+func (self *wave_handler_struct) payloadFrameHeader() (header PayloadBloc, err error) {
+	crc := crc32.NewIEEE()
+
+	if _, err = io.Copy(crc, self.payload_file); err != nil {
+		return nil, err
+	}
+	if _, err = self.payload_file.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	return newFrameHeader(uint32(self.payload_file_size), crc.Sum32()), nil
+}
+
+// unstegAt extracts length bytes hidden from sample offset.
+func (self *wave_handler_struct) unstegAt(offset uint32, length uint32) (payload PayloadBloc, err error) {
+	var samples = make(SamplesBloc, length*self.samples_for_one_byte)
+
+	if err = self.carrier.ReadSamples(uint64(offset), samples); err != nil {
+		return nil, err
+	}
+
+	payload = make(PayloadBloc, length)
+	self.UnstegBloc(&samples, &payload)
+
+	return payload, nil
+}
+
+// scrambleFrameHeader replaces the LSBs of samples holding the frame header at offset by random bits.
+func (self *wave_handler_struct) scrambleFrameHeader(offset uint32) (err error) {
+	noise := make([]byte, FRAME_HEADER_SIZE*self.samples_for_one_byte)
+	if _, err = rand.Read(noise); err != nil {
+		return err
+	}
+
+	return self.writeLSBs(func(i uint64) uint64 { return uint64(offset) + i }, uint64(len(noise)),
+		func(i uint64) byte { return noise[i] & (byte(1<<self.density) - 1) })
+}
+
+// progressStep reports done bytes out of total to self.progress, and returns the error of self.ctx
+// once it is done: loops call it between blocs to stop cleanly.
+func (self *wave_handler_struct) progressStep(done, total int64) (err error) {
+	if self.progress != nil {
+		var eta time.Duration
+
+		now := time.Now()
+		if done == 0 {
+			self.progress_start = now
+		} else if done < total {
+			eta = time.Duration(float64(now.Sub(self.progress_start)) * float64(total-done) / float64(done))
+		}
+		self.progress(done, total, eta)
+	}
+
+	if self.ctx != nil {
+		return self.ctx.Err()
+	}
+
+	return nil
+}
+
+// parseHeaders selects the carrier of file, parses the file headers and collect informations.
+func (self *wave_handler_struct) parseHeaders(file *os.File, size int64) (err error) {
+	var magic = make([]byte, 16)
+
+	// Content sniffing: first bytes of file select the container format
+	n, _ := file.ReadAt(magic, 0)
+	for _, format := range carrier_formats {
+		if strings.HasPrefix(string(magic[:n]), format.magic) {
+			if _, err = file.Seek(int64(len(format.magic)), os.SEEK_SET); err != nil {
 				return err
 			}
+			self.carrier = format.create()
+			break
 		}
 	}
 
+	if self.carrier == nil {
+		return errors.New("Unknown file format. WAVE, AIFF, Wave64, AU or FLAC file expected.")
+	}
+
+	if err = self.carrier.Parse(file, size, &self.wave_info); err != nil {
+		return err
+	}
+
 	// Is audio supported ?	 
 	if self.wave_info.audio_format != 1 {
 		return errors.New("Only PCM (not compressed) format is supported.")
 	}
 
+	if self.algorithm == ALGO_PHASE && self.wave_info.bits_per_sample != 16 && self.wave_info.bits_per_sample != 24 {
+		return errors.New("Phase coding needs 16 or 24 bits samples.")
+	}
+
 	// Auto density ?
 	if self.density == 0 {
 		switch {
@@ -510,73 +1495,68 @@ func (self *wave_handler_struct) parseHeaders() (err error) {
 
 	// Compute some useful values
 	self.wave_info.bytes_per_sample = self.wave_info.bits_per_sample >> 3
+	self.wave_info.unsigned = self.carrier.Unsigned() && self.wave_info.bytes_per_sample == 1
 	self.wave_info.num_samples = self.wave_info.data_bloc_size / self.wave_info.bytes_per_sample
-	self.wave_info.sound_duration = time.Duration(float64(self.wave_info.data_bloc_size)/float64(self.wave_info.bytes_per_sec)) * time.Second
-
-	self.wave_start_offset = gd.offset
-	self.wave_start_offset_in_bytes = gd.offset * self.wave_info.bytes_per_sample
-
-	self.samples_for_one_byte = 8 / self.density
-
-	payload_samples_space := self.wave_info.num_samples - self.wave_start_offset
-	self.payload_max_size = payload_samples_space / self.samples_for_one_byte
-
-	return nil
-}
-
-// parseChunkFmt
-func (self *wave_handler_struct) parseChunkFmt() (err error) {
-	var (
-		v16       uint16
-		v32       uint32
-		wave_file = self.wave_file
-	)
-
-	// <audio format> 1 = PCM not compressed    
-	if err = binary.Read(wave_file, binary.LittleEndian, &v16); err != nil {
-		return err
+	self.wave_info.num_frames = self.wave_info.data_bloc_size / self.wave_info.byte_per_bloc
+	if self.wave_info.sampling_frequency == 0 {
+		return errors.New("Damaged file. Sampling rate is 0.")
 	}
-	self.wave_info.audio_format = uint32(v16)
+	self.wave_info.sound_duration = time.Duration(uint64(self.wave_info.num_frames) * uint64(time.Second) / uint64(self.wave_info.sampling_frequency))
 
-	// <# of channels>
-	if err = binary.Read(wave_file, binary.LittleEndian, &v16); err != nil {
+	if self.wave_start_offset, err = self.offsetToSample(self.offset); err != nil {
 		return err
 	}
-	self.wave_info.num_channels = uint32(v16)
 
-	// <Frequency>
-	if err = binary.Read(wave_file, binary.LittleEndian, &v32); err != nil {
-		return err
-	}
-	self.wave_info.sampling_frequency = v32
+	self.samples_for_one_byte = 8 / self.density
 
-	// <Bytes per second>
-	if err = binary.Read(wave_file, binary.LittleEndian, &v32); err != nil {
-		return err
+	if self.offset_key != "" {
+		if self.offset_candidates, err = deriveOffsets(self.offset_key, self.wave_info.num_samples); err != nil {
+			return err
+		}
 	}
-	self.wave_info.bytes_per_sec = v32
 
-	// <byte per bloc>
-	if err = binary.Read(wave_file, binary.LittleEndian, &v16); err != nil {
-		return err
+	payload_samples_space := self.wave_info.num_samples - self.wave_start_offset
+	if self.passphrase != "" || self.offset_key != "" {
+		payload_samples_space = self.wave_info.num_samples
+	}
+	self.payload_max_size = 0
+	header_size := uint32(FRAME_HEADER_SIZE)
+	if self.passphrase != "" {
+		header_size += SLOT_IV_SIZE
+	}
+	if payload_samples_space/self.samples_for_one_byte > header_size {
+		self.payload_max_size = payload_samples_space/self.samples_for_one_byte - header_size
 	}
-	self.wave_info.byte_per_bloc = uint32(v16)
 
-	// <Bits per sample>
-	if err = binary.Read(wave_file, binary.LittleEndian, &v16); err != nil {
-		return err
+	// Phase coding hides data in one segment only
+	if self.algorithm == ALGO_PHASE {
+		self.phase_start_frame = self.wave_start_offset / self.wave_info.num_channels
+		self.payload_max_size = 0
+		if self.phase_start_frame+PHASE_SEGMENT_LEN <= self.wave_info.num_frames {
+			self.payload_max_size = (PHASE_SEGMENT_LEN/2-1)/8 - FRAME_HEADER_SIZE
+		}
 	}
-	self.wave_info.bits_per_sample = uint32(v16)
 
-	if self.wave_info.canonical == false {
-		// Get extra params size
-		if err = binary.Read(wave_file, binary.LittleEndian, &v32); err != nil {
+	// Expansion capacity depends on prediction errors, up to the largest threshold
+	if self.algorithm == ALGO_REVERSIBLE {
+		if self.reversible_errors, self.reversible_max, err = self.reversibleErrors(self.wave_start_offset); err != nil {
 			return err
 		}
-		// Skip them
-		if _, err = wave_file.Seek(int64(v32), os.SEEK_CUR); err != nil {
+		_, carriers := reversibleThreshold(self.reversible_errors, self.reversible_max, math.MaxUint64)
+		self.reversible_threshold, self.reversible_carriers = self.reversible_max, carriers
+		self.payload_max_size = 0
+		if carriers/8 > FRAME_HEADER_SIZE+REVERSIBLE_SIDE_SIZE {
+			self.payload_max_size = uint32(min(carriers/8-FRAME_HEADER_SIZE-REVERSIBLE_SIDE_SIZE, math.MaxUint32))
+		}
+	}
+
+	// Chunk capacity depends on the size field of the container
+	if self.algorithm == ALGO_CHUNK {
+		chunks, err := self.chunkCarrier()
+		if err != nil {
 			return err
 		}
+		self.payload_max_size = chunkPayloadMax(chunks)
 	}
 
 	return nil
@@ -588,9 +1568,8 @@ func (self *wave_handler_struct) UnstegBloc(samples *SamplesBloc, payload *Paylo
 	var (
 		s_pos  uint32
 		s_len  = uint32(len(*samples))
-		s_skip = self.wave_info.bytes_per_sample
-		s_mask = byte(1<<self.density) - 1
-		s      byte
+		s_mask = int32(1<<self.density) - 1
+		s      int32
 	)
 
 	var (
@@ -601,18 +1580,17 @@ func (self *wave_handler_struct) UnstegBloc(samples *SamplesBloc, payload *Paylo
 
 	var fib uint8
 
-	for n := s_len / self.wave_info.bytes_per_sample / self.samples_for_one_byte; n != 0; n-- {
+	for n := s_len / self.samples_for_one_byte; n != 0; n-- {
 
 		// Loop over samples for extract ONE byte
 		for i := uint32(0); i < self.samples_for_one_byte; i++ {
-			// Sample is little endian ordered. LSB is first
 			s = (*samples)[s_pos]
 			// skip to next sample
-			s_pos += s_skip
+			s_pos++
 			// Make space for new bits
 			p <<= p_shift
 			// Filter sample LSBs and add it to recompose a complete byte. 
-			p |= s & s_mask
+			p |= byte(s & s_mask)
 		}
 
 		if self.obfuscate {
@@ -641,11 +1619,11 @@ func (self *wave_handler_struct) StegBloc(payload *PayloadBloc, samples *Samples
 
 	// Samples vars
 	var (
-		s_pos   uint32
-		s_byte  byte
-		s_mask  byte = ^((1 << self.density) - 1)
-		s_skip       = self.wave_info.bytes_per_sample
-		s_shift      = 8 - self.density
+		s_pos    uint32
+		s_sample int32
+		s_mask   int32 = ^((1 << self.density) - 1)
+		s_shift        = 8 - self.density
+		s_guard        = self.wave_info.bytes_per_sample == 1 // Keep 8 bits samples off extremes
 	)
 
 	// Obfuscation vars
@@ -662,267 +1640,4844 @@ func (self *wave_handler_struct) StegBloc(payload *PayloadBloc, samples *Samples
 			p_byte ^= fib
 		}
 
-		//Steg with sample LSB byte
+		//Steg with sample LSBs
 		for i := uint32(0); i < self.samples_for_one_byte; i++ {
-			// Read sample LSB byte. Alway the first because of Little Endian order.
-			s_byte = (*samples)[s_pos]
+			// Read sample
+			s_sample = (*samples)[s_pos]
 
 			// Steg
-			s_byte &= s_mask
-			s_byte |= p_byte >> s_shift
+			s_sample &= s_mask
+			s_sample |= int32(p_byte >> s_shift)
 			p_byte <<= p_shift
+			if s_guard && s_sample != (*samples)[s_pos] {
+				s_sample = self.offExtremes(s_sample)
+			}
 
 			// Write
-			(*samples)[s_pos] = s_byte
+			(*samples)[s_pos] = s_sample
 
 			// Jump to next sample
-			s_pos += s_skip
+			s_pos++
 		}
 	}
 }
 
-// Free allocated ressources
-func (self *wave_handler_struct) Free() {
-	if self.payload_file != nil {
-		self.payload_file.Close()
+// offExtremes moves an altered 8 bits sample landing on an extreme value (0 or 255 once biased)
+// by 2^density toward zero. Its LSBs are kept, and hidden data never looks like clipping.
+func (self *wave_handler_struct) offExtremes(sample int32) int32 {
+	switch sample {
+	case math.MinInt8:
+		return sample + 1<<self.density
+	case math.MaxInt8:
+		return sample - 1<<self.density
 	}
 
-	if self.wave_file != nil {
-		self.wave_file.Close()
-	}
+	return sample
 }
 
-func main() {
-	var rc = 0
-	var err error
+// resetObfuscation reloads Fibonacci registers with the obfuscation seed.
+func (self *wave_handler_struct) resetObfuscation() {
+	self.fib_2 = self.payload_obfuscation_seed
+	self.fib_1 = self.payload_obfuscation_seed
+}
 
-	// Read cmd line arguments
-	if err = parseArgs(); err != nil {
-		os.Exit(1)
+// obfuscateBloc xors payload with the Fibonacci generator if obfuscation is requested.
+func (self *wave_handler_struct) obfuscateBloc(payload *PayloadBloc) {
+	var fib uint8
+
+	if !self.obfuscate {
+		return
 	}
 
-	if rc, err = runAction(); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
+	for i := range *payload {
+		fib = self.fib_1 + self.fib_2
+		self.fib_2, self.fib_1 = self.fib_1, fib
+		(*payload)[i] ^= fib
 	}
+}
 
-	os.Exit(rc)
+//-----------------------------------------------------------------------
+//-- PARALLEL ENGINE on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// engine_segment is a run of payload bytes and the samples hiding them, processed by one goroutine.
+type engine_segment struct {
+	index  int64       // Position of segment in payload, counted in segments
+	first  int64       // Position of first payload byte
+	length int64       // # of payload bytes
+	sample uint64      // Position of first sample
+	data   PayloadBloc // Payload extracted from samples
+	err    error       // Error of work
 }
 
-func runAction() (rc int, err error) {
-	var wh = &wave_handler_struct{bloc_size: 4096}
-	var return_code = 0
+// engine_buffers are owned by one goroutine and reused for all its segments.
+type engine_buffers struct {
+	payload PayloadBloc
+	samples SamplesBloc
+	raw     []byte
+}
 
-	defer wh.Free()
+// engine_work processes seg with buf. worker is a copy of the handler owned by the goroutine, with
+// Fibonacci registers set for the first byte of seg.
+type engine_work func(worker *wave_handler_struct, seg *engine_segment, buf *engine_buffers) error
 
-	// Init wh
-	wh.density = gd.density
-	wh.fib_2 = gd.obfuscate
-	wh.fib_1 = gd.obfuscate
-	wh.obfuscate = gd.obfuscate != 0
+// fibonacciState returns the Fibonacci registers once steps bytes are obfuscated from seed. The
+// generator is periodic, so any position of payload is reached in less than FIB_PERIOD steps.
+func fibonacciState(seed uint8, steps int64) (fib_2, fib_1 uint8) {
+	fib_2, fib_1 = seed, seed
+	for steps %= FIB_PERIOD; steps != 0; steps-- {
+		fib_2, fib_1 = fib_1, fib_1+fib_2
+	}
 
-	// Profiling ?
-	if gd.cpuprofile != "" {
-		fmt.Fprintf(os.Stderr, "Start profiling to %s\n", gd.cpuprofile)
-		f, err := os.Create(gd.cpuprofile)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-		pprof.StartCPUProfile(f)
-		defer func() {
-			fmt.Fprintf(os.Stderr, "Stop profiling.\n")
-			pprof.StopCPUProfile()
+	return fib_2, fib_1
+}
+
+// runSegments splits length payload bytes hidden from sample start into segments processed at once
+// by self.workers goroutines with work. header_size bytes are hidden before start with the same
+// Fibonacci generator. Processed segments are handed in order to done, if != nil, then reported to
+// self.progress. Feeding stops on the first error or once self.ctx is done, and segments in progress
+// are waited for. Returns the # of payload bytes processed in a row from the beginning of payload.
+func (self *wave_handler_struct) runSegments(start uint64, header_size, length int64, work engine_work, done func(seg *engine_segment) error) (processed int64, err error) {
+	var (
+		size       = int64(self.segment_size)
+		queue      = make(chan *engine_segment)
+		results    = make(chan *engine_segment)
+		pending    = make(map[int64]*engine_segment)
+		sent, next int64
+		stop       bool
+		wg         sync.WaitGroup
+	)
+
+	if size == 0 {
+		size = ENGINE_SEGMENT
+	}
+	count := (length + size - 1) / size
+	workers := min(int64(self.workers), count)
+	samples_size := size * int64(self.samples_for_one_byte)
+
+	for w := int64(0); w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			worker := *self
+			buf := &engine_buffers{
+				payload: make(PayloadBloc, size),
+				samples: make(SamplesBloc, samples_size),
+				raw:     make([]byte, samples_size*int64(self.wave_info.bytes_per_sample)),
+			}
+			for seg := range queue {
+				worker.fib_2, worker.fib_1 = fibonacciState(self.payload_obfuscation_seed, header_size+seg.first)
+				seg.err = work(&worker, seg, buf)
+				results <- seg
+			}
 		}()
 	}
 
-	// Switch over options
-	switch {
-	case gd.action == ACTION_HELP:
-		show_usage()
-	case gd.action == ACTION_VERSION:
-		fmt.Println(APP + " (" + os.Args[0] + ") " + VERSION + ".")
-		fmt.Println("Copyright (C) 2012 Stéphane Bunel.")
-		fmt.Println("License: BSD style (included in source code).")
-	case gd.action == ACTION_INFO:
-		if err = wh.OpenWave(gd.wave_file, false); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to open \"%s\": %s\n", gd.wave_file, err)
-			break
+	for next < count {
+		// Keep goroutines busy, with at most 2 segments per goroutine in progress or pending
+		if !stop && sent < count && sent-next < 2*workers {
+			first := sent * size
+			seg := &engine_segment{
+				index:  sent,
+				first:  first,
+				length: min(size, length-first),
+				sample: start + uint64(first)*uint64(self.samples_for_one_byte),
+			}
+			select {
+			case queue <- seg:
+				sent++
+				continue
+			case seg = <-results:
+				pending[seg.index] = seg
+			}
+		} else if next == sent {
+			break // Stopped and every segment sent is back
+		} else {
+			seg := <-results
+			pending[seg.index] = seg
 		}
 
-		if gd.payload_file != "" {
-			if err = wh.OpenPayload(gd.payload_file); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to open \"%s\": %s\n", gd.payload_file, err)
-				return_code = 1
-				break
+		// Hand processed segments over in order
+		for seg, ok := pending[next]; ok; seg, ok = pending[next] {
+			delete(pending, next)
+			next++
+			if err != nil {
+				continue
+			}
+			if err = seg.err; err == nil && done != nil {
+				err = done(seg)
+			}
+			if err == nil {
+				processed += seg.length
+				// Once the last segment is processed, stopping is pointless
+				if err = self.progressStep(processed, length); processed == length {
+					err = nil
+				}
 			}
+			stop = err != nil
 		}
+	}
 
-		if err = wh.PrintWAVInfo(os.Stdout); err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err)
-			return_code = 1
-			break
-		}
-	case gd.action == ACTION_EXTRACT:
-		if err = wh.OpenWave(gd.wave_file, false); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to open \"%s\": %s\n", gd.wave_file, err)
-			return_code = 1
-			break
-		}
+	close(queue)
+	wg.Wait()
 
-		if err = wh.ExtractPayload(uint32(gd.offset), os.Stdout); err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err)
-			return_code = 1
-			break
-		}
-	case gd.action == ACTION_HIDE:
-		if err = wh.OpenWave(gd.wave_file, true); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to open \"%s\": %s\n", gd.wave_file, err)
-			return_code = 1
-			break
-		}
+	return processed, err
+}
 
-		if wh.density >= wh.wave_info.bits_per_sample/2 {
-			fmt.Fprintf(os.Stderr, "Density of %d is too high for sample size of %d bits.\n", wh.density,
-				wh.wave_info.bits_per_sample)
-			return_code = 1
-			break
-		}
+// hideSegments hides payload in samples from s_pos with the parallel engine. Returns the # of bytes
+// hidden in a row from the beginning of payload.
+func (self *wave_handler_struct) hideSegments(s_pos uint64) (done int64, err error) {
+	return self.runSegments(s_pos, FRAME_HEADER_SIZE, self.payload_file_size,
+		func(worker *wave_handler_struct, seg *engine_segment, buf *engine_buffers) (err error) {
+			payload := buf.payload[0:seg.length]
+			samples := buf.samples[0 : seg.length*int64(worker.samples_for_one_byte)]
 
-		if err = wh.OpenPayload(gd.payload_file); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to open \"%s\": %s\n", gd.payload_file, err)
-			return_code = 1
-			break
-		}
+			if _, err = worker.payload_file.ReadAt(payload, seg.first); err != nil {
+				return err
+			}
+			if err = worker.carrier.ReadSamplesAt(seg.sample, samples, buf.raw); err != nil {
+				return err
+			}
+			worker.StegBloc(&payload, &samples)
 
-		t0 := time.Now()
-		fmt.Printf("Hiding \"%s\" inside \"%s\" ...\n", wh.payload_file_name, wh.wave_file_name)
+			return worker.carrier.WriteSamplesAt(seg.sample, samples, buf.raw)
+		}, nil)
+}
 
-		if err = wh.HidePayload(uint32(gd.offset)); err != nil {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
-			return_code = 1
-			break
-		}
+// extractSegments writes to output p_size bytes extracted from samples following s_pos with the
+// parallel engine. Returns the # of bytes extracted.
+func (self *wave_handler_struct) extractSegments(s_pos uint64, header_size, p_size uint32, output io.Writer) (done int64, err error) {
+	return self.runSegments(s_pos, int64(header_size), int64(p_size),
+		func(worker *wave_handler_struct, seg *engine_segment, buf *engine_buffers) (err error) {
+			samples := buf.samples[0 : seg.length*int64(worker.samples_for_one_byte)]
 
-		duration := time.Now().Sub(t0)
-		byte_writed := uint32(wh.payload_file_size) * wh.samples_for_one_byte * wh.wave_info.bytes_per_sample
-		fmt.Printf("Ok. Read %s from \"%s\" and write %s to \"%s\" in %v (%s/s).\n",
-			intToSuffixedStr(uint32(wh.payload_file_size)), wh.payload_file_name,
-			intToSuffixedStr(byte_writed), wh.wave_file_name,
-			duration, intToSuffixedStr(uint32(float64(byte_writed)/duration.Seconds())))
-	}
+			if err = worker.carrier.ReadSamplesAt(seg.sample, samples, buf.raw); err != nil {
+				return err
+			}
+			seg.data = make(PayloadBloc, seg.length)
+			worker.UnstegBloc(&samples, &seg.data)
 
-	return return_code, nil
+			return nil
+		},
+		func(seg *engine_segment) (err error) {
+			_, err = output.Write(seg.data)
+			seg.data = nil
+
+			return err
+		})
 }
 
-// parseArgs parses command line arguments
-func parseArgs() (err error) {
-	var print_usage = false
+//-----------------------------------------------------------------------
+//-- SLOTS on *wave_handler_struct
+//-----------------------------------------------------------------------
 
-	// Args vars
+// HidePayloadSlot hides payload in the slot selected by passphrase. The first placement
+// not colliding with slots of keep passphrases is used. An older slot of the same
+// passphrase is overwritten.
+func (self *wave_handler_struct) HidePayloadSlot(keep []string) (err error) {
 	var (
-		bExtract   = flag.Bool("extract", false, "")
-		bHide      = flag.Bool("hide", false, "")
-		bInfo      = flag.Bool("info", false, "")
-		bVersion   = flag.Bool("version", false, "")
-		density    = flag.Uint64("density", 0, "")
-		offset     = flag.Uint64("offset", 0, "")
-		obfuscate  = flag.Uint64("obfuscate", 0, "")
-		cpuprofile = flag.String("cpuprofile", "", "")
+		occupied = make([]uint64, (self.wave_info.num_samples+63)/64)
+		slot     *slot_struct
 	)
 
-	flag.StringVar(&gd.wave_file, "wave", "", "")
-	flag.StringVar(&gd.payload_file, "data", "", "")
-	flag.StringVar(&gd.payload_file, "payload", "", "")
-
-	flag.Usage = show_usage
-	flag.Parse()
+	// IV, frame header and payload. Payload is read once for its CRC, then streamed
+	header, err := self.payloadFrameHeader()
+	if err != nil {
+		return err
+	}
+	length := uint32(SLOT_IV_SIZE + FRAME_HEADER_SIZE + self.payload_file_size)
 
-	gd.density = uint32(*density)
-	gd.offset = uint32(*offset)
-	gd.obfuscate = uint8(*obfuscate)
-	gd.cpuprofile = *cpuprofile
+	// Samples used by slots to keep
+	for _, passphrase := range keep {
+		other, err := self.findSlot(passphrase)
+		if err != nil {
+			return err
+		}
+		if other == nil {
+			return errors.New(fmt.Sprintf("No slot found in \"%s\" for a passphrase to keep.", self.wave_file_name))
+		}
+		at, count := self.slotPositions(other, other.length())
+		for i := uint64(0); i < count; i++ {
+			pos := at(i)
+			occupied[pos/64] |= 1 << (pos % 64)
+		}
+	}
 
-	gd.action = ACTION_HELP
-	if *bHide == true {
-		gd.action = ACTION_HIDE
+	// First placement without collision
+	key, err := self.slotKey(self.passphrase)
+	if err != nil {
+		return err
 	}
-	if *bExtract == true {
-		gd.action = ACTION_EXTRACT
+	for nonce := 0; nonce < SLOT_NONCES && slot == nil; nonce++ {
+		slot = self.newSlot(key, uint8(nonce))
+		at, count := self.slotPositions(slot, length)
+		for i := uint64(0); i < count; i++ {
+			if pos := at(i); occupied[pos/64]&(1<<(pos%64)) != 0 {
+				slot = nil
+				break
+			}
+		}
 	}
-	if *bInfo == true {
-		gd.action = ACTION_INFO
+	if slot == nil {
+		return &exit_error{EXIT_CAPACITY, errors.New(fmt.Sprintf("No room left in \"%s\" without overwriting slots to keep.", self.wave_file_name))}
 	}
-	if *bVersion == true {
-		gd.action = ACTION_VERSION
+
+	// An older slot found first would hide the new one: scramble its header
+	old, err := self.findSlot(self.passphrase)
+	if err != nil {
+		return err
 	}
+	if old != nil && old.nonce < slot.nonce {
+		at, count := self.slotPositions(slot, length)
+		for i := uint64(0); i < count; i++ {
+			pos := at(i)
+			occupied[pos/64] |= 1 << (pos % 64)
+		}
 
-	switch gd.density {
+		var positions []uint64
+		at, count = self.slotPositions(old, SLOT_IV_SIZE+FRAME_HEADER_SIZE)
+		for i := uint64(0); i < count; i++ {
+			if pos := at(i); occupied[pos/64]&(1<<(pos%64)) == 0 {
+				positions = append(positions, pos)
+			}
+		}
+		noise := make([]byte, len(positions))
+		if _, err = rand.Read(noise); err != nil {
+			return err
+		}
+		mask := byte(1<<self.density) - 1
+		if err = self.writeLSBs(func(i uint64) uint64 { return positions[i] }, uint64(len(positions)),
+			func(i uint64) byte { return noise[i] & mask }); err != nil {
+			return err
+		}
+	}
+
+	// A new IV for each hide: the same passphrase never reuses a keystream
+	slot.iv = make(PayloadBloc, SLOT_IV_SIZE)
+	if _, err = rand.Read(slot.iv); err != nil {
+		return err
+	}
+	container := io.MultiReader(bytes.NewReader(slot.iv),
+		cipher.StreamReader{S: cipher.NewCTR(slot.block, slot.iv), R: io.MultiReader(bytes.NewReader(header), self.payload_file)})
+
+	// Encrypted and written by blocs of one batch of positions: payload is never held in memory
+	var (
+		at, count = self.slotPositions(slot, length)
+		spb       = uint64(self.samples_for_one_byte)
+		bloc      = make(PayloadBloc, POSITION_BATCH/spb)
+	)
+	for first := uint64(0); first < count; first += uint64(len(bloc)) * spb {
+		b := bloc[0:min(uint64(len(bloc)), (count-first)/spb)]
+		if _, err = io.ReadFull(container, b); err != nil {
+			return err
+		}
+		if err = self.writeLSBs(func(i uint64) uint64 { return at(first + i) }, uint64(len(b))*spb, self.lsbGroups(b)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExtractPayloadSlot writes to output the payload of the slot selected by passphrase.
+func (self *wave_handler_struct) ExtractPayloadSlot(output io.Writer) (err error) {
+	slot, err := self.findSlot(self.passphrase)
+	if err != nil {
+		return err
+	}
+	if slot == nil {
+		return errors.New(fmt.Sprintf("No slot found in \"%s\" for this passphrase.", self.wave_file_name))
+	}
+
+	container, err := self.readLSBs(self.slotPositions(slot, slot.length()))
+	if err != nil {
+		return err
+	}
+	container = container[SLOT_IV_SIZE:]
+	cipher.NewCTR(slot.block, slot.iv).XORKeyStream(container, container)
+
+	_, crc, _ := parseFrameHeader(container)
+	payload := container[FRAME_HEADER_SIZE:]
+	if crc32.ChecksumIEEE(payload) != crc {
+		return errors.New("CRC error. Extracted data is corrupted. Maybe a slot overwritten by another one ?")
+	}
+	_, err = output.Write(payload)
+
+	return err
+}
+
+// findSlot returns the slot of passphrase, or nil if no placement holds a valid frame header.
+func (self *wave_handler_struct) findSlot(passphrase string) (slot *slot_struct, err error) {
+	key, err := self.slotKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	for nonce := 0; nonce < SLOT_NONCES; nonce++ {
+		slot = self.newSlot(key, uint8(nonce))
+		header, err := self.readLSBs(self.slotPositions(slot, SLOT_IV_SIZE+FRAME_HEADER_SIZE))
+		if err != nil {
+			return nil, err
+		}
+
+		iv := header[0:SLOT_IV_SIZE]
+		header = header[SLOT_IV_SIZE:]
+		cipher.NewCTR(slot.block, iv).XORKeyStream(header, header)
+		if size, _, framed := parseFrameHeader(header); framed && size <= self.payload_max_size {
+			slot.size, slot.iv = size, iv
+			return slot, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// slotKey returns the key derived from passphrase, and the order of samples of its slots. PBKDF2
+// is slow on purpose: the result is kept for following calls.
+func (self *wave_handler_struct) slotKey(passphrase string) (key *slot_key, err error) {
+	if key = self.slot_keys[passphrase]; key != nil {
+		return key, nil
+	}
+
+	derived, err := pbkdf2.Key(sha256.New, passphrase, []byte(APP+" slot"), SLOT_KDF_ITERATIONS, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	order := sha256.Sum256(append([]byte("order:"), derived...))
+	key = &slot_key{key: derived, order: newKeyedPermutation(order[:], uint64(self.wave_info.num_samples))}
+
+	if self.slot_keys == nil {
+		self.slot_keys = make(map[string]*slot_key)
+	}
+	self.slot_keys[passphrase] = key
+
+	return key, nil
+}
+
+// newSlot derives start and cipher of a placement of the passphrase of key.
+func (self *wave_handler_struct) newSlot(key *slot_key, nonce uint8) (slot *slot_struct) {
+	nonce_key := sha256.Sum256(append([]byte(fmt.Sprintf("slot:%d:", nonce)), key.key...))
+	placement := sha256.Sum256(append([]byte("placement:"), nonce_key[:]...))
+	encryption := sha256.Sum256(append([]byte("encryption:"), nonce_key[:]...))
+
+	// Key is 32 bytes long: NewCipher can't fail
+	block, _ := aes.NewCipher(encryption[:])
+
+	return &slot_struct{
+		nonce: nonce,
+		start: binary.LittleEndian.Uint64(placement[:]) % uint64(self.wave_info.num_samples),
+		order: key.order,
+		block: block,
+	}
+}
+
+// length returns the # of bytes of slot: IV, frame header and payload.
+func (self *slot_struct) length() uint32 {
+	return SLOT_IV_SIZE + FRAME_HEADER_SIZE + self.size
+}
+
+// slotPositions returns the positions of the count samples holding the first length bytes of slot.
+// Slot order wraps around at its end.
+func (self *wave_handler_struct) slotPositions(slot *slot_struct, length uint32) (at position_func, count uint64) {
+	var n = uint64(self.wave_info.num_samples)
+
+	return func(i uint64) uint64 { return slot.order.At((slot.start + i) % n) }, uint64(length) * uint64(self.samples_for_one_byte)
+}
+
+// lsbGroups returns the group of density bits of payload held by the i-th sample, most significant
+// first like StegBloc.
+func (self *wave_handler_struct) lsbGroups(payload PayloadBloc) func(i uint64) byte {
+	var (
+		spb  = uint64(self.samples_for_one_byte)
+		mask = byte(1<<self.density) - 1
+	)
+
+	return func(i uint64) byte {
+		return payload[i/spb] >> ((spb - 1 - i%spb) * uint64(self.density)) & mask
+	}
+}
+
+// readLSBs returns the bytes held by the density LSBs of the count samples at positions, most
+// significant first like UnstegBloc.
+func (self *wave_handler_struct) readLSBs(at position_func, count uint64) (payload PayloadBloc, err error) {
+	var (
+		spb  = uint64(self.samples_for_one_byte)
+		mask = int32(1<<self.density) - 1
+	)
+
+	payload = make(PayloadBloc, count/spb)
+	err = self.forEachSample(at, count, false, func(i uint64, sample *int32) {
+		payload[i/spb] |= byte(*sample&mask) << ((spb - 1 - i%spb) * uint64(self.density))
+	})
+
+	return payload, err
+}
+
+// writeLSBs replaces the density LSBs of the count samples at positions by group(i).
+func (self *wave_handler_struct) writeLSBs(at position_func, count uint64, group func(i uint64) byte) (err error) {
+	var (
+		mask  = int32(1<<self.density) - 1
+		guard = self.wave_info.bytes_per_sample == 1 // Keep 8 bits samples off extremes
+	)
+
+	return self.forEachSample(at, count, true, func(i uint64, sample *int32) {
+		s := *sample&^mask | int32(group(i))
+		if guard && s != *sample {
+			s = self.offExtremes(s)
+		}
+		*sample = s
+	})
+}
+
+// forEachSample calls f with the index and every one of the count samples at positions. Positions
+// are generated by batches of POSITION_BATCH and visited in file order: only runs of nearby samples
+// are read (and written back if write is true), so scattered positions cost a few samples each.
+func (self *wave_handler_struct) forEachSample(at position_func, count uint64, write bool, f func(i uint64, sample *int32)) (err error) {
+	var (
+		positions = make([]uint64, min(count, POSITION_BATCH))
+		order     = make([]int, len(positions))
+		window    SamplesBloc
+	)
+
+	for first := uint64(0); first < count; first += POSITION_BATCH {
+		batch := min(count-first, POSITION_BATCH)
+		for i := uint64(0); i < batch; i++ {
+			positions[i], order[i] = at(first+i), int(i)
+		}
+		o := order[0:batch]
+		sort.Slice(o, func(a, b int) bool { return positions[o[a]] < positions[o[b]] })
+
+		for k := 0; k < len(o); {
+			// Run from the first remaining position while the next one is close enough
+			start := positions[o[k]]
+			end := k + 1
+			for ; end < len(o); end++ {
+				p := positions[o[end]]
+				if p-positions[o[end-1]] > POSITION_RUN_GAP || p-start >= SCAN_WINDOW {
+					break
+				}
+			}
+			n := positions[o[end-1]] - start + 1
+			if uint64(cap(window)) < n {
+				window = make(SamplesBloc, n)
+			}
+			w := window[0:n]
+			if err = self.carrier.ReadSamples(start, w); err != nil {
+				return err
+			}
+
+			for ; k < end; k++ {
+				f(first+uint64(o[k]), &w[positions[o[k]]-start])
+			}
+
+			if write {
+				if err = self.carrier.WriteSamples(start, w); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------
+//-- KEYED OFFSETS on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// selectKeyedOffset sets the start of hidden data to the first offset derived from key leaving
+// room for payload.
+func (self *wave_handler_struct) selectKeyedOffset() (err error) {
+	for _, offset := range self.offset_candidates {
+		if offset <= self.samples_max_offset {
+			self.wave_start_offset = offset
+			return nil
+		}
+	}
+
+	return &exit_error{EXIT_CAPACITY, errors.New(fmt.Sprintf("Payload (%s) doesn't fit after any offset derived from key in \"%s\". Use --offset.",
+		self.payload_file_name, self.wave_file_name))}
+}
+
+// HidePayloadKeyed hides payload at the offset selected by selectKeyedOffset. Frame headers found
+// at previous offsets would be extracted first: they are scrambled.
+func (self *wave_handler_struct) HidePayloadKeyed() (err error) {
+	var (
+		start = self.wave_start_offset
+		stop  = start + self.samples_to_hide_payload
+		spb   = self.samples_for_one_byte
+	)
+
+	for _, offset := range self.offset_candidates {
+		if offset == start {
+			break
+		}
+		if offset+FRAME_HEADER_SIZE*spb > start && offset < stop {
+			continue
+		}
+		if found, err := self.framedAt(offset); err != nil {
+			return err
+		} else if !found {
+			continue
+		}
+		if err = self.scrambleFrameHeader(offset); err != nil {
+			return err
+		}
+	}
+
+	return self.HidePayload(start)
+}
+
+// findKeyedOffset returns the first offset derived from key holding a frame header.
+func (self *wave_handler_struct) findKeyedOffset() (offset uint32, found bool, err error) {
+	for _, offset = range self.offset_candidates {
+		if found, err = self.framedAt(offset); err != nil || found {
+			return offset, found, err
+		}
+	}
+
+	return 0, false, nil
+}
+
+// framedAt returns true if a frame header of a payload fitting in the file is hidden at offset.
+func (self *wave_handler_struct) framedAt(offset uint32) (found bool, err error) {
+	if offset+FRAME_HEADER_SIZE*self.samples_for_one_byte > self.wave_info.num_samples {
+		return false, nil
+	}
+
+	self.resetObfuscation()
+	header, err := self.unstegAt(offset, FRAME_HEADER_SIZE)
+	if err != nil {
+		return false, err
+	}
+	size, _, framed := parseFrameHeader(header)
+	max_size := (self.wave_info.num_samples-offset)/self.samples_for_one_byte - FRAME_HEADER_SIZE
+
+	return framed && size <= max_size, nil
+}
+
+// deriveOffsets returns OFFSET_CANDIDATES sample offsets derived from key by PBKDF2.
+func deriveOffsets(key string, num_samples uint32) (offsets []uint32, err error) {
+	if num_samples == 0 {
+		return nil, nil
+	}
+
+	seed, err := pbkdf2.Key(sha256.New, key, []byte(APP+" offset"), OFFSET_KDF_ITERATIONS, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets = make([]uint32, OFFSET_CANDIDATES)
+	for i := range offsets {
+		h := sha256.Sum256(append(seed, byte(i)))
+		offsets[i] = uint32(binary.LittleEndian.Uint64(h[:]) % uint64(num_samples))
+	}
+
+	return offsets, nil
+}
+
+//-----------------------------------------------------------------------
+//-- PHASE CODING on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// HidePayloadPhase codes payload in the phase of the first segment of PHASE_SEGMENT_LEN frames.
+// Phases of every following segment are shifted by the same amount to preserve the relative
+// phase differences between segments. All channels are shifted like the first one.
+func (self *wave_handler_struct) HidePayloadPhase() (err error) {
+	var (
+		channels = self.wave_info.num_channels
+		seg      = make(SamplesBloc, PHASE_SEGMENT_LEN*channels)
+		spectrum = make([]complex128, PHASE_SEGMENT_LEN)
+		delta    = make([]float64, PHASE_SEGMENT_LEN/2)
+		pos      = uint64(self.phase_start_frame * channels)
+		end      = uint64(self.wave_info.num_frames * channels)
+	)
+
+	// Build container: frame header followed by payload
+	data, err := io.ReadAll(self.payload_file)
+	if err != nil {
+		return err
+	}
+	container := append(newFrameHeader(uint32(len(data)), crc32.ChecksumIEEE(data)), data...)
+	self.resetObfuscation()
+	self.obfuscateBloc(&container)
+
+	// Code bits in the first segment of the first channel.
+	if err = self.carrier.ReadSamples(pos, seg); err != nil {
+		return err
+	}
+	self.segmentToSpectrum(seg, 0, spectrum)
+	for k := 1; k < PHASE_SEGMENT_LEN/2; k++ {
+		bit := k - 1
+		if bit >= len(container)*8 {
+			break
+		}
+
+		phase := math.Pi / 2
+		if container[bit/8]&(0x80>>uint(bit%8)) != 0 {
+			phase = -math.Pi / 2
+		}
+
+		magnitude := math.Max(cmplx.Abs(spectrum[k]), PHASE_MIN_MAGNITUDE)
+		delta[k] = phase - cmplx.Phase(spectrum[k])
+		spectrum[k] = cmplx.Rect(magnitude, phase)
+		spectrum[PHASE_SEGMENT_LEN-k] = cmplx.Conj(spectrum[k])
+	}
+	self.spectrumToSegment(spectrum, seg, 0)
+
+	// Check that coded bits survive PCM rounding and clipping
+	self.segmentToSpectrum(seg, 0, spectrum)
+	if coded := phaseDecode(spectrum); !bytes.Equal(coded[:len(container)], container) {
+		return errors.New(fmt.Sprintf("Carrier (%s) is not suitable for phase coding at frame %d.", self.wave_file_name, self.phase_start_frame))
+	}
+
+	for c := uint32(1); c < self.wave_info.num_channels; c++ {
+		self.segmentToSpectrum(seg, c, spectrum)
+		shiftPhases(spectrum, delta)
+		self.spectrumToSegment(spectrum, seg, c)
+	}
+
+	if err = self.carrier.WriteSamples(pos, seg); err != nil {
+		return err
+	}
+
+	// Keep relative phases of following segments
+	for pos += uint64(len(seg)); pos+uint64(len(seg)) <= end; pos += uint64(len(seg)) {
+		if err = self.carrier.ReadSamples(pos, seg); err != nil {
+			return err
+		}
+
+		for c := uint32(0); c < self.wave_info.num_channels; c++ {
+			self.segmentToSpectrum(seg, c, spectrum)
+			shiftPhases(spectrum, delta)
+			self.spectrumToSegment(spectrum, seg, c)
+		}
+
+		if err = self.carrier.WriteSamples(pos, seg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExtractPayloadPhase decodes payload from the phase of the first segment.
+func (self *wave_handler_struct) ExtractPayloadPhase(output io.Writer) (err error) {
+	var (
+		channels = self.wave_info.num_channels
+		seg      = make(SamplesBloc, PHASE_SEGMENT_LEN*channels)
+		spectrum = make([]complex128, PHASE_SEGMENT_LEN)
+	)
+
+	if self.payload_max_size == 0 {
+		return errors.New(fmt.Sprintf("Offset (%d) is too big for phase coding in \"%s\"", self.wave_start_offset, self.wave_file_name))
+	}
+
+	if err = self.carrier.ReadSamples(uint64(self.phase_start_frame*channels), seg); err != nil {
+		return err
+	}
+	self.segmentToSpectrum(seg, 0, spectrum)
+	container := phaseDecode(spectrum)
+
+	header := container[0:FRAME_HEADER_SIZE]
+	self.resetObfuscation()
+	self.obfuscateBloc(&header)
+	p_size, p_crc, framed := parseFrameHeader(header)
+	if !framed {
+		return errors.New(fmt.Sprintf("No phase coded data at frame %d. Maybe a wrong offset or obfuscation seed ?", self.phase_start_frame))
+	}
+
+	// Check Consistency of data_size
+	if p_size > self.payload_max_size {
+		return errors.New(fmt.Sprintf("Consistency error. "+
+			"Size of data to extract (%s) is bigger than maximum (%s) payload. Maybe a wrong offset ?",
+			intToSuffixedStr(p_size), intToSuffixedStr(self.payload_max_size)))
+	}
+
+	payload := container[FRAME_HEADER_SIZE : FRAME_HEADER_SIZE+p_size]
+	self.obfuscateBloc(&payload)
+	if crc32.ChecksumIEEE(payload) != p_crc {
+		return errors.New("CRC error. Extracted data is corrupted. Maybe a wrong offset or obfuscation seed ?")
+	}
+	_, err = output.Write(payload)
+
+	return err
+}
+
+// segmentToSpectrum computes the spectrum of one channel of a segment.
+func (self *wave_handler_struct) segmentToSpectrum(seg SamplesBloc, channel uint32, spectrum []complex128) {
+	var s_pos = channel
+
+	for i := range spectrum {
+		spectrum[i] = complex(float64(seg[s_pos]), 0)
+		s_pos += self.wave_info.num_channels
+	}
+	fft(spectrum, false)
+}
+
+// spectrumToSegment stores inverse transform of spectrum into one channel of a segment.
+// spectrum is overwritten.
+func (self *wave_handler_struct) spectrumToSegment(spectrum []complex128, seg SamplesBloc, channel uint32) {
+	var s_pos = channel
+
+	fft(spectrum, true)
+	for i := range spectrum {
+		seg[s_pos] = self.clipSample(real(spectrum[i]))
+		s_pos += self.wave_info.num_channels
+	}
+}
+
+// clipSample rounds value to the nearest integer, clipped to the sample dynamic.
+func (self *wave_handler_struct) clipSample(value float64) int32 {
+	var (
+		max = int64(1)<<(self.wave_info.bytes_per_sample*8-1) - 1
+		min = -max - 1
+		v   = int64(math.Floor(value + 0.5))
+	)
+
+	if v > max {
+		v = max
+	} else if v < min {
+		v = min
+	}
+
+	return int32(v)
+}
+
+//-----------------------------------------------------------------------
+//-- REVERSIBLE EMBEDDING on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// HidePayloadReversible hides payload by prediction error expansion in samples following the side
+// samples at wave_start_offset. Every sample is predicted from the two previous samples of its channel:
+// errors in [-threshold, threshold) are doubled and carry one bit, larger errors are shifted by
+// threshold. Threshold is hidden in the LSB of side samples, whose original LSBs are hidden first.
+// Samples following the last bit are not modified. If self.ctx is done before the end, samples already
+// modified are restored.
+func (self *wave_handler_struct) HidePayloadReversible() (err error) {
+	var (
+		n         = self.wave_info.num_samples
+		threshold = self.reversible_threshold
+		side      = make(SamplesBloc, REVERSIBLE_SIDE_SAMPLES)
+		samples   = make(SamplesBloc, SCAN_WINDOW)
+		predictor = newErrorPredictor(self.wave_info.num_channels)
+		bit       int
+	)
+
+	header, err := self.payloadFrameHeader()
+	if err != nil {
+		return err
+	}
+	if err = self.carrier.ReadSamples(uint64(self.wave_start_offset), side); err != nil {
+		return err
+	}
+
+	// Container: frame header, side LSBs and payload, streamed and obfuscated by blocs
+	prefix := append(header, self.sideLSBs(side)...)
+	container := io.MultiReader(bytes.NewReader(prefix), self.payload_file)
+	size := int64(len(prefix)) + self.payload_file_size
+	length := int(size * 8)
+	bloc := make(PayloadBloc, self.bloc_size)
+	self.resetObfuscation()
+	original := append(SamplesBloc{}, side...)
+
+	if err = self.progressStep(0, size); err != nil {
+		return &exit_error{EXIT_CANCELED, errors.New("Canceled before hiding anything.")}
+	}
+	for i := range side {
+		side[i] = side[i]&^1 | int32(threshold>>(REVERSIBLE_SIDE_SAMPLES-1-i)&1)
+	}
+	if err = self.carrier.WriteSamples(uint64(self.wave_start_offset), side); err != nil {
+		return err
+	}
+
+	for pos := self.wave_start_offset + REVERSIBLE_SIDE_SAMPLES; pos < n && bit < length; pos += SCAN_WINDOW {
+		if err = self.progressStep(int64(bit/8), size); err != nil {
+			if err = self.restoreReversible(pos, original); err != nil {
+				return err
+			}
+			return &exit_error{EXIT_CANCELED, errors.New(fmt.Sprintf("Canceled after hiding %s of %s: original samples restored.",
+				int64ToSuffixedStr(int64(bit/8)), int64ToSuffixedStr(size)))}
+		}
+
+		w := samples[0:min(n-pos, SCAN_WINDOW)]
+		if err = self.carrier.ReadSamples(uint64(pos), w); err != nil {
+			return err
+		}
+
+		last := 0
+		for i := 0; i < len(w) && bit < length && err == nil; i++ {
+			x := int64(w[i])
+			e := x - predictor.next()
+			predictor.push(x)
+			switch {
+			case e >= threshold:
+				w[i] = int32(x + threshold)
+			case e < -threshold:
+				w[i] = int32(x - threshold)
+			default:
+				if bit%(len(bloc)*8) == 0 {
+					err = self.readReversibleBloc(container, bloc[0:min(len(bloc), (length-bit)/8)])
+				}
+				w[i] = int32(x + e + int64(bloc[bit/8%len(bloc)]>>(7-bit%8)&1))
+				bit++
+			}
+			last = i
+		}
+		// Window is not written: samples before it are restored
+		if err != nil {
+			if rerr := self.restoreReversible(pos, original); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+		if err = self.carrier.WriteSamples(uint64(pos), w[0:last+1]); err != nil {
+			return err
+		}
+	}
+
+	// Capacity is checked by OpenPayload
+	if bit < length {
+		return errors.New(fmt.Sprintf("Payload (%s) is too big to be hidden reversibly in (%s).", self.payload_file_name, self.wave_file_name))
+	}
+	self.progressStep(size, size)
+
+	return nil
+}
+
+// readReversibleBloc fills bloc with the next bytes of container, obfuscated.
+func (self *wave_handler_struct) readReversibleBloc(container io.Reader, bloc PayloadBloc) (err error) {
+	if _, err = io.ReadFull(container, bloc); err != nil {
+		return err
+	}
+	self.obfuscateBloc(&bloc)
+
+	return nil
+}
+
+// restoreReversible gives back their original values to the samples expanded by HidePayloadReversible
+// from the side samples to stop, then writes back the original side samples.
+func (self *wave_handler_struct) restoreReversible(stop uint32, side SamplesBloc) (err error) {
+	var (
+		threshold = self.reversible_threshold
+		samples   = make(SamplesBloc, SCAN_WINDOW)
+		predictor = newErrorPredictor(self.wave_info.num_channels)
+	)
+
+	for pos := self.wave_start_offset + REVERSIBLE_SIDE_SAMPLES; pos < stop; pos += SCAN_WINDOW {
+		w := samples[0:min(stop-pos, SCAN_WINDOW)]
+		if err = self.carrier.ReadSamples(uint64(pos), w); err != nil {
+			return err
+		}
+		for i := range w {
+			prediction := predictor.next()
+			e := int64(w[i]) - prediction
+			switch {
+			case e >= 2*threshold:
+				e -= threshold
+			case e < -2*threshold:
+				e += threshold
+			default:
+				e >>= 1
+			}
+			w[i] = int32(prediction + e)
+			predictor.push(prediction + e)
+		}
+		if err = self.carrier.WriteSamples(uint64(pos), w); err != nil {
+			return err
+		}
+	}
+
+	return self.carrier.WriteSamples(uint64(self.wave_start_offset), side)
+}
+
+// ExtractPayloadReversible writes to output the payload hidden by HidePayloadReversible. If restore is
+// true, original samples are written back: the WAVE Audio file must be open for writing. Half restored
+// samples couldn't be extracted again, so self.ctx only stops extraction without restore.
+func (self *wave_handler_struct) ExtractPayloadReversible(output io.Writer, restore bool) (err error) {
+	var (
+		n         = self.wave_info.num_samples
+		lo, hi    = self.sampleRange()
+		side      = make(SamplesBloc, REVERSIBLE_SIDE_SAMPLES)
+		samples   = make(SamplesBloc, SCAN_WINDOW)
+		predictor = newErrorPredictor(self.wave_info.num_channels)
+		container = make(PayloadBloc, 0, FRAME_HEADER_SIZE+REVERSIBLE_SIDE_SIZE)
+		need      = FRAME_HEADER_SIZE
+		threshold int64
+		b, bits   byte
+		p_crc     uint32
+	)
+
+	not_found := errors.New(fmt.Sprintf("No reversibly hidden data at sample %d. Maybe a wrong offset or obfuscation seed ?", self.wave_start_offset))
+	if uint64(self.wave_start_offset)+REVERSIBLE_SIDE_SAMPLES >= uint64(n) {
+		return not_found
+	}
+	if err = self.carrier.ReadSamples(uint64(self.wave_start_offset), side); err != nil {
+		return err
+	}
+	for _, s := range side {
+		threshold = threshold<<1 | int64(s&1)
+	}
+	if threshold == 0 || threshold >= hi-lo {
+		return not_found
+	}
+	self.reversible_threshold = threshold
+
+	for pos := self.wave_start_offset + REVERSIBLE_SIDE_SAMPLES; pos < n && len(container) < need; pos += SCAN_WINDOW {
+		if err = self.progressStep(int64(len(container)), int64(need)); err != nil && !restore {
+			return &exit_error{EXIT_CANCELED, errors.New(fmt.Sprintf("Canceled after extracting %s of %s.",
+				int64ToSuffixedStr(int64(len(container))), int64ToSuffixedStr(int64(need))))}
+		}
+
+		w := samples[0:min(n-pos, SCAN_WINDOW)]
+		if err = self.carrier.ReadSamples(uint64(pos), w); err != nil {
+			return err
+		}
+
+		last := 0
+		for i := 0; i < len(w) && len(container) < need; i++ {
+			y := int64(w[i])
+			prediction := predictor.next()
+			e := y - prediction
+			switch {
+			case e >= 2*threshold:
+				e -= threshold
+			case e < -2*threshold:
+				e += threshold
+			default:
+				// Floor division: e is negative for half of expanded errors
+				b, bits = b<<1|byte(e&1), bits+1
+				e >>= 1
+			}
+			w[i] = int32(prediction + e)
+			predictor.push(prediction + e)
+			last = i
+
+			if bits < 8 {
+				continue
+			}
+			container, b, bits = append(container, b), 0, 0
+			if len(container) != FRAME_HEADER_SIZE {
+				continue
+			}
+
+			// Frame header tells how many bytes follow
+			header := append(PayloadBloc{}, container...)
+			self.resetObfuscation()
+			self.obfuscateBloc(&header)
+			p_size, crc, framed := parseFrameHeader(header)
+			if !framed || p_size > (n-pos)/8 {
+				return not_found
+			}
+			need += REVERSIBLE_SIDE_SIZE + int(p_size)
+			p_crc = crc
+		}
+		if restore {
+			if err = self.carrier.WriteSamples(uint64(pos), w[0:last+1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(container) < need {
+		return errors.New("Consistency error. Hidden data is truncated. Maybe a wrong offset ?")
+	}
+	self.progressStep(int64(need), int64(need))
+	self.resetObfuscation()
+	self.obfuscateBloc(&container)
+	payload := container[FRAME_HEADER_SIZE+REVERSIBLE_SIDE_SIZE:]
+	if crc32.ChecksumIEEE(payload) != p_crc {
+		return errors.New("CRC error. Extracted data is corrupted. Maybe a wrong offset or obfuscation seed ?")
+	}
+
+	if restore {
+		saved := container[FRAME_HEADER_SIZE : FRAME_HEADER_SIZE+REVERSIBLE_SIDE_SIZE]
+		for i := range side {
+			side[i] = side[i]&^1 | int32(saved[i/8]>>(7-i%8)&1)
+		}
+		if err = self.carrier.WriteSamples(uint64(self.wave_start_offset), side); err != nil {
+			return err
+		}
+	}
+	_, err = output.Write(payload)
+
+	return err
+}
+
+// reversibleErrors returns the histogram of prediction errors of samples following the side samples
+// at start, and the largest threshold keeping hidden samples off extreme values: hidden samples never
+// look like clipping.
+func (self *wave_handler_struct) reversibleErrors(start uint32) (histogram map[int64]uint32, max_threshold int64, err error) {
+	var (
+		n         = self.wave_info.num_samples
+		lo, hi    = self.sampleRange()
+		low, high = hi, lo
+		samples   = make(SamplesBloc, SCAN_WINDOW)
+		predictor = newErrorPredictor(self.wave_info.num_channels)
+	)
+
+	histogram = make(map[int64]uint32)
+	if uint64(start)+REVERSIBLE_SIDE_SAMPLES >= uint64(n) {
+		return histogram, 0, nil
+	}
+	for pos := start + REVERSIBLE_SIDE_SAMPLES; pos < n; pos += SCAN_WINDOW {
+		w := samples[0:min(n-pos, SCAN_WINDOW)]
+		if err = self.carrier.ReadSamples(uint64(pos), w); err != nil {
+			return nil, 0, err
+		}
+		for _, s := range w {
+			x := int64(s)
+			histogram[x-predictor.next()]++
+			predictor.push(x)
+			low, high = min(low, x), max(high, x)
+		}
+	}
+
+	// Side samples hold threshold
+	max_threshold = min(hi-high, low-lo, 1<<REVERSIBLE_SIDE_SAMPLES-1) - 1
+
+	return histogram, max(max_threshold, 0), nil
+}
+
+// reversibleThreshold returns the smallest threshold letting samples carry bits, and the number of
+// samples needed. It returns 0 if threshold would be greater than max_threshold.
+func reversibleThreshold(histogram map[int64]uint32, max_threshold int64, bits uint64) (threshold int64, carriers uint64) {
+	var needed = make(map[int64]uint64) // # of samples carrying a bit once threshold is reached
+
+	for e, c := range histogram {
+		if e >= 0 {
+			needed[e+1] += uint64(c)
+		} else {
+			needed[-e] += uint64(c)
+		}
+	}
+	thresholds := make([]int64, 0, len(needed))
+	for t := range needed {
+		if t <= max_threshold {
+			thresholds = append(thresholds, t)
+		}
+	}
+	sort.Slice(thresholds, func(a, b int) bool { return thresholds[a] < thresholds[b] })
+
+	for _, t := range thresholds {
+		if carriers += needed[t]; carriers >= bits {
+			return t, carriers
+		}
+	}
+
+	return 0, carriers
+}
+
+// sampleRange returns the lowest and the highest values of samples.
+func (self *wave_handler_struct) sampleRange() (lo, hi int64) {
+	full := int64(1) << (self.wave_info.bits_per_sample - 1)
+	return -full, full - 1
+}
+
+// sideLSBs returns the LSBs of side samples, first sample in most significant bit.
+func (self *wave_handler_struct) sideLSBs(side SamplesBloc) (lsbs PayloadBloc) {
+	lsbs = make(PayloadBloc, REVERSIBLE_SIDE_SIZE)
+	for i, s := range side {
+		lsbs[i/8] |= byte(s&1) << (7 - i%8)
+	}
+
+	return lsbs
+}
+
+// newErrorPredictor returns a predictor of interleaved samples of channels, starting at silence.
+func newErrorPredictor(channels uint32) *error_predictor {
+	return &error_predictor{previous: make([]int64, 2*channels), channels: int(channels)}
+}
+
+// next returns the prediction of next sample: linear extrapolation of the two previous samples of its
+// channel, like the order 2 fixed predictor of FLAC.
+func (self *error_predictor) next() int64 {
+	c := self.index % self.channels
+	return 2*self.previous[c] - self.previous[self.channels+c]
+}
+
+// push records the actual value of next sample.
+func (self *error_predictor) push(x int64) {
+	c := self.index % self.channels
+	self.previous[self.channels+c], self.previous[c] = self.previous[c], x
+	self.index++
+}
+
+//-----------------------------------------------------------------------
+//-- SPREAD SPECTRUM WATERMARK on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// Watermark adds to every channel a keyed pseudo noise sequence modulated by the bits of the
+// recipient ID. Amplitude follows the local RMS of the sound to stay under the masking level.
+func (self *wave_handler_struct) Watermark(key string, id uint32) (err error) {
+	var (
+		channels = self.wave_info.num_channels
+		bloc     = make(SamplesBloc, WATERMARK_SLOT_FRAMES*channels)
+		pn       = newPNGenerator(key)
+		code     = watermarkCodeword(key, id)
+		pos      uint64
+		end      = uint64(self.wave_info.num_frames * channels)
+	)
+
+	for slot := 0; pos < end; slot++ {
+		if end-pos < uint64(len(bloc)) {
+			bloc = bloc[0 : end-pos]
+		}
+		if err = self.carrier.ReadSamples(pos, bloc); err != nil {
+			return err
+		}
+		frames := uint32(len(bloc)) / channels
+
+		// Local RMS of the mono mix
+		var energy float64
+		for f := uint32(0); f < frames; f++ {
+			m := self.mixFrame(bloc[f*channels:])
+			energy += m * m
+		}
+		alpha := math.Max(WATERMARK_STRENGTH*math.Sqrt(energy/float64(frames)), 1)
+
+		// Add modulated chips
+		bit := code[slot%WATERMARK_BITS]
+		for f := uint32(0); f < frames; f++ {
+			w := alpha * bit * pn.Next()
+			for s_pos := f * channels; s_pos < (f+1)*channels; s_pos++ {
+				bloc[s_pos] = self.clipSample(float64(bloc[s_pos]) + w)
+			}
+		}
+
+		if err = self.carrier.WriteSamples(pos, bloc); err != nil {
+			return err
+		}
+		pos += uint64(len(bloc))
+	}
+
+	return nil
+}
+
+// DetectWatermark correlates the whitened mono mix with the keyed PN sequence and decodes
+// the recipient ID. found is true if the keyed check matches. confidence is the probability
+// that all bits are correctly decoded.
+func (self *wave_handler_struct) DetectWatermark(key string) (id uint32, confidence float64, found bool, err error) {
+	var (
+		channels = self.wave_info.num_channels
+		bloc     = make(SamplesBloc, WATERMARK_SLOT_FRAMES*channels)
+		pn       = newPNGenerator(key)
+		pos      uint64
+		end      = uint64(self.wave_info.num_frames * channels)
+		corr     [WATERMARK_BITS]float64
+		energy   [WATERMARK_BITS]float64
+		prev     float64
+		word     uint64
+	)
+
+	for slot := 0; pos < end; slot++ {
+		if end-pos < uint64(len(bloc)) {
+			bloc = bloc[0 : end-pos]
+		}
+		if err = self.carrier.ReadSamples(pos, bloc); err != nil {
+			return 0, 0, false, err
+		}
+
+		// First order difference removes most of the (low pass) sound energy
+		for f := uint32(0); f < uint32(len(bloc))/channels; f++ {
+			m := self.mixFrame(bloc[f*channels:])
+			d := m - prev
+			prev = m
+			corr[slot%WATERMARK_BITS] += d * pn.Next()
+			energy[slot%WATERMARK_BITS] += d * d
+		}
+		pos += uint64(len(bloc))
+	}
+
+	confidence = 1
+	for i := 0; i < WATERMARK_BITS; i++ {
+		if energy[i] == 0 {
+			return 0, 0, false, nil
+		}
+		z := corr[i] / math.Sqrt(energy[i])
+		word <<= 1
+		if z > 0 {
+			word |= 1
+		}
+		confidence *= 1 - 0.5*math.Erfc(math.Abs(z)/math.Sqrt2)
+	}
+
+	id = uint32(word >> 16)
+	code := watermarkCodeword(key, id)
+	for i := 0; i < WATERMARK_BITS; i++ {
+		if (code[i] > 0) != (word>>uint(WATERMARK_BITS-1-i)&1 == 1) {
+			return id, confidence, false, nil
+		}
+	}
+
+	return id, confidence, true, nil
+}
+
+// mixFrame returns the mean of the channels of the frame at the beginning of b.
+func (self *wave_handler_struct) mixFrame(b SamplesBloc) (m float64) {
+	for c := uint32(0); c < self.wave_info.num_channels; c++ {
+		m += float64(b[c])
+	}
+
+	return m / float64(self.wave_info.num_channels)
+}
+
+//-----------------------------------------------------------------------
+//-- CHUNK STORAGE on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// HidePayloadChunk appends the encrypted payload in a new chunk at the end of the RIFF (or FORM) file.
+// Chunks already holding a payload for the same passphrase are overwritten (removed first).
+func (self *wave_handler_struct) HidePayloadChunk(chunk_id string) (err error) {
+	chunked, err := self.chunkCarrier()
+	if err != nil {
+		return err
+	}
+	if _, err = self.StripPayloadChunks(); err != nil {
+		return err
+	}
+
+	// Container: random IV, then frame header and payload encrypted like a slot. Payload is read
+	// once for its CRC, then streamed to the chunk
+	header, err := self.payloadFrameHeader()
+	if err != nil {
+		return err
+	}
+	block, err := self.chunkCipher()
+	if err != nil {
+		return err
+	}
+	iv := make(PayloadBloc, SLOT_IV_SIZE)
+	if _, err = rand.Read(iv); err != nil {
+		return err
+	}
+	container := io.MultiReader(bytes.NewReader(iv),
+		cipher.StreamReader{S: cipher.NewCTR(block, iv), R: io.MultiReader(bytes.NewReader(header), self.payload_file)})
+
+	return chunked.AppendChunk(chunk_id, int(SLOT_IV_SIZE+FRAME_HEADER_SIZE+self.payload_file_size), container)
+}
+
+// ExtractPayloadChunk writes to output the payload of the first chunk holding one for current key.
+func (self *wave_handler_struct) ExtractPayloadChunk(output io.Writer) (err error) {
+	chunked, err := self.chunkCarrier()
+	if err != nil {
+		return err
+	}
+	chunks, err := chunked.Chunks()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		payload, err := self.chunkPayload(c)
+		if err != nil {
+			return err
+		}
+		if payload != nil {
+			_, err = output.Write(payload)
+			return err
+		}
+	}
+
+	return errors.New(fmt.Sprintf("No chunk holding a payload in \"%s\". Maybe a wrong passphrase ?", self.wave_file_name))
+}
+
+// StripPayloadChunks removes chunks holding a payload for current passphrase and returns their number.
+func (self *wave_handler_struct) StripPayloadChunks() (count int, err error) {
+	chunked, err := self.chunkCarrier()
+	if err != nil {
+		return 0, err
+	}
+	chunks, err := chunked.Chunks()
+	if err != nil {
+		return 0, err
+	}
+
+	// From last to first, so offsets of remaining chunks stay valid
+	for i := len(chunks) - 1; i >= 0; i-- {
+		payload, err := self.chunkPayload(chunks[i])
+		if err != nil {
+			return count, err
+		}
+		if payload == nil {
+			continue
+		}
+		if err = chunked.RemoveChunk(chunks[i]); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// chunkPayload returns the payload held by chunk c, or nil if c doesn't hold one for current passphrase.
+func (self *wave_handler_struct) chunkPayload(c chunk_info) (payload PayloadBloc, err error) {
+	var header = make(PayloadBloc, SLOT_IV_SIZE+FRAME_HEADER_SIZE)
+
+	chunked, err := self.chunkCarrier()
+	if err != nil {
+		return nil, err
+	}
+	if c.size < SLOT_IV_SIZE+FRAME_HEADER_SIZE || reservedChunkID(c.id) {
+		return nil, nil
+	}
+
+	if err = chunked.ReadChunk(c, 0, header); err != nil {
+		return nil, err
+	}
+	block, err := self.chunkCipher()
+	if err != nil {
+		return nil, err
+	}
+	stream := cipher.NewCTR(block, header[0:SLOT_IV_SIZE])
+	stream.XORKeyStream(header[SLOT_IV_SIZE:], header[SLOT_IV_SIZE:])
+	size, crc, framed := parseFrameHeader(header[SLOT_IV_SIZE:])
+	if !framed || size > c.size-SLOT_IV_SIZE-FRAME_HEADER_SIZE {
+		return nil, nil
+	}
+
+	payload = make(PayloadBloc, size)
+	if err = chunked.ReadChunk(c, SLOT_IV_SIZE+FRAME_HEADER_SIZE, payload); err != nil {
+		return nil, err
+	}
+	stream.XORKeyStream(payload, payload)
+	if crc32.ChecksumIEEE(payload) != crc {
+		return nil, nil
+	}
+
+	return payload, nil
+}
+
+// chunkCipher returns the AES cipher of chunks, derived from the slot key of passphrase.
+func (self *wave_handler_struct) chunkCipher() (block cipher.Block, err error) {
+	key, err := self.slotKey(self.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	encryption := sha256.Sum256(append([]byte("chunk:"), key.key...))
+
+	// Key is 32 bytes long: NewCipher can't fail
+	block, _ = aes.NewCipher(encryption[:])
+
+	return block, nil
+}
+
+// chunkCarrier returns the carrier of the WAVE Audio file as a chunk_carrier, or an error if its
+// format has no chunks.
+func (self *wave_handler_struct) chunkCarrier() (chunked chunk_carrier, err error) {
+	chunked, ok := self.carrier.(chunk_carrier)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("\"%s\" (%s) has no chunks. Use lsb or phase algorithm.", self.wave_file_name, self.carrier.Format()))
+	}
+
+	return chunked, nil
+}
+
+// chunkPayloadMax returns the size of the largest payload a chunk appended to chunked can hold.
+func chunkPayloadMax(chunked chunk_carrier) uint32 {
+	if capacity := chunked.ChunkCapacity(); capacity > SLOT_IV_SIZE+FRAME_HEADER_SIZE {
+		return capacity - SLOT_IV_SIZE - FRAME_HEADER_SIZE
+	}
+
+	return 0
+}
+
+// offsetToSample returns the sample index of offset. Offset must be before the end of sound.
+func (self *wave_handler_struct) offsetToSample(offset offset_spec) (sample uint32, err error) {
+	var (
+		frames = float64(self.wave_info.num_frames)
+		frame  float64
+	)
+
+	switch offset.unit {
+	case "", OFFSET_SAMPLES:
+		// Legacy offsets don't care about frames
+		if offset.value != 0 && offset.value >= float64(self.wave_info.num_samples) {
+			return 0, &exit_error{EXIT_USAGE, errors.New(fmt.Sprintf("Offset (%s) is beyond the end of sound (%d samples).", offset.text, self.wave_info.num_samples))}
+		}
+		return uint32(offset.value), nil
+	case OFFSET_FRAMES:
+		frame = offset.value
+	case OFFSET_TIME:
+		frame = math.Round(offset.value * float64(self.wave_info.sampling_frequency))
+	case OFFSET_PERCENT:
+		frame = math.Floor(offset.value / 100 * frames)
+	}
+
+	if frame != 0 && frame >= frames {
+		return 0, &exit_error{EXIT_USAGE, errors.New(fmt.Sprintf("Offset (%s) is beyond the end of sound (%d frames, %s).", offset.text,
+			self.wave_info.num_frames, self.frameTimestamp(self.wave_info.num_frames)))}
+	}
+
+	return uint32(frame) * self.wave_info.num_channels, nil
+}
+
+// frameTimestamp returns the time of frame as [hh:]mm:ss.fff.
+func (self *wave_handler_struct) frameTimestamp(frame uint32) string {
+	ms := uint64(frame) * 1000 / uint64(self.wave_info.sampling_frequency)
+
+	if ms >= 3600000 {
+		return fmt.Sprintf("%d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+	}
+
+	return fmt.Sprintf("%02d:%02d.%03d", ms/60000, ms/1000%60, ms%1000)
+}
+
+// OpenWaveOutput opens the WAVE Audio file for writing. If output != "", the file is copied byte for
+// byte to a temporary file next to output and the copy is opened instead. Sync renames it to output,
+// or writes it to stdout if output is -, so filename is never modified. Filename - is stdin.
+func (self *wave_handler_struct) OpenWaveOutput(filename, output string) (err error) {
+	var (
+		src  = os.Stdin
+		mode = os.FileMode(0644)
+		dir  = os.TempDir()
+	)
+
+	if output == "" {
+		return self.OpenWave(filename, true)
+	}
+
+	if filename != "-" {
+		if src, err = os.Open(filename); err != nil {
+			return err
+		}
+		defer src.Close()
+
+		fi, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		if fo, err := os.Stat(output); err == nil && os.SameFile(fi, fo) {
+			return errors.New(fmt.Sprintf("Output \"%s\" is the WAVE Audio file itself.", output))
+		}
+		mode = fi.Mode()
+	}
+	if output != "-" {
+		dir = filepath.Dir(output)
+	}
+
+	dst, err := os.CreateTemp(dir, "."+APP+"-*"+filepath.Ext(output))
+	if err != nil {
+		return err
+	}
+	self.temp_file_name = dst.Name()
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Chmod(mode)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = self.OpenWave(self.temp_file_name, true); err != nil {
+		return err
+	}
+	self.wave_file_name = output
+
+	return nil
+}
+
+// Sync commits changes to the WAVE Audio file.
+func (self *wave_handler_struct) Sync() (err error) {
+	if err = self.carrier.Sync(); err != nil || self.temp_file_name == "" {
+		return err
+	}
+
+	// Copy is removed by Free
+	if self.wave_file_name == "-" {
+		f, err := os.Open(self.temp_file_name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(os.Stdout, f)
+		return err
+	}
+
+	if err = os.Rename(self.temp_file_name, self.wave_file_name); err != nil {
+		return err
+	}
+	self.temp_file_name = ""
+
+	return nil
+}
+
+// Free allocated ressources
+func (self *wave_handler_struct) Free() {
+	if self.payload_file != nil {
+		self.payload_file.Close()
+	}
+
+	if self.carrier != nil {
+		self.carrier.Close()
+	}
+
+	// Copy was not committed, or was written to stdout
+	if self.temp_file_name != "" {
+		os.Remove(self.temp_file_name)
+	}
+
+	for _, name := range self.temp_files {
+		os.Remove(name)
+	}
+}
+
+// copyStdin copies stdin to a temporary file and returns its name. Free removes it.
+func (self *wave_handler_struct) copyStdin() (name string, err error) {
+	f, err := os.CreateTemp("", APP+"-*.stdin")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	self.temp_files = append(self.temp_files, f.Name())
+
+	if _, err = io.Copy(f, os.Stdin); err != nil {
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+//-----------------------------------------------------------------------
+//-- CHUNK INSPECTION on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// ChunkTree returns the chunks of the WAVE Audio file with their decoded content.
+func (self *wave_handler_struct) ChunkTree() (nodes []chunk_node, err error) {
+	// AU and FLAC files have no chunks
+	chunked, ok := self.carrier.(chunk_carrier)
+	if !ok {
+		return []chunk_node{}, nil
+	}
+
+	chunks, err := chunked.Chunks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range chunks {
+		node := chunk_node{ID: c.id, Offset: c.offset, Size: c.size, Padding: c.length - (c.data - c.offset) - int64(c.size)}
+
+		// Sub chunks of LIST chunks are RIFF chunks in RIFF/WAVE files only
+		decoder := chunkDecoder(c.id)
+		if c.id == "LIST" && !chunked.ListSubChunks() {
+			decoder = nil
+		}
+
+		if decoder != nil && c.size <= CHUNK_DECODE_MAX {
+			data := make([]byte, c.size)
+			if err = chunked.ReadChunk(c, 0, data); err != nil {
+				return nil, err
+			}
+			decoder(&node, data, c.data)
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// UpdateBext updates fields of the bext chunk. Each update is field=value, where field is a text
+// field, time_reference, or coding_history whose value is appended as a new line.
+func (self *wave_handler_struct) UpdateBext(updates []string) (err error) {
+	chunked, ok := self.carrier.(chunk_carrier)
+	if !ok {
+		return errors.New(fmt.Sprintf("%s files have no bext chunk.", self.carrier.Format()))
+	}
+	chunks, err := chunked.Chunks()
+	if err != nil {
+		return err
+	}
+
+	var bext *chunk_info
+	for i := range chunks {
+		if chunks[i].id == "bext" {
+			bext = &chunks[i]
+			break
+		}
+	}
+	if bext == nil {
+		return errors.New(fmt.Sprintf("\"%s\" has no bext chunk.", self.wave_file_name))
+	}
+	if bext.size < 602 || bext.size > CHUNK_DECODE_MAX {
+		return errors.New(fmt.Sprintf("Bad bext chunk size (%d bytes).", bext.size))
+	}
+
+	data := make([]byte, bext.size)
+	if err = chunked.ReadChunk(*bext, 0, data); err != nil {
+		return err
+	}
+
+	for _, update := range updates {
+		name, value, _ := strings.Cut(update, "=")
+		switch name {
+		case "time_reference":
+			ref, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Bad time_reference (%s) for --bext.", value))
+			}
+			binary.LittleEndian.PutUint64(data[338:], ref)
+		case "coding_history":
+			// Lines are terminated by CR/LF (EBU R98)
+			history := bytes.TrimRight(data[602:], "\x00")
+			data = append(append(data[0:602:602], history...), value+"\r\n"...)
+		default:
+			field := bext_fields[name]
+			text := make([]byte, field.end-field.start)
+			copy(text, value)
+			copy(data[field.start:field.end], text)
+		}
+	}
+
+	return chunked.WriteChunk(*bext, data)
+}
+
+// PrintChunks prints the chunk tree to output, as text or JSON.
+func (self *wave_handler_struct) PrintChunks(output io.Writer, format string) (err error) {
+	nodes, err := self.ChunkTree()
+	if err != nil {
+		return err
+	}
+
+	if format == FORMAT_JSON {
+		return printJSON(output, chunks_report{File: self.wave_file_name, Format: self.carrier.Format(), Chunks: nodes})
+	}
+
+	msg := fmt.Sprintf("Chunks of \"%s\" (%s)\n", self.wave_file_name, self.carrier.Format())
+	msg += fmt.Sprintf("===================\n")
+	if len(nodes) == 0 {
+		msg += fmt.Sprintf("  No chunks\n")
+	}
+	msg += chunkNodesText(nodes, "  ")
+
+	fmt.Fprintln(output, msg)
+	return nil
+}
+
+//-----------------------------------------------------------------------
+//-- ANALYSIS on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// Analyze prints regions holding data hidden by lsb algorithm with any density for current
+// obfuscation seed, then chunks holding a payload. Returns true if hidden data were found.
+func (self *wave_handler_struct) Analyze(output io.Writer) (found bool, err error) {
+	var msg string
+
+	msg = fmt.Sprintf("Analysis of \"%s\"\n", self.wave_file_name)
+	msg += fmt.Sprintf("==================\n")
+	msg += fmt.Sprintf("  Obfuscation seed               : %d\n", self.payload_obfuscation_seed)
+
+	defer func(algorithm string, density uint32) {
+		self.algorithm, self.density, self.samples_for_one_byte = algorithm, density, 8/density
+	}(self.algorithm, self.density)
+
+	self.algorithm = ALGO_LSB
+	for _, density := range []uint32{1, 2, 4, 8} {
+		if density >= self.wave_info.bits_per_sample {
+			break
+		}
+		self.density, self.samples_for_one_byte = density, 8/density
+
+		regions, err := self.ScanHiddenData()
+		if err != nil {
+			return false, err
+		}
+		for _, r := range regions {
+			msg += fmt.Sprintf("  Density %d                      : samples %d to %d (%s), %s (%d bytes)\n", density, r.start, r.stop,
+				self.frameTimestamp(r.start/self.wave_info.num_channels), intToSuffixedStr(r.size), r.size)
+		}
+		found = found || len(regions) != 0
+	}
+
+	// AU and FLAC files have no chunks. Chunks are encrypted with passphrase
+	if _, ok := self.carrier.(chunk_carrier); ok && self.passphrase != "" {
+		self.algorithm = ALGO_CHUNK
+		regions, err := self.ScanHiddenData()
+		if err != nil {
+			return false, err
+		}
+		for _, r := range regions {
+			msg += fmt.Sprintf("  Chunk at byte %-10d             : %s (%d bytes)\n", r.start, intToSuffixedStr(r.size), r.size)
+		}
+		found = found || len(regions) != 0
+	}
+
+	if !found {
+		msg += fmt.Sprintf("  No hidden data found for this seed.\n")
+	}
+
+	fmt.Fprintln(output, msg)
+	return found, nil
+}
+
+// Compare prints how samples of other differ from samples of the WAVE Audio file. Both files
+// must have the same number of channels, sample size and number of samples.
+func (self *wave_handler_struct) Compare(other *wave_handler_struct, output io.Writer) (differ bool, err error) {
+	var (
+		a, b     = make(SamplesBloc, SCAN_WINDOW), make(SamplesBloc, SCAN_WINDOW)
+		n        = self.wave_info.num_samples
+		count    uint32
+		first    uint32
+		last     uint32
+		max_diff int64
+		msg      string
+	)
+
+	if self.wave_info.num_channels != other.wave_info.num_channels || self.wave_info.bits_per_sample != other.wave_info.bits_per_sample ||
+		n != other.wave_info.num_samples {
+		return false, errors.New(fmt.Sprintf("\"%s\" and \"%s\" have different channels, sample sizes or lengths.",
+			self.wave_file_name, other.wave_file_name))
+	}
+
+	for start := uint32(0); start < n; start += SCAN_WINDOW {
+		size := min(n-start, SCAN_WINDOW)
+		if err = self.carrier.ReadSamples(uint64(start), a[0:size]); err != nil {
+			return false, err
+		}
+		if err = other.carrier.ReadSamples(uint64(start), b[0:size]); err != nil {
+			return false, err
+		}
+
+		for i := uint32(0); i < size; i++ {
+			if a[i] == b[i] {
+				continue
+			}
+			if count == 0 {
+				first = start + i
+			}
+			last = start + i
+			count++
+			diff := int64(a[i]) - int64(b[i])
+			max_diff = max(max_diff, diff, -diff)
+		}
+	}
+
+	msg = fmt.Sprintf("Comparison of \"%s\" and \"%s\"\n", self.wave_file_name, other.wave_file_name)
+	msg += fmt.Sprintf("==================\n")
+	msg += fmt.Sprintf("  Samples compared               : %d\n", n)
+	msg += fmt.Sprintf("  Differing samples              : %d (%.2f%%)\n", count, 100*float64(count)/float64(max(n, 1)))
+	if count != 0 {
+		msg += fmt.Sprintf("  First difference at sample     : %d (%s)\n", first, self.frameTimestamp(first/self.wave_info.num_channels))
+		msg += fmt.Sprintf("  Last difference at sample      : %d (%s)\n", last, self.frameTimestamp(last/self.wave_info.num_channels))
+		msg += fmt.Sprintf("  Max difference                 : %d (%d low bits)\n", max_diff, bits.Len64(uint64(max_diff)))
+	}
+
+	fmt.Fprintln(output, msg)
+	return count != 0, nil
+}
+
+//-----------------------------------------------------------------------
+//-- VERIFICATION on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// Extract writes to output the payload hidden with current algorithm and key.
+func (self *wave_handler_struct) Extract(output io.Writer) (err error) {
+	switch {
+	case self.algorithm == ALGO_CHUNK:
+		return self.ExtractPayloadChunk(output)
+	case self.algorithm == ALGO_PHASE:
+		return self.ExtractPayloadPhase(output)
+	case self.algorithm == ALGO_REVERSIBLE:
+		return self.ExtractPayloadReversible(output, false)
+	case self.passphrase != "":
+		return self.ExtractPayloadSlot(output)
+	case self.offset_key != "":
+		var found bool
+		if self.wave_start_offset, found, err = self.findKeyedOffset(); err != nil {
+			return err
+		} else if !found {
+			return errors.New(fmt.Sprintf("No hidden data found in \"%s\" for this offset key.", self.wave_file_name))
+		}
+	}
+
+	return self.ExtractPayload(self.wave_start_offset, output)
+}
+
+// Hide hides the payload with current algorithm and key. Chunk algorithm stores it in a chunk_id chunk.
+// Slots of keep passphrases are kept intact. Returns the number of bytes written to the WAVE Audio file,
+// frame header included.
+func (self *wave_handler_struct) Hide(chunk_id string, keep []string) (written int64, err error) {
+	// Frame header and payload, plus the clear IV of a slot or chunk. Counted in int64: multi-GB carriers overflow uint32
+	stored := self.payload_file_size + FRAME_HEADER_SIZE
+	if self.passphrase != "" {
+		stored += SLOT_IV_SIZE
+	}
+	written = stored * int64(self.samples_for_one_byte) * int64(self.wave_info.bytes_per_sample)
+
+	switch {
+	case self.algorithm == ALGO_CHUNK:
+		err = self.HidePayloadChunk(chunk_id)
+		// Chunk header, IV, frame header and payload, padded to an even size
+		written = 8 + stored + stored%2
+	case self.algorithm == ALGO_PHASE:
+		err = self.HidePayloadPhase()
+		segments := int64(self.wave_info.num_frames-self.phase_start_frame) / PHASE_SEGMENT_LEN
+		written = segments * PHASE_SEGMENT_LEN * int64(self.wave_info.byte_per_bloc)
+	case self.algorithm == ALGO_REVERSIBLE:
+		err = self.HidePayloadReversible()
+		written = int64(self.wave_info.num_samples-self.wave_start_offset) * int64(self.wave_info.bytes_per_sample)
+	case self.passphrase != "":
+		err = self.HidePayloadSlot(keep)
+	case self.offset_key != "":
+		err = self.HidePayloadKeyed()
+	default:
+		err = self.HidePayload(self.wave_start_offset)
+	}
+
+	return written, err
+}
+
+// VerifyPayload extracts back the payload just hidden and compares it with the payload file.
+// Differing data is an error.
+func (self *wave_handler_struct) VerifyPayload() (report *verify_report, err error) {
+	if _, err = self.payload_file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	result, err := self.Verify(self.payload_file, "")
+	if err == nil && !result.Match {
+		err = &exit_error{EXIT_VERIFY, errors.New(fmt.Sprintf("Verification failed: %d byte(s) of payload extracted back from \"%s\" differ, first at offset %d.",
+			result.Differing, self.wave_file_name, result.Offsets[0]))}
+	}
+
+	return &result, err
+}
+
+// Verify extracts the payload and compares it with expected, or only its digest with expected_sha256
+// (hexadecimal) if expected is nil. Hidden data not found is an error, differing data is not.
+func (self *wave_handler_struct) Verify(expected io.Reader, expected_sha256 string) (report verify_report, err error) {
+	var (
+		vw       = &verify_writer{digest: sha256.New()}
+		original = sha256.New()
+	)
+
+	if expected != nil {
+		vw.expected = io.TeeReader(expected, original)
+	}
+	if err = self.Extract(vw); err != nil {
+		return report, err
+	}
+
+	report = verify_report{File: self.wave_file_name, Size: vw.size, ExpectedSize: -1, SHA256: fmt.Sprintf("%x", vw.digest.Sum(nil)),
+		ExpectedSHA256: strings.ToLower(expected_sha256), Differing: -1, Offsets: []int64{}}
+
+	if expected == nil {
+		report.Match = report.SHA256 == report.ExpectedSHA256
+		if report.Match {
+			report.Differing = 0
+		}
+		return report, nil
+	}
+
+	// Bytes of payload following extracted data are missing
+	missing, err := io.Copy(original, expected)
+	if err != nil {
+		return report, err
+	}
+	if missing != 0 {
+		vw.differ(vw.size, missing)
+	}
+
+	report.ExpectedSize = vw.read + missing
+	report.ExpectedSHA256 = fmt.Sprintf("%x", original.Sum(nil))
+	report.Differing = vw.count
+	report.Offsets = append(report.Offsets, vw.offsets...)
+	report.Match = vw.count == 0
+
+	return report, nil
+}
+
+// printVerify prints report to output, as text or JSON.
+func printVerify(output io.Writer, report verify_report, format string) (err error) {
+	if format == FORMAT_JSON {
+		return printJSON(output, report)
+	}
+
+	msg := fmt.Sprintf("Verification of \"%s\"\n", report.File)
+	msg += fmt.Sprintf("===============\n")
+	msg += fmt.Sprintf("  Extracted size                 : %s (%d bytes)\n", int64ToSuffixedStr(report.Size), report.Size)
+	if report.ExpectedSize >= 0 {
+		msg += fmt.Sprintf("  Payload size                   : %s (%d bytes)\n", int64ToSuffixedStr(report.ExpectedSize), report.ExpectedSize)
+	}
+	msg += fmt.Sprintf("  Extracted SHA-256              : %s\n", report.SHA256)
+	msg += fmt.Sprintf("  Payload SHA-256                : %s\n", report.ExpectedSHA256)
+	switch {
+	case report.Match:
+		msg += fmt.Sprintf("  Result                         : match\n")
+	case report.Differing < 0:
+		msg += fmt.Sprintf("  Result                         : digests differ\n")
+	default:
+		offsets := fmt.Sprint(report.Offsets)
+		if int64(len(report.Offsets)) < report.Differing {
+			offsets = offsets[:len(offsets)-1] + " ...]"
+		}
+		msg += fmt.Sprintf("  Result                         : %d byte(s) differ\n", report.Differing)
+		msg += fmt.Sprintf("    At offsets                   : %s\n", offsets)
+	}
+
+	_, err = fmt.Fprintln(output, msg)
+	return err
+}
+
+//-----------------------------------------------------------------------
+//-- WIPE on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// Wipe erases the payload hidden with current algorithm and key. Samples holding it are restored from
+// cover if not nil, else their density LSBs are drawn at random from the distribution of LSBs of other
+// samples, so they look like untouched samples. Reversibly hidden data is removed by restoring original
+// samples. Chunks holding a payload are removed. Returns the number of samples (or chunks) erased.
+// Hidden data still extractable afterwards is an error.
+func (self *wave_handler_struct) Wipe(cover *wave_handler_struct) (count uint64, err error) {
+	if cover != nil && (self.wave_info.num_channels != cover.wave_info.num_channels ||
+		self.wave_info.bits_per_sample != cover.wave_info.bits_per_sample || self.wave_info.num_samples != cover.wave_info.num_samples) {
+		return 0, &exit_error{EXIT_USAGE, errors.New(fmt.Sprintf("\"%s\" and \"%s\" have different channels, sample sizes or lengths.",
+			self.wave_file_name, cover.wave_file_name))}
+	}
+
+	if self.algorithm == ALGO_CHUNK {
+		n, err := self.StripPayloadChunks()
+		count = uint64(n)
+		if err != nil {
+			return count, err
+		}
+	}
+
+	// Several offsets derived from key may hold a frame header: every one is erased
+	for i := 0; self.algorithm != ALGO_CHUNK && i < OFFSET_CANDIDATES; i++ {
+		at, n, err := self.payloadPositions()
+		if err != nil {
+			return count, err
+		}
+		if at == nil {
+			break
+		}
+
+		switch {
+		case cover != nil:
+			err = self.restoreSamples(cover, at, n)
+		case self.algorithm == ALGO_REVERSIBLE:
+			err = self.ExtractPayloadReversible(io.Discard, true)
+		case self.algorithm == ALGO_PHASE:
+			err = &exit_error{EXIT_USAGE, errors.New("Phase coded data can only be wiped with --cover: every segment is altered.")}
+		case self.passphrase != "":
+			err = self.randomizeLSBs(at, n, 0, 0)
+		default:
+			err = self.randomizeLSBs(at, n, at(0), at(n-1)+1)
+		}
+		if err != nil {
+			return count, err
+		}
+		count += n
+
+		if self.offset_key == "" {
+			break
+		}
+	}
+
+	if count == 0 {
+		return 0, &exit_error{EXIT_NOT_FOUND, errors.New(fmt.Sprintf("No hidden data found in \"%s\" for this key.", self.wave_file_name))}
+	}
+	if err = self.Extract(io.Discard); err == nil {
+		return count, errors.New(fmt.Sprintf("Hidden data can still be extracted from \"%s\".", self.wave_file_name))
+	}
+
+	return count, nil
+}
+
+// payloadPositions returns the positions of the count samples holding the payload of current key, or
+// nil if no hidden data is found.
+func (self *wave_handler_struct) payloadPositions() (at position_func, count uint64, err error) {
+	var first, length uint64
+
+	switch {
+	case self.algorithm == ALGO_PHASE:
+		if self.ExtractPayloadPhase(io.Discard) != nil {
+			return nil, 0, nil
+		}
+		// Relative phases of every following segment were shifted
+		channels := uint64(self.wave_info.num_channels)
+		segments := uint64((self.wave_info.num_frames - self.phase_start_frame) / PHASE_SEGMENT_LEN)
+		first, length = uint64(self.phase_start_frame)*channels, segments*PHASE_SEGMENT_LEN*channels
+	case self.algorithm == ALGO_REVERSIBLE:
+		if self.ExtractPayloadReversible(io.Discard, false) != nil {
+			return nil, 0, nil
+		}
+		first, length = uint64(self.wave_start_offset), uint64(self.wave_info.num_samples-self.wave_start_offset)
+	case self.passphrase != "":
+		slot, err := self.findSlot(self.passphrase)
+		if err != nil || slot == nil {
+			return nil, 0, err
+		}
+		at, count = self.slotPositions(slot, slot.length())
+		return at, count, nil
+	default:
+		offset := self.wave_start_offset
+		if self.offset_key != "" {
+			var found bool
+			if offset, found, err = self.findKeyedOffset(); err != nil || !found {
+				return nil, 0, err
+			}
+		}
+		if found, err := self.framedAt(offset); err != nil || !found {
+			return nil, 0, err
+		}
+
+		self.resetObfuscation()
+		header, err := self.unstegAt(offset, FRAME_HEADER_SIZE)
+		if err != nil {
+			return nil, 0, err
+		}
+		size, _, _ := parseFrameHeader(header)
+		first, length = uint64(offset), uint64(FRAME_HEADER_SIZE+size)*uint64(self.samples_for_one_byte)
+	}
+
+	return func(i uint64) uint64 { return first + i }, length, nil
+}
+
+// randomizeLSBs replaces the density LSBs of the count samples at positions by values drawn at random
+// with the frequencies of LSBs of samples outside [start, stop).
+func (self *wave_handler_struct) randomizeLSBs(at position_func, count uint64, start, stop uint64) (err error) {
+	var (
+		n       = uint64(self.wave_info.num_samples)
+		mask    = int32(1<<self.density) - 1
+		cdf     = make([]uint64, 1<<self.density)
+		samples = make(SamplesBloc, SCAN_WINDOW)
+		random  = bufio.NewReader(rand.Reader)
+		b       = make([]byte, 8)
+	)
+
+	for pos := uint64(0); pos < n; pos += SCAN_WINDOW {
+		w := samples[0:min(n-pos, SCAN_WINDOW)]
+		if err = self.carrier.ReadSamples(pos, w); err != nil {
+			return err
+		}
+		for i, s := range w {
+			if p := pos + uint64(i); p < start || p >= stop {
+				cdf[s&mask]++
+			}
+		}
+	}
+	for i := range cdf {
+		// Uniform if every sample holds hidden data
+		if cdf[len(cdf)-1] == 0 {
+			cdf[i] = 1
+		}
+		if i != 0 {
+			cdf[i] += cdf[i-1]
+		}
+	}
+	total := cdf[len(cdf)-1]
+
+	// Groups are drawn in the order samples are visited: any order is as random
+	var random_err error
+	err = self.writeLSBs(at, count, func(i uint64) byte {
+		if _, e := io.ReadFull(random, b); e != nil && random_err == nil {
+			random_err = e
+		}
+		r := binary.LittleEndian.Uint64(b) % total
+		return byte(sort.Search(len(cdf), func(k int) bool { return cdf[k] > r }))
+	})
+	if err == nil {
+		err = random_err
+	}
+
+	return err
+}
+
+// restoreSamples copies the count samples of cover at positions, by batches of POSITION_BATCH.
+func (self *wave_handler_struct) restoreSamples(cover *wave_handler_struct, at position_func, count uint64) (err error) {
+	var values = make([]int32, min(count, POSITION_BATCH))
+
+	for first := uint64(0); first < count; first += POSITION_BATCH {
+		batch := min(count-first, POSITION_BATCH)
+		at_batch := func(i uint64) uint64 { return at(first + i) }
+		if err = cover.forEachSample(at_batch, batch, false, func(i uint64, sample *int32) { values[i] = *sample }); err != nil {
+			return err
+		}
+		if err = self.forEachSample(at_batch, batch, true, func(i uint64, sample *int32) { *sample = values[i] }); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------
+//-- JSON REPORTS on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// InfoReport returns what PrintWAVInfo prints, and regions holding hidden data if scan is true.
+func (self *wave_handler_struct) InfoReport(scan bool) (report info_report, err error) {
+	info := &self.wave_info
+
+	report = info_report{
+		File:   self.wave_file_name,
+		Format: self.carrier.Format(),
+		Size:   self.carrier.Size(),
+		Wave: wave_report{
+			AudioFormat:    info.audio_format,
+			Channels:       info.num_channels,
+			SamplingRate:   info.sampling_frequency,
+			BytesPerSecond: info.bytes_per_sec,
+			BlockAlign:     info.byte_per_bloc,
+			BitsPerSample:  info.bits_per_sample,
+			BigEndian:      info.big_endian,
+			Canonical:      info.canonical && !info.extra_chunk,
+			Samples:        info.num_samples,
+			Frames:         info.num_frames,
+			SoundSize:      info.data_bloc_size,
+			Duration:       info.sound_duration.Seconds(),
+		},
+		Warnings: append([]string{}, info.warnings...),
+		Hiding:   self.hidingReport(),
+	}
+
+	if self.payload_file != nil {
+		payload := self.payloadReport()
+		report.Payload = &payload
+	}
+
+	if !scan {
+		return report, nil
+	}
+
+	regions := []region_report{}
+	if self.passphrase != "" && self.algorithm != ALGO_CHUNK {
+		slot, err := self.findSlot(self.passphrase)
+		if err != nil {
+			return report, err
+		}
+		if slot != nil {
+			regions = append(regions, region_report{Size: slot.size})
+		}
+	} else {
+		found, err := self.ScanHiddenData()
+		if err != nil {
+			return report, err
+		}
+		for _, r := range found {
+			regions = append(regions, region_report{Start: &r.start, Stop: &r.stop, Size: r.size})
+		}
+	}
+	report.Regions = &regions
+
+	return report, nil
+}
+
+// hidingReport returns the placement and the capacity of current algorithm.
+func (self *wave_handler_struct) hidingReport() (report hiding_report) {
+	report = hiding_report{Algorithm: self.algorithm, Capacity: self.payload_max_size}
+
+	switch {
+	case self.algorithm == ALGO_CHUNK:
+		report.Placement = "chunk"
+	case self.algorithm == ALGO_PHASE:
+		report.Placement = "segment"
+	case self.algorithm == ALGO_REVERSIBLE:
+		report.Placement = "offset"
+		report.Threshold = self.reversible_threshold
+		report.MaxAlteration = 100.0 * float64(self.reversible_threshold) / (0.15 * math.Pow(2, float64(self.wave_info.bits_per_sample)))
+	default:
+		report.Placement = "offset"
+		if self.passphrase != "" {
+			report.Placement = "passphrase"
+		} else if self.offset_key != "" {
+			report.Placement = "offset_key"
+		}
+		report.Density = self.density
+		report.SamplesPerByte = self.samples_for_one_byte
+		report.MaxAlteration = 100.0 * math.Pow(2, float64(self.density)) / (0.15 * math.Pow(2, float64(self.wave_info.bits_per_sample)))
+	}
+
+	return report
+}
+
+// payloadReport returns where the payload file is (or would be) hidden.
+func (self *wave_handler_struct) payloadReport() (report payload_report) {
+	report = payload_report{File: self.payload_file_name, Size: self.payload_file_size}
+
+	switch {
+	case self.algorithm == ALGO_CHUNK:
+	case self.algorithm == ALGO_PHASE:
+		report.Start = self.positionReport(self.phase_start_frame * self.wave_info.num_channels)
+		report.Stop = self.positionReport((self.phase_start_frame + PHASE_SEGMENT_LEN) * self.wave_info.num_channels)
+	case self.algorithm == ALGO_REVERSIBLE:
+		report.Start = self.positionReport(self.wave_start_offset)
+		report.Stop = self.positionReport(self.wave_info.num_samples)
+	case self.passphrase != "":
+		report.Samples = self.samples_to_hide_payload
+	default:
+		report.Samples = self.samples_to_hide_payload
+		report.Start = self.positionReport(self.wave_start_offset)
+		report.Stop = self.positionReport(self.wave_start_offset + self.samples_to_hide_payload)
+	}
+
+	return report
+}
+
+// positionReport returns sample with its frame and timestamp.
+func (self *wave_handler_struct) positionReport(sample uint32) *position_report {
+	frame := sample / self.wave_info.num_channels
+
+	return &position_report{Sample: sample, Frame: frame, Timestamp: self.frameTimestamp(frame)}
+}
+
+//-----------------------------------------------------------------------
+//-- CAPACITY PLANNER on *wave_handler_struct
+//-----------------------------------------------------------------------
+
+// PlanCarrier returns the capacity, the distortion and the detectability of every algorithm and
+// density supported by the WAVE Audio file, for a payload of size bytes.
+func (self *wave_handler_struct) PlanCarrier(size int64) (carrier plan_carrier, err error) {
+	var info = &self.wave_info
+
+	carrier = plan_carrier{File: self.wave_file_name, Format: self.carrier.Format(), Bits: info.bits_per_sample,
+		Samples: info.num_samples, Duration: info.sound_duration.Seconds()}
+	if carrier.NoiseFloor, err = self.noiseFloor(); err != nil {
+		return carrier, err
+	}
+
+	// Same densities as hide accepts
+	for _, density := range []uint32{1, 2, 4, 8} {
+		if density >= info.bits_per_sample/2 {
+			break
+		}
+		carrier.Options = append(carrier.Options, carrier.planLSB(density, size))
+	}
+
+	if (info.bits_per_sample == 16 || info.bits_per_sample == 24) && info.num_frames >= PHASE_SEGMENT_LEN {
+		option := plan_option{Algorithm: ALGO_PHASE, Capacity: (PHASE_SEGMENT_LEN/2-1)/8 - FRAME_HEADER_SIZE, Prior: true}
+		option.Fits = size <= int64(option.Capacity)
+		option.Detectability = PLAN_PHASE_SCORE * min(1, float64(size+FRAME_HEADER_SIZE)*8/(PHASE_SEGMENT_LEN/2-1))
+		carrier.Options = append(carrier.Options, option)
+	}
+
+	// Reversible hiding from first sample
+	histogram, max_threshold, err := self.reversibleErrors(0)
+	if err != nil {
+		return carrier, err
+	}
+	carrier.Options = append(carrier.Options, carrier.planReversible(histogram, max_threshold, size))
+
+	// AU and FLAC files have no chunks
+	if chunked, ok := self.carrier.(chunk_carrier); ok {
+		option := plan_option{Algorithm: ALGO_CHUNK, Capacity: chunkPayloadMax(chunked), Prior: true}
+		option.Fits = size <= int64(option.Capacity)
+		option.Detectability = PLAN_CHUNK_SCORE
+		carrier.Options = append(carrier.Options, option)
+	}
+
+	return carrier, nil
+}
+
+// planLSB returns the lsb configuration of carrier with density, for a payload of size bytes.
+func (self *plan_carrier) planLSB(density uint32, size int64) (option plan_option) {
+	var full = math.Pow(2, float64(self.Bits-1)) // Full scale amplitude
+
+	option = plan_option{Algorithm: ALGO_LSB, Density: density}
+	if self.Samples/(8/density) > FRAME_HEADER_SIZE {
+		option.Capacity = self.Samples/(8/density) - FRAME_HEADER_SIZE
+	}
+	option.Fits = size <= int64(option.Capacity)
+
+	// Replacing density LSBs by random bits adds a noise of variance (4^density-1)/6 to used samples
+	used := min(1, float64(size+FRAME_HEADER_SIZE)*float64(8/density)/float64(max(self.Samples, 1)))
+	mse := (math.Pow(4, float64(density)) - 1) / 6
+	distortion := 10 * math.Log10(mse*used/(full*full))
+	option.Distortion = &distortion
+	option.Detectability = 100 * min(1, math.Sqrt(mse)/self.NoiseFloor) * math.Sqrt(used)
+
+	return option
+}
+
+// planReversible returns the reversible configuration of carrier with histogram of prediction errors,
+// for a payload of size bytes.
+func (self *plan_carrier) planReversible(histogram map[int64]uint32, max_threshold int64, size int64) (option plan_option) {
+	var (
+		full = math.Pow(2, float64(self.Bits-1)) // Full scale amplitude
+		bits = uint64(size+FRAME_HEADER_SIZE+REVERSIBLE_SIDE_SIZE) * 8
+		sum  float64
+		n    float64
+	)
+
+	option = plan_option{Algorithm: ALGO_REVERSIBLE, Detectability: 100}
+	if _, total := reversibleThreshold(histogram, max_threshold, math.MaxUint64); total/8 > FRAME_HEADER_SIZE+REVERSIBLE_SIDE_SIZE {
+		option.Capacity = uint32(min(total/8-FRAME_HEADER_SIZE-REVERSIBLE_SIDE_SIZE, math.MaxUint32))
+	}
+	option.Fits = size <= int64(option.Capacity)
+	threshold, carriers := reversibleThreshold(histogram, max_threshold, bits)
+	if !option.Fits || threshold == 0 {
+		return option
+	}
+
+	// Expanded errors e move samples by e or e+1, others by threshold. Hiding stops after the last bit
+	for e, c := range histogram {
+		if e >= threshold || e < -threshold {
+			sum += float64(c) * float64(threshold*threshold)
+		} else {
+			sum += float64(c) * (float64(e*e+e) + 0.5)
+		}
+		n += float64(c)
+	}
+	mse := sum / n
+	used := min(1, float64(bits)/float64(carriers)) * n / float64(max(self.Samples, 1))
+	distortion := 10 * math.Log10(mse*used/(full*full))
+	option.Distortion = &distortion
+	option.Detectability = 100 * min(1, math.Sqrt(mse)/self.NoiseFloor) * math.Sqrt(used)
+
+	return option
+}
+
+// noiseFloor returns the RMS of the difference between samples and the mean of their neighbours
+// in the same channel. LSB alterations well below it are hard to tell from the cover noise.
+func (self *wave_handler_struct) noiseFloor() (rms float64, err error) {
+	var (
+		channels = self.wave_info.num_channels
+		n        = self.wave_info.num_samples
+		samples  = make(SamplesBloc, SCAN_WINDOW+2*channels)
+		sum      float64
+		count    float64
+	)
+
+	for start := uint32(0); start+2*channels < n; start += SCAN_WINDOW {
+		size := min(n-start, SCAN_WINDOW+2*channels)
+		if err = self.carrier.ReadSamples(uint64(start), samples[0:size]); err != nil {
+			return 0, err
+		}
+		for i := channels; i+channels < size; i++ {
+			residual := float64(samples[i]) - (float64(samples[i-channels])+float64(samples[i+channels]))/2
+			sum += residual * residual
+			count++
+		}
+	}
+
+	// Silence, or too short to tell
+	if count == 0 || sum == 0 {
+		return 0.5, nil
+	}
+	return math.Sqrt(sum / count), nil
+}
+
+// planCarriers opens every file and recommends the least detectable configuration fitting a payload
+// of size bytes. Splitting payload over carriers with lsb algorithm is recommended if it is less detectable.
+func planCarriers(files []string, size int64) (report plan_report) {
+	report = plan_report{PayloadSize: size, Carriers: []plan_carrier{}, Recommendation: []plan_part{}}
+
+	for _, file := range files {
+		var wh = &wave_handler_struct{bloc_size: 4096, algorithm: ALGO_LSB}
+
+		carrier := plan_carrier{File: file}
+		err := wh.OpenWave(file, false)
+		if err == nil {
+			carrier, err = wh.PlanCarrier(size)
+		}
+		if err != nil {
+			carrier.Error = err.Error()
+		}
+		wh.Free()
+		report.Carriers = append(report.Carriers, carrier)
+	}
+
+	// Least detectable, then least distorting, fitting configuration
+	var best *plan_part
+	var best_distortion float64
+	for _, carrier := range report.Carriers {
+		for _, option := range carrier.Options {
+			distortion := 0.0
+			if option.Distortion != nil {
+				distortion = *option.Distortion
+			}
+			if !option.Fits || best != nil && (option.Detectability > best.Detectability ||
+				option.Detectability == best.Detectability && distortion >= best_distortion) {
+				continue
+			}
+			best = &plan_part{carrier.File, option.Algorithm, option.Density, size, option.Detectability}
+			best_distortion = distortion
+		}
+	}
+	if best != nil {
+		report.Recommendation = append(report.Recommendation, *best)
+	}
+
+	// Split payload in proportion to capacities, with the lowest density fitting
+	for _, density := range []uint32{1, 2, 4, 8} {
+		var carriers []plan_carrier
+		var total int64
+		for _, carrier := range report.Carriers {
+			if carrier.Error == "" && density < carrier.Bits/2 && carrier.planLSB(density, 0).Capacity != 0 {
+				carriers = append(carriers, carrier)
+				total += int64(carrier.planLSB(density, 0).Capacity)
+			}
+		}
+		if total < size || len(carriers) < 2 {
+			continue
+		}
+
+		var parts []plan_part
+		var score float64
+		left := size
+		for i, carrier := range carriers {
+			part := size * int64(carrier.planLSB(density, 0).Capacity) / total
+			if i == len(carriers)-1 {
+				part = left
+			}
+			left -= part
+			if part != 0 {
+				option := carrier.planLSB(density, part)
+				parts = append(parts, plan_part{carrier.File, ALGO_LSB, density, part, option.Detectability})
+				score = max(score, option.Detectability)
+			}
+		}
+		if len(parts) > 1 && (best == nil || score < best.Detectability) {
+			report.Recommendation = parts
+		}
+		break
+	}
+
+	return report
+}
+
+// printPlan prints report to output, as text or JSON.
+func printPlan(output io.Writer, report plan_report, format string) (err error) {
+	if format == FORMAT_JSON {
+		return printJSON(output, report)
+	}
+
+	msg := fmt.Sprintf("Capacity plan for %s (%d bytes)\n", int64ToSuffixedStr(report.PayloadSize), report.PayloadSize)
+	msg += fmt.Sprintf("=================\n")
+	for _, carrier := range report.Carriers {
+		msg += fmt.Sprintf("  \"%s\"\n", carrier.File)
+		if carrier.Error != "" {
+			msg += fmt.Sprintf("    Error                        : %s\n", carrier.Error)
+			continue
+		}
+		msg += fmt.Sprintf("    Format                       : %s, %d bits, %.3fs\n", carrier.Format, carrier.Bits, carrier.Duration)
+		msg += fmt.Sprintf("    Noise floor                  : %.2f\n", carrier.NoiseFloor)
+		for _, option := range carrier.Options {
+			name := option.Algorithm
+			if option.Algorithm == ALGO_LSB {
+				name = fmt.Sprintf("%s, density %d", option.Algorithm, option.Density)
+			}
+			distortion := "unknown"
+			if option.Algorithm == ALGO_CHUNK {
+				distortion = "none"
+			} else if option.Distortion != nil {
+				distortion = fmt.Sprintf("%.1f dBFS", *option.Distortion)
+			}
+			fits := map[bool]string{false: "too small", true: "fits"}[option.Fits]
+			prior := map[bool]string{false: "", true: " (fixed prior)"}[option.Prior]
+			msg += fmt.Sprintf("    %-29s: %s, distortion %s, detectability %.1f%s, %s\n", name,
+				intToSuffixedStr(option.Capacity), distortion, option.Detectability, prior, fits)
+		}
+	}
+
+	msg += fmt.Sprintf("\nRecommendation\n")
+	msg += fmt.Sprintf("==============\n")
+	if len(report.Recommendation) == 0 {
+		msg += fmt.Sprintf("  Payload doesn't fit, even split over every carrier.\n")
+	}
+	for _, part := range report.Recommendation {
+		options := "--algorithm=" + part.Algorithm
+		if part.Algorithm == ALGO_LSB {
+			options = fmt.Sprintf("--density=%d", part.Density)
+		}
+		msg += fmt.Sprintf("  \"%s\" %s: %s (%d bytes), detectability %.1f\n", part.File, options,
+			int64ToSuffixedStr(part.Size), part.Size, part.Detectability)
+	}
+
+	_, err = fmt.Fprintln(output, msg)
+	return err
+}
+
+//-----------------------------------------------------------------------
+//-- BATCH
+//-----------------------------------------------------------------------
+
+// readManifest reads batch items from a JSON array of objects, or from CSV whose first row names
+// the columns. Values missing or empty are taken from defaults.
+func readManifest(filename string, defaults batch_item) (items []batch_item, err error) {
+	var records []map[string]string
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if strings.EqualFold(filepath.Ext(filename), ".json") || bytes.HasPrefix(data, []byte("[")) {
+		var objects []map[string]interface{}
+
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err = decoder.Decode(&objects); err != nil {
+			return nil, &exit_error{EXIT_FORMAT, errors.New(fmt.Sprintf("bad JSON manifest: %s", err))}
+		}
+		for _, object := range objects {
+			record := map[string]string{}
+			for name, value := range object {
+				if value != nil {
+					record[name] = fmt.Sprint(value)
+				}
+			}
+			records = append(records, record)
+		}
+	} else {
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.Comment = '#'
+		reader.TrimLeadingSpace = true
+		rows, err := reader.ReadAll()
+		if err != nil {
+			return nil, &exit_error{EXIT_FORMAT, errors.New(fmt.Sprintf("bad CSV manifest: %s", err))}
+		}
+		for _, row := range rows[min(1, len(rows)):] {
+			record := map[string]string{}
+			for i, value := range row {
+				record[rows[0][i]] = value
+			}
+			records = append(records, record)
+		}
+	}
+
+	// Columns are set in name order, so the error reported for an item doesn't change between runs
+	for _, record := range records {
+		var names []string
+		for name := range record {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		item := defaults
+		for _, name := range names {
+			if err = item.set(name, strings.TrimSpace(record[name])); err != nil && item.err == nil {
+				item.err = err
+			}
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// globItems returns one item per file matching pattern, with the options of defaults.
+func globItems(pattern string, defaults batch_item) (items []batch_item, err error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, &exit_error{EXIT_USAGE, err}
+	}
+	if len(files) == 0 {
+		return nil, &exit_error{EXIT_IO, errors.New("no file matches")}
+	}
+
+	for _, file := range files {
+		item := defaults
+		item.wave_file = file
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// set sets the option named by a manifest column. Names are case insensitive, - and _ are the same.
+// An empty value keeps the default.
+func (self *batch_item) set(name, value string) (err error) {
+	var n uint64
+
+	column := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "-", "_")
+	if !slices.Contains(batch_columns, column) {
+		return errors.New(fmt.Sprintf("Unknown column \"%s\" in manifest.", name))
+	}
+	if value == "" {
+		return nil
+	}
+
+	switch column {
+	case "action":
+		self.action = value
+	case "wave", "carrier":
+		self.wave_file = value
+	case "payload":
+		self.payload_file = value
+	case "algorithm":
+		self.algorithm = value
+	case "chunk":
+		self.chunk_id = value
+	case "density":
+		n, err = strconv.ParseUint(value, 10, 32)
+		self.density = uint32(n)
+	case "offset":
+		err = self.offset.Set(value)
+	case "offset_key", "key":
+		self.offset_key = value
+	case "obfuscate":
+		n, err = strconv.ParseUint(value, 10, 8)
+		self.obfuscate = uint8(n)
+	case "passphrase":
+		self.passphrase = value
+	case "output":
+		self.output = value
+	case "force":
+		self.force, err = strconv.ParseBool(value)
+	case "no_verify":
+		self.no_verify, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Bad value (%s) for %s: %s", value, name, err))
+	}
+
+	return nil
+}
+
+// check returns an error if the options of the item can't be used together, as parseArgs does.
+// stdin and stdout can't be shared by items.
+func (self *batch_item) check() (err error) {
+	var msg string
+
+	switch {
+	case self.err != nil:
+		return &exit_error{EXIT_USAGE, self.err}
+	case self.action != "info" && self.action != "hide" && self.action != "extract":
+		msg = fmt.Sprintf("Bad action (%s): must be info, hide or extract.", self.action)
+	case self.wave_file == "" || self.wave_file == "-":
+		msg = "A WAVE Audio file (not stdin) is mandatory."
+	case self.payload_file == "-" || self.output == "-":
+		msg = "Payload and output can't be stdin or stdout."
+	case self.algorithm != ALGO_LSB && self.algorithm != ALGO_PHASE && self.algorithm != ALGO_CHUNK && self.algorithm != ALGO_REVERSIBLE:
+		msg = fmt.Sprintf("Bad value (%v) for algorithm.", self.algorithm)
+	case self.density != 0 && self.density != 1 && self.density != 2 && self.density != 4 && self.density != 8:
+		msg = fmt.Sprintf("Bad value (%v) for density.", self.density)
+	case reservedChunkID(self.chunk_id) || !validChunkID(self.chunk_id):
+		msg = fmt.Sprintf("Chunk ID \"%s\" is reserved or not made of 4 printable ASCII characters.", self.chunk_id)
+	case self.passphrase != "" && self.algorithm != ALGO_LSB && self.algorithm != ALGO_CHUNK:
+		msg = "Passphrase is only supported by lsb and chunk algorithms."
+	case self.passphrase == "" && self.algorithm == ALGO_CHUNK:
+		msg = "Passphrase is mandatory with chunk algorithm: it encrypts the chunk."
+	case self.offset_key != "" && (self.algorithm != ALGO_LSB || self.passphrase != "" || self.offset.text != ""):
+		msg = "Offset key is only supported by lsb algorithm, without passphrase or offset."
+	case self.action != "info" && self.offset.text == "" && self.algorithm != ALGO_CHUNK && self.passphrase == "" && self.offset_key == "":
+		msg = "Offset or offset key is mandatory for this action."
+	case self.action == "hide" && self.payload_file == "":
+		msg = "Payload is mandatory for this action."
+	}
+	if msg != "" {
+		return &exit_error{EXIT_USAGE, errors.New(msg)}
+	}
+
+	return nil
+}
+
+// run runs the item with its own wave handler and fills result. Errors carry their exit code.
+func (self *batch_item) run(ctx context.Context, result *batch_result) (err error) {
+	var wh = &wave_handler_struct{bloc_size: 4096}
+
+	if err = self.check(); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return &exit_error{EXIT_CANCELED, errors.New("Canceled before start.")}
+	}
+
+	defer wh.Free()
+
+	wh.ctx = ctx
+	wh.offset = self.offset
+	wh.density = self.density
+	wh.algorithm = self.algorithm
+	wh.passphrase = self.passphrase
+	wh.offset_key = self.offset_key
+	wh.payload_obfuscation_seed = self.obfuscate
+	wh.resetObfuscation()
+	wh.obfuscate = self.obfuscate != 0
+
+	switch self.action {
+	case "info":
+		if err = wh.OpenWave(self.wave_file, false); err != nil {
+			return &exit_error{exitCode(err, EXIT_FORMAT), errors.New(fmt.Sprintf("Failed to open \"%s\": %s", self.wave_file, err))}
+		}
+		if self.payload_file != "" {
+			if err = wh.OpenPayload(self.payload_file); err != nil {
+				return &exit_error{exitCode(err, EXIT_CAPACITY), errors.New(fmt.Sprintf("Failed to open \"%s\": %s", self.payload_file, err))}
+			}
+		}
+
+		info, err := wh.InfoReport(false)
+		if err != nil {
+			return err
+		}
+		result.Info = &info
+	case "hide":
+		if err = wh.OpenWaveOutput(self.wave_file, self.output); err != nil {
+			return &exit_error{exitCode(err, EXIT_FORMAT), errors.New(fmt.Sprintf("Failed to open \"%s\": %s", self.wave_file, err))}
+		}
+		if wh.algorithm == ALGO_LSB && wh.density >= wh.wave_info.bits_per_sample/2 {
+			return &exit_error{EXIT_USAGE, errors.New(fmt.Sprintf("Density of %d is too high for sample size of %d bits.", wh.density,
+				wh.wave_info.bits_per_sample))}
+		}
+		if err = wh.OpenPayload(self.payload_file); err != nil {
+			return &exit_error{exitCode(err, EXIT_CAPACITY), errors.New(fmt.Sprintf("Failed to open \"%s\": %s", self.payload_file, err))}
+		}
+		if !self.force {
+			if err = wh.CheckOverwrite(); err != nil {
+				return &exit_error{exitCode(err, EXIT_EXISTS), err}
+			}
+		}
+
+		written, err := wh.Hide(self.chunk_id, nil)
+		if err == nil && !self.no_verify {
+			_, err = wh.VerifyPayload()
+		}
+		if err == nil {
+			err = wh.Sync()
+		}
+		if err != nil {
+			return err
+		}
+
+		hiding, payload := wh.hidingReport(), wh.payloadReport()
+		result.Hiding, result.Payload, result.Written, result.Output = &hiding, &payload, written, self.output
+	case "extract":
+		var (
+			digest  = sha256.New()
+			counter write_counter
+		)
+
+		if err = wh.OpenWave(self.wave_file, false); err != nil {
+			return &exit_error{exitCode(err, EXIT_FORMAT), errors.New(fmt.Sprintf("Failed to open \"%s\": %s", self.wave_file, err))}
+		}
+		f, err := os.Create(self.output)
+		if err != nil {
+			return &exit_error{EXIT_IO, errors.New(fmt.Sprintf("Failed to create \"%s\": %s", self.output, err))}
+		}
+
+		err = wh.Extract(io.MultiWriter(f, digest, &counter))
+		if close_err := f.Close(); err == nil {
+			err = close_err
+		}
+		if err != nil {
+			os.Remove(self.output)
+			return &exit_error{exitCode(err, EXIT_NOT_FOUND), err}
+		}
+
+		hiding := wh.hidingReport()
+		result.Hiding, result.Output = &hiding, self.output
+		result.Payload = &payload_report{Size: int64(counter.n), SHA256: fmt.Sprintf("%x", digest.Sum(nil))}
+	}
+
+	return nil
+}
+
+// files returns the absolute paths of the files item reads, and of the file it writes ("" if none).
+func (self *batch_item) files() (reads []string, write string) {
+	var names []string
+
+	switch self.action {
+	case "info", "extract":
+		names = []string{self.wave_file}
+	case "hide":
+		names = []string{self.wave_file, self.payload_file}
+	}
+	for _, name := range names {
+		if path, err := filepath.Abs(name); err == nil && name != "" && name != "-" {
+			reads = append(reads, path)
+		}
+	}
+
+	target := self.output
+	if self.action == "hide" && target == "" {
+		target = self.wave_file
+	}
+	if self.action != "info" && target != "" {
+		write, _ = filepath.Abs(target)
+	}
+
+	return reads, write
+}
+
+// runBatch runs items with jobs workers. Every item is run: errors are collected in the results.
+// Items writing a file already written by a previous item fail without being run, like items
+// following the end of ctx. An item reading a file written by a previous item, or writing a file
+// read by a previous item, waits for it: they run in manifest order.
+func runBatch(ctx context.Context, items []batch_item, jobs int) (report batch_report) {
+	var (
+		queue   = make(chan int)
+		workers sync.WaitGroup
+		written = map[string]int{}   // Item writing each file
+		read    = map[string][]int{} // Items reading each file
+		after   = make([][]int, len(items))
+		done    = make([]chan struct{}, len(items))
+		t0      = time.Now()
+	)
+
+	report = batch_report{Jobs: jobs, Items: len(items), Results: make([]batch_result, len(items))}
+
+	for i := range items {
+		item := &items[i]
+		done[i] = make(chan struct{})
+		if item.action == "extract" && item.output == "" {
+			item.output = item.wave_file + ".payload"
+		}
+		if item.err != nil {
+			continue
+		}
+
+		reads, write := item.files()
+		if previous, found := written[write]; found && write != "" {
+			item.err = errors.New(fmt.Sprintf("\"%s\" is already written by item %d.", write, previous+1))
+			continue
+		}
+		for _, path := range reads {
+			if previous, found := written[path]; found {
+				after[i] = append(after[i], previous)
+			}
+			read[path] = append(read[path], i)
+		}
+		if write != "" {
+			for _, previous := range read[write] {
+				if previous != i {
+					after[i] = append(after[i], previous)
+				}
+			}
+			written[write] = i
+		}
+	}
+
+	for w := 0; w < min(jobs, len(items)); w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range queue {
+				// Items are queued in order: previous items are already run by other workers
+				for _, previous := range after[i] {
+					<-done[previous]
+				}
+				report.Results[i] = runBatchItem(ctx, i+1, &items[i])
+				close(done[i])
+			}
+		}()
+	}
+	for i := range items {
+		queue <- i
+	}
+	close(queue)
+	workers.Wait()
+
+	for _, result := range report.Results {
+		if !result.Ok {
+			report.Failed++
+		}
+	}
+	report.Duration = time.Now().Sub(t0).Seconds()
+
+	return report
+}
+
+// runBatchItem runs item number n and returns its result.
+func runBatchItem(ctx context.Context, n int, item *batch_item) (result batch_result) {
+	result = batch_result{Item: n, Action: item.action, File: item.wave_file}
+
+	t0 := time.Now()
+	err := item.run(ctx, &result)
+	result.Duration = time.Now().Sub(t0).Seconds()
+
+	if err != nil {
+		result.Code = exitCode(err, EXIT_FAILURE)
+		result.Class = exit_classes[result.Code]
+		result.Error = err.Error()
+	} else {
+		result.Ok = true
+	}
+
+	return result
+}
+
+// printBatch prints report to output, as text or JSON.
+func printBatch(output io.Writer, report batch_report, format string) (err error) {
+	if format == FORMAT_JSON {
+		return printJSON(output, report)
+	}
+
+	title := fmt.Sprintf("Batch of %d item(s), %d job(s)", report.Items, report.Jobs)
+	msg := title + "\n" + strings.Repeat("=", len(title)) + "\n"
+	for _, result := range report.Results {
+		msg += fmt.Sprintf("  #%-4d %-8s \"%s\": ", result.Item, result.Action, result.File)
+		switch {
+		case !result.Ok:
+			msg += fmt.Sprintf("Failed (%s). %s\n", result.Class, result.Error)
+		case result.Info != nil:
+			msg += fmt.Sprintf("Ok. %s, %d bits, %.3fs, capacity %s with %s.\n", result.Info.Format, result.Info.Wave.BitsPerSample,
+				result.Info.Wave.Duration, intToSuffixedStr(result.Info.Hiding.Capacity), result.Info.Hiding.Algorithm)
+		case result.Action == "hide":
+			target := result.File
+			if result.Output != "" {
+				target = result.Output
+			}
+			msg += fmt.Sprintf("Ok. Hid %s with %s into \"%s\" in %.3fs.\n", int64ToSuffixedStr(result.Payload.Size),
+				result.Hiding.Algorithm, target, result.Duration)
+		default:
+			msg += fmt.Sprintf("Ok. Extracted %s to \"%s\" in %.3fs.\n", int64ToSuffixedStr(result.Payload.Size), result.Output,
+				result.Duration)
+		}
+	}
+	msg += fmt.Sprintf("Done: %d ok, %d failed in %.3fs.", report.Items-report.Failed, report.Failed, report.Duration)
+
+	_, err = fmt.Fprintln(output, msg)
+	return err
+}
+
+func main() {
+	var rc = 0
+	var err error
+
+	// Read cmd line arguments
+	if err = parseArgs(); err != nil {
+		rc = exitCode(err, EXIT_USAGE)
+		if rc != EXIT_OK && gd.format == FORMAT_JSON {
+			reportError(os.Stdout, err.Error(), rc)
+		}
+		os.Exit(rc)
+	}
+
+	if rc, err = runAction(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	os.Exit(rc)
+}
+
+func runAction() (rc int, err error) {
+	var wh = &wave_handler_struct{bloc_size: 4096}
+	var return_code = EXIT_OK
+	var report io.Writer = os.Stdout // Stdout may receive the WAVE Audio file
+	var bar = &progress_bar{output: os.Stderr}
+
+	if gd.output == "-" || gd.restore_file == "-" {
+		report = os.Stderr
+	}
+
+	defer wh.Free()
+
+	// Ctrl-C stops hiding and extraction between blocs, then a second one kills
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	wh.ctx = ctx
+	if !gd.no_progress && isTerminal(os.Stderr) {
+		wh.progress = bar.update
+	}
+
+	// Init wh
+	wh.offset = gd.offset
+	wh.density = gd.density
+	wh.algorithm = gd.algorithm
+	wh.passphrase = gd.passphrase
+	wh.offset_key = gd.offset_key
+	wh.payload_obfuscation_seed = gd.obfuscate
+	wh.resetObfuscation()
+	wh.obfuscate = gd.obfuscate != 0
+	wh.workers = gd.jobs
+
+	// Profiling ?
+	runtime.MemProfileRate = gd.memprofilerate
+	if gd.cpuprofile != "" {
+		fmt.Fprintf(os.Stderr, "Start profiling to %s\n", gd.cpuprofile)
+		f, err := os.Create(gd.cpuprofile)
+		if err != nil {
+			return reportError(report, fmt.Sprintf("Failed to create \"%s\": %s", gd.cpuprofile, err), EXIT_IO), nil
+		}
+		defer f.Close()
+		if err = pprof.StartCPUProfile(f); err != nil {
+			return reportError(report, fmt.Sprintf("Failed to profile to \"%s\": %s", gd.cpuprofile, err), EXIT_IO), nil
+		}
+		defer func() {
+			fmt.Fprintf(os.Stderr, "Stop profiling.\n")
+			pprof.StopCPUProfile()
+		}()
+	}
+	if gd.memprofile != "" {
+		defer func() {
+			if err := writeHeapProfile(gd.memprofile); err != nil && rc == EXIT_OK {
+				rc = reportError(report, fmt.Sprintf("Failed to write \"%s\": %s", gd.memprofile, err), EXIT_IO)
+			}
+		}()
+	}
+
+	// Switch over options
+	switch {
+	case gd.action == ACTION_HELP:
+		if cmd := findCommand(gd.command); cmd != nil && cmd.action != ACTION_HELP {
+			showCommandUsage(cmd)
+		} else {
+			show_usage()
+		}
+	case gd.action == ACTION_VERSION:
+		fmt.Println(APP + " (" + os.Args[0] + ") " + VERSION + ".")
+		fmt.Println("Copyright (C) 2012 Stéphane Bunel.")
+		fmt.Println("License: BSD style (included in source code).")
+	case gd.action == ACTION_INFO:
+		if err = wh.OpenWave(gd.wave_file, false); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		if gd.payload_file != "" {
+			if err = wh.OpenPayload(gd.payload_file); err != nil {
+				return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.payload_file, err), exitCode(err, EXIT_CAPACITY))
+				break
+			}
+		}
+
+		if gd.format == FORMAT_JSON {
+			info, err := wh.InfoReport(gd.scan)
+			if err == nil {
+				err = printJSON(os.Stdout, info)
+			}
+			if err != nil {
+				return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			}
+			break
+		}
+
+		if err = wh.PrintWAVInfo(os.Stdout); err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+
+		if gd.scan {
+			if err = wh.PrintHiddenRegions(os.Stdout); err != nil {
+				return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+				break
+			}
+		}
+	case gd.action == ACTION_EXTRACT:
+		// --restore writes a copy of the WAVE Audio file with original samples
+		if gd.restore_file != "" {
+			err = wh.OpenWaveOutput(gd.wave_file, gd.restore_file)
+		} else {
+			err = wh.OpenWave(gd.wave_file, false)
+		}
+		if err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		// Payload goes to stdout, to --output, or into the json report
+		var (
+			payload io.Writer = os.Stdout
+			data    bytes.Buffer
+			digest  = sha256.New()
+			counter write_counter
+		)
+		if gd.output != "" && gd.output != "-" {
+			f, err := os.Create(gd.output)
+			if err != nil {
+				return_code = reportError(report, fmt.Sprintf("Failed to create \"%s\": %s", gd.output, err), EXIT_IO)
+				break
+			}
+			defer f.Close()
+			payload = f
+		} else if gd.output == "" && gd.format == FORMAT_JSON {
+			payload = &data
+		}
+		output := io.MultiWriter(payload, digest, &counter)
+
+		t0 := time.Now()
+		bar.label = "Extracting"
+		if gd.restore_file != "" {
+			err = wh.ExtractPayloadReversible(output, true)
+			if err == nil {
+				err = wh.Sync()
+			}
+		} else {
+			err = wh.Extract(output)
+		}
+		bar.clear()
+		if err != nil {
+			if gd.output != "" && gd.output != "-" {
+				os.Remove(gd.output)
+			}
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_NOT_FOUND))
+			break
+		}
+
+		if gd.format == FORMAT_JSON {
+			duration := time.Now().Sub(t0)
+			result := action_report{Action: "extract", File: gd.wave_file, Output: gd.output, Hiding: wh.hidingReport(),
+				Duration: duration.Seconds(), Throughput: float64(counter.n) / duration.Seconds(), Restored: gd.restore_file}
+			result.Payload = payload_report{Size: int64(counter.n), SHA256: fmt.Sprintf("%x", digest.Sum(nil)), Data: data.Bytes()}
+			if wh.algorithm == ALGO_PHASE {
+				result.Payload.Start = wh.positionReport(wh.phase_start_frame * wh.wave_info.num_channels)
+			} else if (wh.algorithm == ALGO_LSB && wh.passphrase == "") || wh.algorithm == ALGO_REVERSIBLE {
+				result.Payload.Start = wh.positionReport(wh.wave_start_offset)
+			}
+			if err = printJSON(report, result); err != nil {
+				return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			}
+		} else if gd.restore_file != "" {
+			fmt.Fprintf(os.Stderr, "Ok. Original samples of \"%s\" restored to \"%s\".\n", gd.wave_file, gd.restore_file)
+		}
+	case gd.action == ACTION_HIDE:
+		if err = wh.OpenWaveOutput(gd.wave_file, gd.output); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		if wh.algorithm == ALGO_LSB && wh.density >= wh.wave_info.bits_per_sample/2 {
+			return_code = reportError(report, fmt.Sprintf("Density of %d is too high for sample size of %d bits.", wh.density,
+				wh.wave_info.bits_per_sample), EXIT_USAGE)
+			break
+		}
+
+		if err = wh.OpenPayload(gd.payload_file); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.payload_file, err), exitCode(err, EXIT_CAPACITY))
+			break
+		}
+
+		if !gd.force {
+			if err = wh.CheckOverwrite(); err != nil {
+				return_code = reportError(report, err.Error(), exitCode(err, EXIT_EXISTS))
+				break
+			}
+		}
+
+		t0 := time.Now()
+		if gd.format == FORMAT_TEXT {
+			fmt.Fprintf(report, "Hiding \"%s\" inside \"%s\" ...\n", wh.payload_file_name, wh.wave_file_name)
+		}
+
+		bar.label = "Hiding"
+		byte_writed, err := wh.Hide(gd.chunk_id, gd.keep)
+
+		// Extract back payload from written samples. A copy given by --output is not written if it fails
+		var verified *verify_report
+		var verify_time time.Duration
+		if err == nil && !gd.no_verify {
+			t1 := time.Now()
+			bar.label = "Verifying"
+			verified, err = wh.VerifyPayload()
+			verify_time = time.Now().Sub(t1)
+		}
+		bar.clear()
+		if err == nil && len(gd.bext) != 0 {
+			err = wh.UpdateBext(gd.bext)
+		}
+		if err == nil {
+			err = wh.Sync()
+		}
+		if err != nil {
+			msg := err.Error()
+			if exitCode(err, EXIT_FAILURE) == EXIT_CANCELED && gd.output != "" {
+				msg = fmt.Sprintf("Canceled: \"%s\" was not written.", gd.output)
+			}
+			return_code = reportError(report, msg, exitCode(err, EXIT_FAILURE))
+			break
+		}
+
+		duration := time.Now().Sub(t0) - verify_time
+		if gd.format == FORMAT_JSON {
+			result := action_report{Action: "hide", File: gd.wave_file, Output: gd.output, Hiding: wh.hidingReport(),
+				Payload: wh.payloadReport(), Written: byte_writed, Duration: duration.Seconds(),
+				Throughput: float64(byte_writed) / duration.Seconds(), Verify: verified}
+			if err = printJSON(report, result); err != nil {
+				return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			}
+			break
+		}
+		fmt.Fprintf(report, "Ok. Read %s from \"%s\" and write %s to \"%s\" in %v (%s/s).\n",
+			int64ToSuffixedStr(wh.payload_file_size), wh.payload_file_name,
+			int64ToSuffixedStr(byte_writed), wh.wave_file_name,
+			duration, int64ToSuffixedStr(int64(float64(byte_writed)/duration.Seconds())))
+		if verified != nil {
+			fmt.Fprintf(report, "Ok. Verified %s extracted back in %v (SHA-256 %s).\n", int64ToSuffixedStr(verified.Size),
+				verify_time, verified.SHA256)
+		}
+	case gd.action == ACTION_STRIP:
+		if err = wh.OpenWaveOutput(gd.wave_file, gd.output); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		count, err := wh.StripPayloadChunks()
+		if err == nil && len(gd.bext) != 0 {
+			err = wh.UpdateBext(gd.bext)
+		}
+		if err == nil {
+			err = wh.Sync()
+		}
+		if err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+		fmt.Fprintf(report, "Ok. Removed %d chunk(s) from \"%s\".\n", count, wh.wave_file_name)
+	case gd.action == ACTION_WIPE:
+		var cover *wave_handler_struct
+
+		if err = wh.OpenWaveOutput(gd.wave_file, gd.output); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+		if gd.cover_file != "" {
+			cover = &wave_handler_struct{bloc_size: 4096, algorithm: ALGO_LSB}
+			defer cover.Free()
+			if err = cover.OpenWave(gd.cover_file, false); err != nil {
+				return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.cover_file, err), exitCode(err, EXIT_FORMAT))
+				break
+			}
+		}
+
+		t0 := time.Now()
+		count, err := wh.Wipe(cover)
+		if err == nil && len(gd.bext) != 0 {
+			err = wh.UpdateBext(gd.bext)
+		}
+		if err == nil {
+			err = wh.Sync()
+		}
+		if err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+
+		what, how := "sample(s)", "randomized"
+		if wh.algorithm == ALGO_CHUNK {
+			what, how = "chunk(s)", "removed"
+		} else if wh.algorithm == ALGO_REVERSIBLE && cover == nil {
+			how = "restored"
+		} else if cover != nil {
+			how = "restored from \"" + cover.wave_file_name + "\""
+		}
+		fmt.Fprintf(report, "Ok. %d %s of \"%s\" %s in %v. Nothing can be extracted anymore.\n", count, what, wh.wave_file_name, how,
+			time.Now().Sub(t0))
+	case gd.action == ACTION_CHUNKS:
+		if err = wh.OpenWave(gd.wave_file, false); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		if err = wh.PrintChunks(os.Stdout, gd.format); err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+	case gd.action == ACTION_WATERMARK:
+		if err = wh.OpenWaveOutput(gd.wave_file, gd.output); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		t0 := time.Now()
+		err = wh.Watermark(gd.key, gd.recipient_id)
+		if err == nil && len(gd.bext) != 0 {
+			err = wh.UpdateBext(gd.bext)
+		}
+		if err == nil {
+			err = wh.Sync()
+		}
+		if err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+		fmt.Fprintf(report, "Ok. Watermark recipient ID %d into \"%s\" in %v.\n", gd.recipient_id, wh.wave_file_name, time.Now().Sub(t0))
+	case gd.action == ACTION_DETECT_WATERMARK:
+		if err = wh.OpenWave(gd.wave_file, false); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		id, confidence, found, err := wh.DetectWatermark(gd.key)
+		if err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+
+		if !found {
+			fmt.Printf("No watermark detected in \"%s\" (confidence %.2f%%).\n", wh.wave_file_name, 100*confidence)
+			return_code = EXIT_NOT_FOUND
+			break
+		}
+		fmt.Printf("Watermark detected in \"%s\": recipient ID %d (confidence %.2f%%).\n", wh.wave_file_name, id, 100*confidence)
+	case gd.action == ACTION_ANALYZE:
+		if err = wh.OpenWave(gd.wave_file, false); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		found, err := wh.Analyze(os.Stdout)
+		if err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+		if !found {
+			return_code = EXIT_NOT_FOUND
+		}
+	case gd.action == ACTION_COMPARE:
+		var other = &wave_handler_struct{bloc_size: 4096, algorithm: ALGO_LSB}
+
+		defer other.Free()
+		if err = wh.OpenWave(gd.wave_file, false); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+		if err = other.OpenWave(gd.compare_file, false); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.compare_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		differ, err := wh.Compare(other, os.Stdout)
+		if err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+		if differ {
+			return_code = EXIT_DIFFER
+		}
+	case gd.action == ACTION_VERIFY:
+		if err = wh.OpenWave(gd.wave_file, false); err != nil {
+			return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.wave_file, err), exitCode(err, EXIT_FORMAT))
+			break
+		}
+
+		// Payload is read once: stdin needs no copy
+		var expected io.Reader
+		if gd.payload_file == "-" {
+			expected = os.Stdin
+		} else if gd.payload_file != "" {
+			f, err := os.Open(gd.payload_file)
+			if err != nil {
+				return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.payload_file, err), EXIT_IO)
+				break
+			}
+			defer f.Close()
+			expected = f
+		}
+
+		bar.label = "Verifying"
+		result, err := wh.Verify(expected, gd.sha256)
+		bar.clear()
+		if err == nil {
+			err = printVerify(os.Stdout, result, gd.format)
+		}
+		if err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_NOT_FOUND))
+			break
+		}
+		if !result.Match {
+			return_code = EXIT_VERIFY
+		}
+	case gd.action == ACTION_PLAN:
+		size := gd.payload_size
+		if gd.payload_file != "" {
+			fi, err := os.Stat(gd.payload_file)
+			if err != nil {
+				return_code = reportError(report, fmt.Sprintf("Failed to open \"%s\": %s", gd.payload_file, err), EXIT_IO)
+				break
+			}
+			size = fi.Size()
+		}
+
+		plan := planCarriers(gd.carriers, size)
+		if err = printPlan(os.Stdout, plan, gd.format); err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+		if len(plan.Recommendation) == 0 {
+			return_code = EXIT_CAPACITY
+		}
+	case gd.action == ACTION_BATCH:
+		var items []batch_item
+
+		defaults := batch_item{action: gd.batch_action, payload_file: gd.payload_file, algorithm: gd.algorithm, chunk_id: gd.chunk_id,
+			density: gd.density, offset: gd.offset, offset_key: gd.offset_key, obfuscate: gd.obfuscate, passphrase: gd.passphrase,
+			force: gd.force, no_verify: gd.no_verify}
+		if gd.manifest != "" {
+			items, err = readManifest(gd.manifest, defaults)
+			if err != nil {
+				return_code = reportError(report, fmt.Sprintf("Failed to read \"%s\": %s", gd.manifest, err), exitCode(err, EXIT_IO))
+				break
+			}
+		} else {
+			items, err = globItems(gd.glob, defaults)
+			if err != nil {
+				return_code = reportError(report, fmt.Sprintf("Failed to list \"%s\": %s", gd.glob, err), exitCode(err, EXIT_IO))
+				break
+			}
+		}
+
+		batch := runBatch(ctx, items, gd.jobs)
+		if err = printBatch(os.Stdout, batch, gd.format); err != nil {
+			return_code = reportError(report, err.Error(), exitCode(err, EXIT_FAILURE))
+			break
+		}
+		if batch.Failed != 0 {
+			return_code = EXIT_FAILURE
+		}
+	}
+
+	return return_code, nil
+}
+
+// parseArgs parses command line arguments: a command followed by its options, or legacy
+// options where --<command> selects the action.
+func parseArgs() (err error) {
+	var (
+		print_usage = false
+		args        = os.Args[1:]
+		fs          = flag.NewFlagSet(APP, flag.ContinueOnError)
+		id_given    = false
+		actions     []string
+		arguments   []string
+	)
+
+	// Defaults of options not accepted by every command
+	gd.algorithm = ALGO_LSB
+	gd.chunk_id = CHUNK_DEFAULT
+	gd.format = FORMAT_TEXT
+
+	if len(args) != 0 && !strings.HasPrefix(args[0], "-") {
+		cmd := findCommand(args[0])
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "Unknown command \"%s\". See %s help\n", args[0], APP)
+			return &exit_error{EXIT_USAGE, errors.New("Error parsing arguments.")}
+		}
+		gd.action, gd.command, args = cmd.action, cmd.name, args[1:]
+		for _, name := range cmd.options {
+			defineOption(fs, name)
+		}
+		fs.Usage = func() { showCommandUsage(cmd) }
+	} else {
+		gd.action = ACTION_HELP
+		for _, cmd := range cli_commands {
+			if cmd.legacy {
+				fs.Bool(cmd.name, false, "")
+			}
+		}
+		for _, name := range []string{"wave", "payload", "algorithm", "chunk", "density", "offset", "offset-key", "obfuscate",
+			"key", "id", "passphrase", "keep", "force", "no-verify", "jobs", "no-progress", "scan", "format", "output", "bext"} {
+			defineOption(fs, name)
+		}
+		fs.Usage = show_usage
+	}
+	// Profiling options are accepted by every command
+	for _, name := range []string{"cpuprofile", "memprofile", "memprofilerate"} {
+		if fs.Lookup(name) == nil {
+			defineOption(fs, name)
+		}
+	}
+
+	// Options may follow arguments
+	err = fs.Parse(args)
+	for err == nil && fs.NArg() != 0 {
+		arguments = append(arguments, fs.Arg(0))
+		err = fs.Parse(fs.Args()[1:])
+	}
+	if err == flag.ErrHelp {
+		return &exit_error{EXIT_OK, err}
+	} else if err != nil {
+		return &exit_error{EXIT_USAGE, err}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		id_given = id_given || f.Name == "id"
+		if cmd := findCommand(f.Name); cmd != nil && cmd.legacy && gd.command == "" && f.Value.String() == "true" {
+			actions = append(actions, "--"+f.Name)
+			gd.action = cmd.action
+		}
+	})
+
+	// Last action option used to win silently
+	if len(actions) > 1 {
+		fmt.Fprintf(os.Stderr, "Only one action can be given (%s).\n", strings.Join(actions, ", "))
+		print_usage = true
+	}
+
+	// help takes the command whose options are shown, plan takes carriers
+	if gd.command == "help" && len(arguments) == 1 && findCommand(arguments[0]) != nil {
+		gd.command = arguments[0]
+	} else if gd.action == ACTION_PLAN {
+		if gd.wave_file != "" {
+			gd.carriers = append(gd.carriers, gd.wave_file)
+		}
+		gd.carriers = append(gd.carriers, arguments...)
+	} else if len(arguments) != 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected argument \"%s\".\n", arguments[0])
+		print_usage = true
+	}
+
+	switch gd.density {
 	case 0, 1, 2, 4, 8:
 	default:
-		fmt.Fprintf(os.Stderr, "Bad value (%v) for -density. See --help\n", gd.density)
-		print_usage = true
+		fmt.Fprintf(os.Stderr, "Bad value (%v) for -density. See --help\n", gd.density)
+		print_usage = true
+	}
+
+	switch gd.format {
+	case FORMAT_TEXT, FORMAT_JSON:
+	default:
+		fmt.Fprintf(os.Stderr, "Bad value (%v) for -format. See --help\n", gd.format)
+		print_usage = true
+	}
+
+	switch gd.algorithm {
+	case ALGO_LSB, ALGO_PHASE, ALGO_CHUNK, ALGO_REVERSIBLE:
+	default:
+		fmt.Fprintf(os.Stderr, "Bad value (%v) for -algorithm. See --help\n", gd.algorithm)
+		print_usage = true
+	}
+
+	if gd.action >= ACTION_INFO && gd.action != ACTION_PLAN && gd.action != ACTION_BATCH && gd.wave_file == "" {
+		fmt.Fprintln(os.Stderr, "Option --wave=<filename> is mandatory for this action.")
+		print_usage = true
+	}
+
+	if gd.action == ACTION_PLAN && len(gd.carriers) == 0 {
+		fmt.Fprintln(os.Stderr, "At least one WAVE Audio file is mandatory for this action.")
+		print_usage = true
+	}
+
+	if gd.action == ACTION_BATCH && (gd.manifest == "") == (gd.glob == "") {
+		fmt.Fprintln(os.Stderr, "One of options --manifest=<filename> or --glob=<pattern> is mandatory for this action.")
+		print_usage = true
+	}
+
+	if gd.action == ACTION_BATCH && gd.glob != "" && gd.batch_action == "" {
+		fmt.Fprintln(os.Stderr, "Option --action=<name> is mandatory with --glob.")
+		print_usage = true
+	}
+
+	switch gd.batch_action {
+	case "", "info", "hide", "extract":
+	default:
+		fmt.Fprintf(os.Stderr, "Bad value (%v) for -action. See --help\n", gd.batch_action)
+		print_usage = true
+	}
+
+	if gd.memprofilerate < 1 {
+		fmt.Fprintf(os.Stderr, "Bad value (%v) for -memprofilerate. See --help\n", gd.memprofilerate)
+		print_usage = true
+	}
+
+	if fs.Lookup("jobs") != nil && gd.jobs < 1 {
+		fmt.Fprintf(os.Stderr, "Bad value (%v) for -jobs. See --help\n", gd.jobs)
+		print_usage = true
+	}
+
+	if gd.action == ACTION_VERIFY && (gd.payload_file == "") == (gd.sha256 == "") {
+		fmt.Fprintln(os.Stderr, "One of options --payload=<filename> or --sha256=<digest> is mandatory for this action.")
+		print_usage = true
+	}
+
+	if gd.sha256 != "" {
+		if digest, err := hex.DecodeString(gd.sha256); err != nil || len(digest) != sha256.Size {
+			fmt.Fprintln(os.Stderr, "Option --sha256=<digest> needs 64 hexadecimal digits.")
+			print_usage = true
+		}
+	}
+
+	if gd.action == ACTION_PLAN && (gd.payload_file == "") == (gd.payload_size == 0) {
+		fmt.Fprintln(os.Stderr, "One of options --payload=<filename> or --size=<size> is mandatory for this action.")
+		print_usage = true
+	}
+
+	if reservedChunkID(gd.chunk_id) {
+		fmt.Fprintf(os.Stderr, "Chunk ID \"%s\" is reserved. See --help\n", gd.chunk_id)
+		print_usage = true
+	} else if !validChunkID(gd.chunk_id) {
+		fmt.Fprintln(os.Stderr, "Option --chunk=<ID> needs 4 printable ASCII characters.")
+		print_usage = true
+	}
+
+	if gd.passphrase != "" && gd.algorithm != ALGO_LSB && gd.algorithm != ALGO_CHUNK {
+		fmt.Fprintln(os.Stderr, "Option --passphrase is only supported by lsb and chunk algorithms.")
+		print_usage = true
+	}
+
+	if gd.passphrase == "" && (gd.algorithm == ALGO_CHUNK || gd.action == ACTION_STRIP) && gd.action != ACTION_BATCH {
+		fmt.Fprintln(os.Stderr, "Option --passphrase=<string> is mandatory with chunk algorithm: it encrypts the chunk.")
+		print_usage = true
+	}
+
+	if len(gd.keep) != 0 && gd.passphrase == "" {
+		fmt.Fprintln(os.Stderr, "Option --keep=<passphrase> needs --passphrase.")
+		print_usage = true
+	}
+
+	if gd.offset_key != "" && (gd.algorithm != ALGO_LSB || gd.passphrase != "" || gd.offset.text != "") {
+		fmt.Fprintln(os.Stderr, "Option --offset-key is only supported by lsb algorithm, without --passphrase or --offset.")
+		print_usage = true
+	}
+
+	if (gd.action == ACTION_HIDE || gd.action == ACTION_EXTRACT || gd.action == ACTION_VERIFY || gd.action == ACTION_WIPE) &&
+		gd.offset.text == "" && gd.algorithm != ALGO_CHUNK && gd.passphrase == "" && gd.offset_key == "" {
+		fmt.Fprintln(os.Stderr, "Option --offset=<position> or --offset-key=<string> is mandatory for this action.")
+		print_usage = true
+	}
+
+	if gd.action == ACTION_HIDE && gd.payload_file == "" {
+		fmt.Fprintln(os.Stderr, "Option --payload=<filename> is mandatory for this action.")
+		print_usage = true
+	}
+
+	if (gd.action == ACTION_WATERMARK || gd.action == ACTION_DETECT_WATERMARK) && gd.key == "" {
+		fmt.Fprintln(os.Stderr, "Option --key=<string> is mandatory for this action.")
+		print_usage = true
+	}
+
+	if gd.action == ACTION_WATERMARK && !id_given {
+		fmt.Fprintln(os.Stderr, "Option --id=<integer> (32 bits) is mandatory for this action.")
+		print_usage = true
+	}
+
+	if gd.restore_file != "" && gd.algorithm != ALGO_REVERSIBLE {
+		fmt.Fprintln(os.Stderr, "Option --restore needs reversible algorithm.")
+		print_usage = true
+	}
+
+	if gd.restore_file == "-" && (gd.output == "" || gd.output == "-") {
+		fmt.Fprintln(os.Stderr, "Option --restore=- needs --output=<filename> for payload.")
+		print_usage = true
+	}
+
+	if gd.action == ACTION_WIPE && gd.algorithm == ALGO_PHASE && gd.cover_file == "" {
+		fmt.Fprintln(os.Stderr, "Option --cover=<filename> is mandatory to wipe phase coded data.")
+		print_usage = true
+	}
+
+	writing := gd.action == ACTION_HIDE || gd.action == ACTION_STRIP || gd.action == ACTION_WATERMARK || gd.action == ACTION_WIPE
+	if len(gd.bext) != 0 && !writing {
+		fmt.Fprintln(os.Stderr, "Option --bext needs hide, strip, wipe or watermark.")
+		print_usage = true
+	}
+
+	if gd.output != "" && !writing && gd.action != ACTION_EXTRACT {
+		fmt.Fprintln(os.Stderr, "Option --output needs hide, extract, strip, wipe or watermark.")
+		print_usage = true
+	}
+
+	if gd.format == FORMAT_JSON && gd.action != ACTION_INFO && gd.action != ACTION_HIDE && gd.action != ACTION_EXTRACT &&
+		gd.action != ACTION_CHUNKS && gd.action != ACTION_PLAN && gd.action != ACTION_VERIFY && gd.action != ACTION_BATCH {
+		fmt.Fprintln(os.Stderr, "Option --format=json needs info, hide, extract, verify, chunks, plan or batch.")
+		print_usage = true
+	}
+
+	if gd.action == ACTION_COMPARE && gd.compare_file == "" {
+		fmt.Fprintln(os.Stderr, "Option --with=<filename> is mandatory for this action.")
+		print_usage = true
+	}
+
+	if gd.wave_file == "-" && gd.payload_file == "-" {
+		fmt.Fprintln(os.Stderr, "Options --wave and --payload can't both read stdin.")
+		print_usage = true
+	}
+
+	if gd.wave_file == "-" && writing && gd.output == "" {
+		fmt.Fprintln(os.Stderr, "Option --output=<filename> is mandatory when --wave reads stdin.")
+		print_usage = true
+	}
+
+	for _, update := range gd.bext {
+		name, value, _ := strings.Cut(update, "=")
+		field, known := bext_fields[name]
+		switch {
+		case name == "coding_history" || name == "time_reference":
+		case !known:
+			fmt.Fprintf(os.Stderr, "Bad field (%s) for -bext. See --help\n", name)
+			print_usage = true
+		case len(value) > field.end-field.start:
+			fmt.Fprintf(os.Stderr, "Value of bext field %s is longer than %d bytes.\n", name, field.end-field.start)
+			print_usage = true
+		case field.layout != "":
+			if _, err := time.Parse(field.layout, value); err != nil {
+				fmt.Fprintf(os.Stderr, "Value of bext field %s must look like %s.\n", name, field.layout)
+				print_usage = true
+			}
+		}
+	}
+
+	if print_usage {
+		fs.Usage()
+		return &exit_error{EXIT_USAGE, errors.New("Error parsing arguments.")}
+	}
+
+	return nil
+}
+
+// defineOption defines option name in fs. Values are stored in gd.
+func defineOption(fs *flag.FlagSet, name string) {
+	switch name {
+	case "wave":
+		fs.StringVar(&gd.wave_file, name, "", "")
+	case "payload":
+		fs.StringVar(&gd.payload_file, name, "", "")
+		fs.StringVar(&gd.payload_file, "data", "", "")
+	case "algorithm":
+		fs.StringVar(&gd.algorithm, name, gd.algorithm, "")
+	case "chunk":
+		fs.StringVar(&gd.chunk_id, name, gd.chunk_id, "")
+	case "density":
+		fs.Func(name, "", func(value string) error {
+			n, err := strconv.ParseUint(value, 10, 32)
+			gd.density = uint32(n)
+			return err
+		})
+	case "offset":
+		fs.Var(&gd.offset, name, "")
+	case "offset-key":
+		fs.StringVar(&gd.offset_key, name, "", "")
+	case "obfuscate":
+		fs.Func(name, "", func(value string) error {
+			n, err := strconv.ParseUint(value, 10, 64)
+			gd.obfuscate = uint8(n)
+			return err
+		})
+	case "key":
+		fs.StringVar(&gd.key, name, "", "")
+	case "id":
+		fs.Func(name, "", func(value string) error {
+			n, err := strconv.ParseUint(value, 10, 32)
+			gd.recipient_id = uint32(n)
+			return err
+		})
+	case "passphrase":
+		fs.StringVar(&gd.passphrase, name, "", "")
+	case "keep":
+		fs.Var(&gd.keep, name, "")
+	case "force":
+		fs.BoolVar(&gd.force, name, false, "")
+	case "scan":
+		fs.BoolVar(&gd.scan, name, false, "")
+	case "format":
+		fs.StringVar(&gd.format, name, gd.format, "")
+	case "output":
+		fs.StringVar(&gd.output, name, "", "")
+	case "bext":
+		fs.Var(&gd.bext, name, "")
+	case "with":
+		fs.StringVar(&gd.compare_file, name, "", "")
+	case "sha256":
+		fs.StringVar(&gd.sha256, name, "", "")
+	case "no-verify":
+		fs.BoolVar(&gd.no_verify, name, false, "")
+	case "cover":
+		fs.StringVar(&gd.cover_file, name, "", "")
+	case "restore":
+		fs.StringVar(&gd.restore_file, name, "", "")
+	case "manifest":
+		fs.StringVar(&gd.manifest, name, "", "")
+	case "glob":
+		fs.StringVar(&gd.glob, name, "", "")
+	case "action":
+		fs.StringVar(&gd.batch_action, name, "", "")
+	case "jobs":
+		fs.IntVar(&gd.jobs, name, runtime.NumCPU(), "")
+	case "no-progress":
+		fs.BoolVar(&gd.no_progress, name, false, "")
+	case "cpuprofile":
+		fs.StringVar(&gd.cpuprofile, name, "", "")
+	case "memprofile":
+		fs.StringVar(&gd.memprofile, name, "", "")
+	case "memprofilerate":
+		fs.IntVar(&gd.memprofilerate, name, MEMPROFILE_RATE, "")
+	case "size":
+		fs.Func(name, "", func(value string) (err error) {
+			gd.payload_size, err = parseSize(value)
+			return err
+		})
+	}
+}
+
+// findCommand returns the command called name, or nil.
+func findCommand(name string) *cli_command {
+	for i := range cli_commands {
+		if cli_commands[i].name == name {
+			return &cli_commands[i]
+		}
+	}
+
+	return nil
+}
+
+// Show usage of steganoWAV
+func show_usage() {
+	fmt.Fprintf(os.Stderr, "\n%s %s\n", APP, VERSION)
+	fmt.Fprintf(os.Stderr,
+		"Usage                   : %s <COMMAND> [<OPTIONS>]\n"+
+			"                          %s <ACTION> [<OPTIONS>] (legacy)\n\n", os.Args[0], os.Args[0])
+	fmt.Fprintln(os.Stderr, "COMMANDS:")
+	for _, cmd := range cli_commands {
+		fmt.Fprintf(os.Stderr, "  %-22s: %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprint(os.Stderr, "\n")
+
+	fmt.Fprintln(os.Stderr, "ACTIONS (legacy):")
+	fmt.Fprint(os.Stderr,
+		"  --<command>           : Same as command, for commands but help, analyze and compare. One at most.\n\n")
+
+	fmt.Fprintln(os.Stderr, "OPTIONS:")
+	for _, name := range []string{"wave", "payload", "algorithm", "chunk", "density", "offset", "offset-key", "obfuscate",
+		"key", "id", "passphrase", "keep", "force", "no-verify", "no-progress", "scan", "format", "output", "bext", "with", "sha256",
+		"size", "cover", "restore", "manifest", "glob", "action", "jobs"} {
+		fmt.Fprint(os.Stderr, optionUsage(name))
+	}
+	fmt.Fprint(os.Stderr, "\n")
+
+	fmt.Fprintln(os.Stderr, "PROFILING (any command):")
+	for _, name := range []string{"cpuprofile", "memprofile", "memprofilerate"} {
+		fmt.Fprint(os.Stderr, optionUsage(name))
+	}
+	fmt.Fprint(os.Stderr, "\n")
+
+	fmt.Fprintln(os.Stderr, "EXIT CODES:")
+	fmt.Fprint(os.Stderr,
+		"  0: success, 1: failure, 2: bad command line, 3: file can't be read or written,\n"+
+			"  4: unsupported or damaged WAVE Audio file, 5: payload doesn't fit, 6: no hidden data found,\n"+
+			"  7: hidden data would be overwritten, 8: extracted data differ from payload, 9: interrupted,\n"+
+			"  10: compared files differ.\n\n")
+
+	fmt.Fprintln(os.Stderr, "Examples:")
+	fmt.Fprintln(os.Stderr, "  Get informations about capsule:")
+	fmt.Fprint(os.Stderr, "  $ steganoWAV info --wave=boris24.2.wav --offset=5432\n\n")
+	fmt.Fprintln(os.Stderr, "  Hide source code of steganoWAV:")
+	fmt.Fprint(os.Stderr, "  $ steganoWAV hide --wave=boris24.2.wav --payload=steganoWAV.go --offset=5432 --obfuscate=10\n\n")
+	fmt.Fprintln(os.Stderr, "  Extract source code to stdout:")
+	fmt.Fprint(os.Stderr, "  $ steganoWAV extract --wave=boris24.2.wav --offset=5432 --obfuscate=10\n\n")
+	fmt.Fprintln(os.Stderr, "  Choose carrier and density for a 5 MiB payload:")
+	fmt.Fprint(os.Stderr, "  $ steganoWAV plan --size=5M boris24.2.wav 07Narayan.wav\n\n")
+	fmt.Fprintln(os.Stderr, "  Hide an archive read from stdin, writing the new WAVE Audio file to stdout:")
+	fmt.Fprint(os.Stderr, "  $ tar cz docs | steganoWAV hide --wave=boris24.2.wav --payload=- --offset=5432 --output=- >capsule.wav\n\n")
+	fmt.Fprintln(os.Stderr, "  Profile hiding of a large payload, then read the profile:")
+	fmt.Fprint(os.Stderr, "  $ steganoWAV hide --wave=boris24.2.wav --payload=big.tgz --offset=5432 --cpuprofile=cpu.out && go tool pprof cpu.out\n\n")
+}
+
+// showCommandUsage prints the summary and the options of cmd.
+func showCommandUsage(cmd *cli_command) {
+	fmt.Fprintf(os.Stderr, "\n%s %s\n", APP, VERSION)
+	fmt.Fprintf(os.Stderr, "Usage                   : %s %s [<OPTIONS>]\n\n", os.Args[0], cmd.name)
+	fmt.Fprintf(os.Stderr, "%s\n\n", cmd.usage)
+
+	if len(cmd.options) != 0 {
+		fmt.Fprintln(os.Stderr, "OPTIONS:")
+		for _, name := range cmd.options {
+			fmt.Fprint(os.Stderr, optionUsage(name))
+		}
+		fmt.Fprint(os.Stderr, "\n")
+	}
+}
+
+// optionUsage returns the usage lines of option name.
+func optionUsage(name string) string {
+	switch name {
+	case "wave":
+		return "  --wave=<filename>     : Path to WAVE, AIFF/AIFF-C, Wave64, AU or FLAC Audio file, or - for stdin.\n"
+	case "payload":
+		return "  --payload=<filename>  : Path to file containing data to hide, or - for stdin.\n"
+	case "algorithm":
+		return "  --algorithm=<name>    : Must be lsb, phase, chunk or reversible (default to lsb). phase hides a few hundred bytes.\n" +
+			"                          chunk stores payload in a RIFF chunk and ignores --offset. reversible expands prediction\n" +
+			"                          errors of samples after --offset: extract --restore gives back the original samples.\n"
+	case "chunk":
+		return "  --chunk=<ID>          : ID of chunk holding payload with chunk algorithm (default to JUNK).\n"
+	case "density":
+		return "  --density=<integer>   : Must be 1, 2, 4 or 8 (default to AUTO).\n"
+	case "offset":
+		return "  --offset=<position>   : Start of hidden data. This is one of your SECRETS. Samples count, frames count followed\n" +
+			"                          by f (44100f), timestamp ([hh:]mm:ss.fff), seconds followed by s (83.456s)\n" +
+			"                          or percentage of sound duration (12.5%).\n"
+	case "offset-key":
+		return "  --offset-key=<string> : Derive the offset from this secret instead of --offset (lsb only).\n"
+	case "obfuscate":
+		return "  --obfuscate=<integer> : Use a Fibonacci generator to obfuscate payload. This is one of your SECRETS.\n"
+	case "key":
+		return "  --key=<string>        : Secret key of the watermark pseudo noise sequence.\n"
+	case "id":
+		return "  --id=<integer>        : Recipient ID (32 bits) carried by the watermark.\n"
+	case "passphrase":
+		return "  --passphrase=<string> : Hide/extract in the slot selected by passphrase instead of --offset (lsb).\n" +
+			"                          With chunk algorithm (mandatory), encrypt the chunk with a key derived from it.\n"
+	case "keep":
+		return "  --keep=<string>       : With hide, passphrase of another slot to keep intact. May be repeated.\n"
+	case "force":
+		return "  --force               : With hide, overwrite hidden data found for the same key.\n"
+	case "scan":
+		return "  --scan                : With info, list regions holding hidden data for given key.\n"
+	case "format":
+		return "  --format=<name>       : With info, hide, extract, verify, chunks, plan or batch, output format: text or json\n" +
+			"                          (default to text). With json, errors are printed as json objects too.\n"
+	case "output":
+		return "  --output=<filename>   : With hide, strip, wipe or watermark, write a modified copy of WAVE Audio file,\n" +
+			"                          or - for stdout. Every chunk but audio data is copied byte for byte.\n" +
+			"                          With extract, write payload to this file.\n"
+	case "bext":
+		return "  --bext=<field>=<value>: With hide, strip, wipe or watermark, update a field of bext chunk: description,\n" +
+			"                          originator, originator_reference, origination_date, origination_time,\n" +
+			"                          time_reference or coding_history (appends a line). May be repeated.\n"
+	case "with":
+		return "  --with=<filename>     : With compare, path to the other WAVE Audio file.\n"
+	case "sha256":
+		return "  --sha256=<digest>     : With verify, SHA-256 (hexadecimal) of payload instead of --payload.\n"
+	case "no-verify":
+		return "  --no-verify           : With hide, don't extract back payload to check it.\n"
+	case "cover":
+		return "  --cover=<filename>    : With wipe, original WAVE Audio file: samples holding hidden data are restored\n" +
+			"                          instead of randomized. Needed by phase algorithm.\n"
+	case "restore":
+		return "  --restore=<filename>  : With extract and reversible algorithm, also write a copy of WAVE Audio file\n" +
+			"                          with original samples, or - for stdout.\n"
+	case "manifest":
+		return "  --manifest=<filename> : With batch, CSV file whose first row names columns, or JSON array of objects. Columns:\n" +
+			"                          action, wave, payload, algorithm, chunk, density, offset, offset-key, obfuscate,\n" +
+			"                          passphrase, output, force and no-verify. Missing values are taken from options.\n" +
+			"                          extract writes payload to output, default to the WAVE Audio file name + .payload.\n"
+	case "glob":
+		return "  --glob=<pattern>      : With batch, run --action on every file matching pattern instead of --manifest.\n"
+	case "action":
+		return "  --action=<name>       : With batch, action of items not giving one: info, hide or extract.\n"
+	case "jobs":
+		return "  --jobs=<integer>      : With batch, number of items run at once. With hide, extract or verify, number of\n" +
+			"                          goroutines processing lsb payload segments at once, 1 processing it bloc by bloc.\n" +
+			"                          Default to the number of CPUs.\n"
+	case "no-progress":
+		return "  --no-progress         : With hide, extract or verify, don't draw a progress bar. It is drawn only if stderr\n" +
+			"                          is a terminal. Ctrl-C stops cleanly: a copy given by --output is not written.\n"
+	case "size":
+		return "  --size=<size>         : With plan, size of payload instead of --payload. Bytes, or KiB, MiB, GiB\n" +
+			"                          followed by K, M or G (1.5M).\n"
+	case "cpuprofile":
+		return "  --cpuprofile=<file>   : Write a CPU profile of the command to file, read by go tool pprof.\n"
+	case "memprofile":
+		return "  --memprofile=<file>   : Write a heap profile to file once the command is done, read by go tool pprof.\n"
+	case "memprofilerate":
+		return "  --memprofilerate=<n>  : Bytes allocated between two samples of the heap profile (default to 524288).\n" +
+			"                          1 records every allocation.\n"
+	}
+
+	return ""
+}
+
+// printJSON prints v to output as indented JSON.
+func printJSON(output io.Writer, v interface{}) (err error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(output, string(b))
+
+	return err
+}
+
+// reportError prints message to stderr, or a json error object to output with --format=json.
+// Returns code.
+func reportError(output io.Writer, message string, code int) int {
+	if gd.format != FORMAT_JSON {
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+
+	var report error_report
+	report.Error.Code = code
+	report.Error.Class = exit_classes[code]
+	report.Error.Message = message
+	if err := printJSON(output, report); err != nil {
+		fmt.Fprintln(os.Stderr, message)
+	}
+
+	return code
+}
+
+// Error returns the message of the wrapped error.
+func (self *exit_error) Error() string {
+	return self.err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (self *exit_error) Unwrap() error {
+	return self.err
+}
+
+// exitCode returns the exit code of err class. Errors of file operations are EXIT_IO,
+// errors without class are code.
+func exitCode(err error, code int) int {
+	var (
+		exit_err *exit_error
+		path_err *os.PathError
+	)
+
+	switch {
+	case errors.As(err, &exit_err):
+		return exit_err.code
+	case errors.As(err, &path_err):
+		return EXIT_IO
+	case errors.Is(err, context.Canceled):
+		return EXIT_CANCELED
+	}
+
+	return code
+}
+
+// update draws the bar for done bytes out of total, at most every PROGRESS_PERIOD but the last time.
+// It is a progress_func.
+func (self *progress_bar) update(done, total int64, eta time.Duration) {
+	now := time.Now()
+	if done != 0 && done < total && now.Sub(self.last) < PROGRESS_PERIOD {
+		return
+	}
+	self.last = now
+
+	ratio := 1.0
+	if total > 0 {
+		ratio = float64(done) / float64(total)
+	}
+	filled := int(ratio * PROGRESS_WIDTH)
+	line := fmt.Sprintf("\r%-10s [%s%s] %5.1f%% %s of %s", self.label, strings.Repeat("#", filled), strings.Repeat(".", PROGRESS_WIDTH-filled),
+		100*ratio, int64ToSuffixedStr(done), int64ToSuffixedStr(total))
+	if eta != 0 {
+		line += fmt.Sprintf(", %v left", eta.Round(time.Second))
+	}
+	fmt.Fprint(self.output, line+"\x1b[K")
+	self.drawn = true
+}
+
+// clear erases the bar, so following messages start on an empty line.
+func (self *progress_bar) clear() {
+	if self.drawn {
+		fmt.Fprint(self.output, "\r\x1b[K")
+		self.drawn = false
+	}
+}
+
+// isTerminal returns true if f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// writeHeapProfile writes a heap profile to filename: memory allocated since start, sampled every
+// runtime.MemProfileRate bytes, and memory still in use.
+func writeHeapProfile(filename string) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Memory in use is only known once collected
+	runtime.GC()
+	if err = pprof.WriteHeapProfile(f); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// parseSize parses a size in bytes, or in KiB, MiB or GiB if followed by K, M or G.
+func parseSize(value string) (size int64, err error) {
+	var (
+		unit   = 1.0
+		number = value
+	)
+
+	switch {
+	case strings.HasSuffix(value, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		number = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n <= 0 || n*unit >= math.MaxUint32 {
+		return 0, errors.New(fmt.Sprintf("Bad size (%s).", value))
+	}
+
+	return int64(math.Ceil(n * unit)), nil
+}
+
+// String returns the option as given.
+func (self *offset_spec) String() string {
+	return self.text
+}
+
+// Set parses an offset: samples count, frames count followed by f, [hh:]mm:ss[.fff] timestamp,
+// seconds followed by s, or percentage of sound duration followed by %.
+func (self *offset_spec) Set(value string) (err error) {
+	var n uint64
+
+	*self = offset_spec{text: value}
+
+	switch {
+	case strings.HasSuffix(value, "%"):
+		self.unit = OFFSET_PERCENT
+		self.value, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err == nil && (self.value < 0 || self.value >= 100) {
+			err = errors.New("percentage must be in [0, 100)")
+		}
+	case strings.HasSuffix(value, "f"):
+		self.unit = OFFSET_FRAMES
+		n, err = strconv.ParseUint(strings.TrimSuffix(value, "f"), 10, 32)
+		self.value = float64(n)
+	case strings.HasSuffix(value, "s"):
+		self.unit = OFFSET_TIME
+		self.value, err = strconv.ParseFloat(strings.TrimSuffix(value, "s"), 64)
+		if err == nil && self.value < 0 {
+			err = errors.New("time must be >= 0")
+		}
+	case strings.Contains(value, ":"):
+		self.unit = OFFSET_TIME
+		self.value, err = parseTimestamp(value)
+	default:
+		self.unit = OFFSET_SAMPLES
+		n, err = strconv.ParseUint(value, 10, 32)
+		self.value = float64(n)
 	}
 
-	if (gd.action == ACTION_INFO || gd.action == ACTION_EXTRACT || gd.action == ACTION_HIDE) && gd.wave_file == "" {
-		fmt.Fprintln(os.Stderr, "Option --wave=<filename> is mandatory for this action.")
-		print_usage = true
+	return err
+}
+
+// String returns the values of the option separated by commas.
+func (self *string_list) String() string {
+	return strings.Join(*self, ",")
+}
+
+// Set adds one more value to the option.
+func (self *string_list) Set(value string) error {
+	*self = append(*self, value)
+	return nil
+}
+
+// newKeyedPermutation returns a permutation of [0, n) keyed by key (at least 32 bytes).
+func newKeyedPermutation(key []byte, n uint64) *keyed_permutation {
+	var perm = &keyed_permutation{n: n}
+
+	// Feistel halves cover at least [0, n)
+	for uint64(1)<<(2*perm.half_bits) < n {
+		perm.half_bits++
+	}
+	for i := range perm.keys {
+		perm.keys[i] = binary.LittleEndian.Uint64(key[8*i:])
 	}
 
-	if (gd.action == ACTION_HIDE || gd.action == ACTION_EXTRACT) && gd.offset == 0 {
-		fmt.Fprintln(os.Stderr, "Option --offset=<integer> is mandatory for this action.")
-		print_usage = true
+	return perm
+}
+
+// At returns the image of i. Images out of [0, n) are permuted again (cycle walking).
+func (self *keyed_permutation) At(i uint64) uint64 {
+	var mask = uint64(1)<<self.half_bits - 1
+
+	for {
+		left, right := i>>self.half_bits, i&mask
+		for _, key := range self.keys {
+			left, right = right, left^(mix64(right^key)&mask)
+		}
+		i = left<<self.half_bits | right
+
+		if i < self.n {
+			return i
+		}
 	}
+}
 
-	if gd.action == ACTION_HIDE && gd.payload_file == "" {
-		fmt.Fprintln(os.Stderr, "Option --payload=<filename> is mandatory for this action.")
-		print_usage = true
+// mix64 is the finalizer of SplitMix64.
+func mix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// newFrameHeader returns the header framing hidden data: magic, payload size and payload CRC-32.
+func newFrameHeader(size uint32, crc uint32) (header PayloadBloc) {
+	header = make(PayloadBloc, FRAME_HEADER_SIZE)
+	copy(header, FRAME_MAGIC)
+	binary.LittleEndian.PutUint32(header[4:], size)
+	binary.LittleEndian.PutUint32(header[8:], crc)
+
+	return header
+}
+
+// parseFrameHeader returns payload size and CRC-32 stored in a frame header. ok is false without magic.
+func parseFrameHeader(header PayloadBloc) (size uint32, crc uint32, ok bool) {
+	if len(header) < FRAME_HEADER_SIZE || string(header[:len(FRAME_MAGIC)]) != FRAME_MAGIC {
+		return 0, 0, false
 	}
 
-	if print_usage {
-		show_usage()
-		return errors.New("Error parsing arguments.")
+	return binary.LittleEndian.Uint32(header[4:]), binary.LittleEndian.Uint32(header[8:]), true
+}
+
+// Write compares p with the next bytes of expected payload.
+func (self *verify_writer) Write(p []byte) (n int, err error) {
+	self.digest.Write(p)
+
+	if self.expected != nil {
+		if len(self.buf) < len(p) {
+			self.buf = make([]byte, len(p))
+		}
+		m, err := io.ReadFull(self.expected, self.buf[:len(p)])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		self.read += int64(m)
+		for i := range p {
+			if i >= m || p[i] != self.buf[i] {
+				self.differ(self.size+int64(i), 1)
+			}
+		}
+	}
+	self.size += int64(len(p))
+
+	return len(p), nil
+}
+
+// differ counts count differing bytes starting at offset.
+func (self *verify_writer) differ(offset int64, count int64) {
+	if len(self.offsets) < VERIFY_MAX_OFFSETS {
+		self.offsets = append(self.offsets, offset)
+	}
+	self.count += count
+}
+
+// Write counts bytes of p.
+func (self *write_counter) Write(p []byte) (n int, err error) {
+	self.n += uint32(len(p))
+	return len(p), nil
+}
+
+// newPNGenerator returns a pseudo noise generator seeded by key.
+func newPNGenerator(key string) *pn_generator {
+	return &pn_generator{key: []byte("watermark:" + key), bit: sha256.Size * 8}
+}
+
+// Next returns the next chip of the sequence: +1 or -1.
+func (self *pn_generator) Next() float64 {
+	if self.bit == sha256.Size*8 {
+		var counter [8]byte
+		binary.LittleEndian.PutUint64(counter[:], self.counter)
+		self.block = sha256.Sum256(append(append([]byte{}, self.key...), counter[:]...))
+		self.counter++
+		self.bit = 0
+	}
+
+	chip := self.block[self.bit/8] >> (self.bit % 8) & 1
+	self.bit++
+	if chip == 0 {
+		return -1
+	}
+
+	return 1
+}
+
+// watermarkCodeword returns the +1/-1 symbols of the recipient ID followed by its keyed check.
+func watermarkCodeword(key string, id uint32) (code [WATERMARK_BITS]float64) {
+	var id_bytes [4]byte
+
+	binary.BigEndian.PutUint32(id_bytes[:], id)
+	check := sha256.Sum256(append([]byte("check:"+key), id_bytes[:]...))
+	word := uint64(id)<<16 | uint64(check[0])<<8 | uint64(check[1])
+
+	for i := range code {
+		code[i] = -1
+		if word>>uint(WATERMARK_BITS-1-i)&1 == 1 {
+			code[i] = 1
+		}
+	}
+
+	return code
+}
+
+// phaseDecode returns bits coded in the phase of spectrum bins: bit 0 for +Pi/2, bit 1 for -Pi/2.
+func phaseDecode(spectrum []complex128) (payload PayloadBloc) {
+	payload = make(PayloadBloc, (len(spectrum)/2-1)/8)
+
+	for bit := 0; bit < len(payload)*8; bit++ {
+		if cmplx.Phase(spectrum[bit+1]) < 0 {
+			payload[bit/8] |= 0x80 >> uint(bit%8)
+		}
+	}
+
+	return payload
+}
+
+// shiftPhases adds delta to the phase of every positive frequency bin and keeps spectrum hermitian.
+func shiftPhases(spectrum []complex128, delta []float64) {
+	n := len(spectrum)
+
+	for k := 1; k < n/2; k++ {
+		spectrum[k] *= cmplx.Rect(1, delta[k])
+		spectrum[n-k] = cmplx.Conj(spectrum[k])
+	}
+}
+
+// fft computes in place the discrete Fourier transform of x. len(x) must be a power of 2.
+// If inverse is true, it computes the normalized inverse transform.
+func fft(x []complex128, inverse bool) {
+	n := len(x)
+
+	// Bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	// Butterflies
+	for size := 2; size <= n; size <<= 1 {
+		angle := -2 * math.Pi / float64(size)
+		if inverse {
+			angle = -angle
+		}
+		w_step := cmplx.Rect(1, angle)
+		for i := 0; i < n; i += size {
+			w := complex(1, 0)
+			for j := i; j < i+size/2; j++ {
+				u, v := x[j], x[j+size/2]*w
+				x[j], x[j+size/2] = u+v, u-v
+				w *= w_step
+			}
+		}
+	}
+
+	if inverse {
+		for i := range x {
+			x[i] /= complex(float64(n), 0)
+		}
+	}
+}
+
+// chunkNodesText returns nodes as text, sub chunks indented.
+func chunkNodesText(nodes []chunk_node, indent string) (msg string) {
+	for _, node := range nodes {
+		msg += fmt.Sprintf("%-35s: %s (%d bytes)", fmt.Sprintf("%s\"%s\" at %d", indent, node.ID, node.Offset), intToSuffixedStr(node.Size), node.Size)
+		if node.Padding != 0 {
+			msg += fmt.Sprintf(", %d padding byte(s)", node.Padding)
+		}
+		if node.ListType != "" {
+			msg += fmt.Sprintf(", list of \"%s\"", node.ListType)
+		}
+		msg += "\n"
+		for _, field := range node.Fields {
+			// Align following lines of multi lines values, like coding history
+			value := strings.ReplaceAll(fmt.Sprint(field.Value), "\r\n", "\n")
+			value = strings.ReplaceAll(value, "\n", "\n"+strings.Repeat(" ", 37))
+			msg += fmt.Sprintf("%-35s: %s\n", indent+"    "+field.Name, value)
+		}
+		msg += chunkNodesText(node.Children, indent+"  ")
+	}
+
+	return msg
+}
+
+// chunkDecoder returns the function decoding data of chunks of ID id, or nil if they are not decoded.
+// Decoders add fields and sub chunks to node. pos is the position of data in file.
+func chunkDecoder(id string) func(node *chunk_node, data []byte, pos int64) {
+	switch id {
+	case "LIST":
+		return decodeListChunk
+	case "bext":
+		return decodeBextChunk
+	case "iXML":
+		return decodeIXMLChunk
+	case "cue ":
+		return decodeCueChunk
+	case "smpl":
+		return decodeSmplChunk
+	case "labl", "note":
+		return decodeLabelChunk
+	case "id3 ", "ID3 ":
+		return decodeID3Chunk
+	case "NAME", "AUTH", "ANNO", "(c) ":
+		return decodeTextChunk
 	}
 
 	return nil
 }
 
-// Show usage of steganoWAV
-func show_usage() {
-	fmt.Fprintf(os.Stderr, "\n%s %s\n", APP, VERSION)
-	fmt.Fprintf(os.Stderr,
-		"Usage                   : %s <ACTION> [<OPTIONS>]\n\n", os.Args[0])
-	fmt.Fprintln(os.Stderr, "ACTIONS:")
-	fmt.Fprintln(os.Stderr,
-		"  --help                : Show this command summary.\n"+
-			"  --version             : Show version informations.\n"+
-			"  --info                : Print informations about given WAVE Audio file (need --wave option).\n"+
-			"  --extract             : Extract data from given WAVE Audio file to stdout (need --wave, --offset options).\n"+
-			"  --hide                : Hide data into given WAVE Audio file (need --payload, --wave, --offset options).\n")
+// addField appends a decoded value to node.
+func (self *chunk_node) addField(name string, value interface{}) {
+	self.Fields = append(self.Fields, chunk_field{name, value})
+}
 
-	fmt.Fprintln(os.Stderr, "OPTIONS:")
-	fmt.Fprintln(os.Stderr,
-		"  --wave=<filename>     : Path to WAVE/PCM Audio file.\n"+
-			"  --payload=<filename>  : Path to file containing data to hide.\n"+
-			"  --density=<integer>   : Must be 1, 2, 4 or 8 (default to AUTO).\n"+
-			"  --offset=<integer>    : Must be > 0. This is one of your SECRETS.\n"+
-			"  --obfuscate=<integer> : Use a Fibonacci generator to obfuscate payload. This is one of your SECRETS.\n")
+// decodeListChunk decodes the list type and the sub chunks of a LIST chunk.
+func decodeListChunk(node *chunk_node, data []byte, pos int64) {
+	if len(data) < 4 {
+		return
+	}
+	node.ListType = string(data[0:4])
 
-	fmt.Fprintln(os.Stderr, "Examples:")
-	fmt.Fprintln(os.Stderr, "  Get informations about capsule:")
-	fmt.Fprintln(os.Stderr, "  $ steganoWAV --wave=boris24.2.wav --offset=5432 --info\n")
-	fmt.Fprintln(os.Stderr, "  Hide source code of steganoWAV:")
-	fmt.Fprintln(os.Stderr, "  $ steganoWAV --wave=boris24.2.wav --payload=steganoWAV.go --offset=5432 --obfuscate=10 --hide\n")
-	fmt.Fprintln(os.Stderr, "  Extract source code to stdout:")
-	fmt.Fprintln(os.Stderr, "  $ steganoWAV --wave=boris24.2.wav --offset=5432 --obfuscate=10 --extract\n")
+	for p := 4; p+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[p+4:]))
+		if size > len(data)-p-8 {
+			size = len(data) - p - 8
+		}
+		length := 8 + size + size%2
+		if length > len(data)-p {
+			length = len(data) - p
+		}
+
+		child := chunk_node{ID: string(data[p : p+4]), Offset: pos + int64(p), Size: uint32(size), Padding: int64(length - 8 - size)}
+		body := data[p+8 : p+8+size]
+		if node.ListType == "INFO" {
+			decodeInfoChunk(&child, body, child.Offset+8)
+		} else if decoder := chunkDecoder(child.ID); decoder != nil {
+			decoder(&child, body, child.Offset+8)
+		}
+		node.Children = append(node.Children, child)
+		p += length
+	}
+}
+
+// decodeInfoChunk decodes a sub chunk of a LIST/INFO chunk: a zero terminated text.
+func decodeInfoChunk(node *chunk_node, data []byte, pos int64) {
+	var names = map[string]string{
+		"IART": "artist", "ICMT": "comments", "ICOP": "copyright", "ICRD": "creation_date",
+		"IENG": "engineer", "IGNR": "genre", "IKEY": "keywords", "INAM": "title", "IPRD": "product",
+		"ISBJ": "subject", "ISFT": "software", "ISRC": "source", "ITCH": "technician", "ITRK": "track",
+	}
+
+	name, ok := names[node.ID]
+	if !ok {
+		name = "text"
+	}
+	node.addField(name, zeroTerminated(data))
+}
+
+// decodeTextChunk decodes a chunk holding a text, like NAME or ANNO chunks of AIFF files.
+func decodeTextChunk(node *chunk_node, data []byte, pos int64) {
+	node.addField("text", zeroTerminated(data))
+}
+
+// decodeBextChunk decodes a Broadcast Wave Format extension chunk (EBU Tech 3285).
+func decodeBextChunk(node *chunk_node, data []byte, pos int64) {
+	if len(data) < 602 {
+		node.addField("error", "bext chunk is too small.")
+		return
+	}
+
+	node.addField("description", zeroTerminated(data[0:256]))
+	node.addField("originator", zeroTerminated(data[256:288]))
+	node.addField("originator_reference", zeroTerminated(data[288:320]))
+	node.addField("origination_date", zeroTerminated(data[320:330]))
+	node.addField("origination_time", zeroTerminated(data[330:338]))
+	node.addField("time_reference", binary.LittleEndian.Uint64(data[338:]))
+	version := binary.LittleEndian.Uint16(data[346:])
+	node.addField("version", version)
+	if version >= 1 {
+		node.addField("umid", fmt.Sprintf("%X", bytes.TrimRight(data[348:412], "\x00")))
+	}
+	if version >= 2 {
+		for i, name := range []string{"loudness_value", "loudness_range", "max_true_peak_level", "max_momentary_loudness", "max_short_term_loudness"} {
+			node.addField(name, float64(int16(binary.LittleEndian.Uint16(data[412+2*i:])))/100)
+		}
+	}
+	node.addField("coding_history", zeroTerminated(data[602:]))
+}
+
+// decodeIXMLChunk decodes the main production fields of an iXML chunk.
+func decodeIXMLChunk(node *chunk_node, data []byte, pos int64) {
+	var ixml struct {
+		Project string `xml:"PROJECT"`
+		Scene   string `xml:"SCENE"`
+		Take    string `xml:"TAKE"`
+		Tape    string `xml:"TAPE"`
+		Note    string `xml:"NOTE"`
+		FileUID string `xml:"FILE_UID"`
+	}
+
+	if err := xml.Unmarshal(bytes.TrimRight(data, "\x00"), &ixml); err != nil {
+		node.addField("error", err.Error())
+		return
+	}
+
+	for _, field := range []chunk_field{{"project", ixml.Project}, {"scene", ixml.Scene}, {"take", ixml.Take},
+		{"tape", ixml.Tape}, {"note", ixml.Note}, {"file_uid", ixml.FileUID}} {
+		if field.Value != "" {
+			node.addField(field.Name, field.Value)
+		}
+	}
+}
+
+// decodeCueChunk decodes the cue points of a cue chunk.
+func decodeCueChunk(node *chunk_node, data []byte, pos int64) {
+	if len(data) < 4 {
+		node.addField("error", "cue chunk is too small.")
+		return
+	}
+
+	n := binary.LittleEndian.Uint32(data)
+	for i := uint32(0); i < n && 4+24*(int(i)+1) <= len(data); i++ {
+		p := data[4+24*i:]
+		node.addField("cue_point", cue_point{
+			ID:           binary.LittleEndian.Uint32(p[0:]),
+			Position:     binary.LittleEndian.Uint32(p[4:]),
+			Chunk:        string(p[8:12]),
+			ChunkStart:   binary.LittleEndian.Uint32(p[12:]),
+			BlockStart:   binary.LittleEndian.Uint32(p[16:]),
+			SampleOffset: binary.LittleEndian.Uint32(p[20:]),
+		})
+	}
+}
+
+// decodeSmplChunk decodes the sampler informations and loops of a smpl chunk.
+func decodeSmplChunk(node *chunk_node, data []byte, pos int64) {
+	if len(data) < 36 {
+		node.addField("error", "smpl chunk is too small.")
+		return
+	}
+
+	for i, name := range []string{"manufacturer", "product", "sample_period", "midi_unity_note",
+		"midi_pitch_fraction", "smpte_format", "smpte_offset"} {
+		node.addField(name, binary.LittleEndian.Uint32(data[4*i:]))
+	}
+
+	n := binary.LittleEndian.Uint32(data[28:])
+	for i := uint32(0); i < n && 36+24*(int(i)+1) <= len(data); i++ {
+		p := data[36+24*i:]
+		node.addField("loop", sample_loop{
+			ID:        binary.LittleEndian.Uint32(p[0:]),
+			Type:      binary.LittleEndian.Uint32(p[4:]),
+			Start:     binary.LittleEndian.Uint32(p[8:]),
+			End:       binary.LittleEndian.Uint32(p[12:]),
+			Fraction:  binary.LittleEndian.Uint32(p[16:]),
+			PlayCount: binary.LittleEndian.Uint32(p[20:]),
+		})
+	}
+}
+
+// decodeLabelChunk decodes a labl or note chunk of a LIST/adtl chunk: a cue point ID and a text.
+func decodeLabelChunk(node *chunk_node, data []byte, pos int64) {
+	if len(data) < 4 {
+		return
+	}
+
+	node.addField("cue_point_id", binary.LittleEndian.Uint32(data))
+	node.addField("text", zeroTerminated(data[4:]))
+}
+
+// decodeID3Chunk decodes the text and comment frames of an ID3v2 tag.
+func decodeID3Chunk(node *chunk_node, data []byte, pos int64) {
+	if len(data) < 10 || string(data[0:3]) != "ID3" {
+		node.addField("error", "No ID3v2 tag.")
+		return
+	}
+
+	var (
+		major  = data[3]
+		id_len = 4
+		hdr    = 10
+		tag    = data[10:]
+	)
+
+	node.addField("version", fmt.Sprintf("2.%d.%d", data[3], data[4]))
+	if size := int(syncSafe(data[6:10])); size < len(tag) {
+		tag = tag[0:size]
+	}
+	if data[5]&0x80 != 0 {
+		node.addField("error", "Unsynchronised tag is not decoded.")
+		return
+	}
+
+	// Version 2.2 has 3 characters frame IDs and 24 bits sizes
+	if major < 3 {
+		id_len, hdr = 3, 6
+	}
+
+	// Extended header
+	if major >= 3 && data[5]&0x40 != 0 && len(tag) >= 4 {
+		skip := int(binary.BigEndian.Uint32(tag)) + 4
+		if major >= 4 {
+			skip = int(syncSafe(tag))
+		}
+		if skip > len(tag) {
+			skip = len(tag)
+		}
+		tag = tag[skip:]
+	}
+
+	for len(tag) >= hdr && tag[0] != 0 {
+		id := string(tag[0:id_len])
+		var size int
+		switch {
+		case major < 3:
+			size = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case major == 3:
+			size = int(binary.BigEndian.Uint32(tag[4:]))
+		default:
+			size = int(syncSafe(tag[4:8]))
+		}
+		if size > len(tag)-hdr {
+			size = len(tag) - hdr
+		}
+		body := tag[hdr : hdr+size]
+
+		switch {
+		case len(body) == 0:
+		case id[0] == 'T' && id != "TXXX" && id != "TXX":
+			node.addField(id, id3Text(body[0], body[1:]))
+		case (id == "COMM" || id == "COM") && len(body) > 4:
+			// Language, then description and text separated by a terminator
+			text := id3Text(body[0], body[4:])
+			if i := strings.Index(text, " / "); i >= 0 {
+				text = text[i+3:]
+			}
+			node.addField(id, text)
+		}
+		tag = tag[hdr+size:]
+	}
+}
+
+// id3Text decodes an ID3v2 text in encoding. Multiple values are separated by " / ".
+func id3Text(encoding byte, b []byte) string {
+	var text string
+
+	switch encoding {
+	case 1, 2:
+		// UTF-16 with BOM, or big endian without BOM
+		big_endian := encoding == 2
+		if len(b) >= 2 && (b[0] == 0xFE && b[1] == 0xFF || b[0] == 0xFF && b[1] == 0xFE) {
+			big_endian = b[0] == 0xFE
+			b = b[2:]
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			if big_endian {
+				u[i] = binary.BigEndian.Uint16(b[2*i:])
+			} else {
+				u[i] = binary.LittleEndian.Uint16(b[2*i:])
+			}
+			// A BOM starts every value
+			if u[i] == 0xFEFF {
+				u[i] = 0
+				if i > 0 && u[i-1] == 0 {
+					u = u[0:i]
+					break
+				}
+			}
+		}
+		text = string(utf16.Decode(u))
+	case 3:
+		text = string(b)
+	default:
+		// ISO-8859-1
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		text = string(r)
+	}
+
+	return strings.Join(strings.FieldsFunc(strings.TrimRight(text, "\x00"), func(r rune) bool { return r == 0 }), " / ")
+}
+
+// syncSafe returns the 28 bits value of a 4 bytes ID3v2 synchsafe integer.
+func syncSafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// zeroTerminated returns the text in b, up to the first zero byte.
+func zeroTerminated(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[0:i]
+	}
+
+	return strings.TrimRight(string(b), " \r\n")
+}
+
+// String returns a cue point as text.
+func (self cue_point) String() string {
+	return fmt.Sprintf("#%d at sample %d of \"%s\"", self.ID, self.SampleOffset, self.Chunk)
+}
+
+// String returns a sample loop as text.
+func (self sample_loop) String() string {
+	var kinds = []string{"forward", "alternating", "backward"}
+
+	kind := fmt.Sprintf("type %d", self.Type)
+	if self.Type < uint32(len(kinds)) {
+		kind = kinds[self.Type]
+	}
+	count := "infinitely"
+	if self.PlayCount != 0 {
+		count = fmt.Sprintf("%d times", self.PlayCount)
+	}
+
+	return fmt.Sprintf("#%d %s from sample %d to %d, played %s", self.ID, kind, self.Start, self.End, count)
+}
+
+// parseTimestamp returns the seconds of a [hh:]mm:ss[.fff] timestamp.
+func parseTimestamp(value string) (seconds float64, err error) {
+	fields := strings.Split(value, ":")
+	if len(fields) > 3 {
+		return 0, errors.New("timestamp must look like [hh:]mm:ss.fff")
+	}
+
+	seconds, err = strconv.ParseFloat(fields[len(fields)-1], 64)
+	if err != nil || seconds < 0 || seconds >= 60 {
+		return 0, errors.New("seconds of timestamp must be in [0, 60)")
+	}
+
+	unit := 60.0
+	for i := len(fields) - 2; i >= 0; i-- {
+		n, err := strconv.ParseUint(fields[i], 10, 32)
+		if err != nil || (i != 0 && n >= 60) {
+			return 0, errors.New("timestamp must look like [hh:]mm:ss.fff")
+		}
+		seconds += float64(n) * unit
+		unit *= 60
+	}
+
+	return seconds, nil
+}
+
+// reservedChunkID returns true if id is the ID of a chunk the container formats depend on.
+func reservedChunkID(id string) bool {
+	switch id {
+	case "RIFF", "LIST", "fmt ", "data", "FORM", "COMM", "SSND":
+		return true
+	}
+
+	return false
+}
+
+// validChunkID returns true if id is made of 4 printable ASCII characters.
+func validChunkID(id string) bool {
+	if len(id) != 4 {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
 }
 
 // intToSuffixedStr converts integer into string. The string contains decimal value expressed as power of 2^10 by a suffix. 
 func intToSuffixedStr(value uint32) (result string) {
+	return int64ToSuffixedStr(int64(value))
+}
+
+// int64ToSuffixedStr is intToSuffixedStr for sizes of multi-GB files.
+func int64ToSuffixedStr(value int64) (result string) {
 	var engorder = 0
 	var tempv = float64(value)
 
 	for {
-		if value > 1024 {
+		if value > 1024 && engorder < len(EngSuffix)-1 {
 			engorder += 1
 			value >>= 10
 			tempv /= 1024
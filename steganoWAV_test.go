@@ -0,0 +1,1234 @@
+// Copyright (C) 2012 Stéphane Bunel. All rights reserved.
+// Use of this source code is governed by the license found in steganoWAV.go.
+//
+// Run with:
+//    go test steganoWAV.go carrier*.go steganoWAV_test.go
+//    go test -run '^$' -bench . steganoWAV.go carrier*.go steganoWAV_test.go -args -size=16M
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const (
+	TEST_FRAMES = 5 * TEST_RATE // # of frames of test carriers. Watermark needs a few seconds
+	TEST_RATE   = 22050         // Sampling rate of test carriers
+	TEST_LOUD   = 8192          // # of first frames clipped at full scale
+	TEST_OFFSET = 1234          // Samples offset used by tests, in the clipped part
+	TEST_SLOT   = "slot"        // Test mode hiding in a passphrase slot
+	TEST_WM     = "watermark"   // Test mode adding a watermark
+)
+
+const (
+	BENCH_SIZE     = "4M"      // Default size of payload hidden by BenchmarkHide and BenchmarkExtract
+	BENCH_MAX_SIZE = 512 << 20 // Carriers of 24 bits are then 3 GiB, RIFF format allows 4 GiB
+	BENCH_DENSITY  = 4         // Density of BenchmarkHide and BenchmarkExtract
+	BENCH_CHUNK    = 1 << 20   // # of samples generated at once in bench carriers
+)
+
+var bench_size = flag.String("size", BENCH_SIZE, "Size of payload hidden by BenchmarkHide and BenchmarkExtract (max 512M)")
+
+//-----------------------------------------------------------------------
+//-- TEST
+//-----------------------------------------------------------------------
+
+// round_trip_case is a carrier and an algorithm of TestRoundTrip.
+type round_trip_case struct {
+	format   string
+	bits     uint32
+	channels uint32
+	mode     string
+}
+
+// TestRoundTrip hides then extracts a payload with every algorithm in generated carriers of every
+// format, sample size and number of channels.
+func TestRoundTrip(t *testing.T) {
+	var (
+		dir          = t.TempDir()
+		payload      = testPayload(300)
+		payload_name = filepath.Join(dir, "payload.bin")
+		cases        []round_trip_case
+	)
+
+	if err := os.WriteFile(payload_name, payload, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"WAVE", "AIFF", "W64", "AU", "FLAC"} {
+		for _, bits := range []uint32{8, 16, 24} {
+			for _, channels := range []uint32{1, 2} {
+				for _, mode := range []string{ALGO_LSB, TEST_SLOT, ALGO_PHASE, ALGO_CHUNK, ALGO_REVERSIBLE, TEST_WM} {
+					cases = append(cases, round_trip_case{format, bits, channels, mode})
+				}
+			}
+		}
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s/bits=%d/channels=%d/%s", c.format, c.bits, c.channels, c.mode), func(t *testing.T) {
+			if !roundTripSupported(c.format, c.bits, c.mode) {
+				t.Skipf("%s doesn't apply to %d bits %s files", c.mode, c.bits, c.format)
+			}
+			if err := roundTrip(dir, c.format, c.bits, c.channels, c.mode, payload_name, payload); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestStreamedPayload hides then extracts a payload spanning several blocs with algorithms streaming
+// it, so that blocs are chained in order.
+func TestStreamedPayload(t *testing.T) {
+	var dir = t.TempDir()
+
+	tests := []struct {
+		mode string
+		size int
+	}{
+		{TEST_SLOT, 20000},       // 3 blocs of positions in 8 bits carriers
+		{ALGO_CHUNK, 3 * 65536},  // 4 copy steps of CHUNK_MOVE_BUF
+		{ALGO_REVERSIBLE, 10000}, // 3 blocs of test handlers
+	}
+
+	for _, test := range tests {
+		payload := testPayload(test.size)
+		payload_name := filepath.Join(dir, test.mode+".bin")
+		if err := os.WriteFile(payload_name, payload, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := roundTrip(dir, "WAVE", 8, 2, test.mode, payload_name, payload); err != nil {
+			t.Errorf("%s: %s", test.mode, err)
+		}
+	}
+}
+
+// Test8BitNoExtremes checks that bytes of 8 bits samples altered by a hide are never 0 or 255, even
+// in a carrier clipped at full scale where plain LSB replacement would produce them.
+func Test8BitNoExtremes(t *testing.T) {
+	var (
+		dir          = t.TempDir()
+		payload      = testPayload(2000)
+		payload_name = filepath.Join(dir, "payload.bin")
+		original     = testSignal(8, 2, TEST_FRAMES)
+	)
+
+	if err := os.WriteFile(payload_name, payload, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{ALGO_LSB, TEST_SLOT, ALGO_REVERSIBLE} {
+		// Higher densities are refused for 8 bits samples
+		for _, density := range []uint32{1, 2} {
+			if mode == ALGO_REVERSIBLE && density != 1 {
+				continue // Expanded prediction errors carry one bit each
+			}
+			t.Run(fmt.Sprintf("%s/density=%d", mode, density), func(t *testing.T) {
+				name := filepath.Join(dir, fmt.Sprintf("carrier.%s.%d.wav", mode, density))
+				if err := writeTestCarrier(name, "WAVE", 8, 2, original); err != nil {
+					t.Fatal(err)
+				}
+				before, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				offset := offset_spec{unit: OFFSET_SAMPLES, value: TEST_OFFSET}
+				if mode == ALGO_REVERSIBLE {
+					offset = offset_spec{unit: OFFSET_FRAMES, value: 2 * TEST_LOUD}
+				}
+				wh := newTestHandler(mode, offset)
+				defer wh.Free()
+				wh.density = density
+				if err = wh.OpenWave(name, true); err != nil {
+					t.Fatal(err)
+				}
+				if err = wh.OpenPayload(payload_name); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = wh.Hide(CHUNK_DEFAULT, nil); err != nil {
+					t.Fatal(err)
+				}
+				if err = wh.Sync(); err != nil {
+					t.Fatal(err)
+				}
+
+				after, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(after) != len(before) {
+					t.Fatalf("File size changed from %d to %d bytes.", len(before), len(after))
+				}
+				altered := 0
+				for i := 44; i < len(after); i++ {
+					if after[i] == before[i] {
+						continue
+					}
+					altered++
+					if after[i] == 0 || after[i] == 255 {
+						t.Fatalf("Sample at byte %d altered from %d to %d.", i, before[i], after[i])
+					}
+				}
+				if altered == 0 {
+					t.Fatal("No sample altered.")
+				}
+			})
+		}
+	}
+}
+
+// TestKeyedPermutation checks that slot orders are permutations of [0, n) whatever n.
+func TestKeyedPermutation(t *testing.T) {
+	for _, n := range []uint64{1, 2, 3, 255, 256, 1000, 65537} {
+		key := sha256.Sum256([]byte(fmt.Sprintf("key %d", n)))
+		perm := newKeyedPermutation(key[:], n)
+		seen := make([]bool, n)
+		for i := uint64(0); i < n; i++ {
+			j := perm.At(i)
+			if j >= n || seen[j] {
+				t.Fatalf("n=%d: %d is mapped to %d, out of range or already seen.", n, i, j)
+			}
+			seen[j] = true
+		}
+	}
+}
+
+// TestFFT checks that the inverse transform gives back the signal, and that a tone lands in its bin.
+func TestFFT(t *testing.T) {
+	const n = PHASE_SEGMENT_LEN
+
+	x := make([]complex128, n)
+	seed := uint64(n)
+	for i := range x {
+		seed = mix64(seed)
+		x[i] = complex(float64(int16(seed)), float64(int16(seed>>16)))
+	}
+	y := append([]complex128(nil), x...)
+	fft(y, false)
+	fft(y, true)
+	for i := range x {
+		if cmplx.Abs(y[i]-x[i]) > 1e-6 {
+			t.Fatalf("Sample %d is %v instead of %v once transformed back.", i, y[i], x[i])
+		}
+	}
+
+	const bin = 100
+	for i := range x {
+		x[i] = complex(math.Cos(2*math.Pi*bin*float64(i)/n), 0)
+	}
+	fft(x, false)
+	for k, v := range x {
+		want := 0.0
+		if k == bin || k == n-bin {
+			want = n / 2
+		}
+		if math.Abs(cmplx.Abs(v)-want) > 1e-6 {
+			t.Fatalf("Bin %d of a tone in bin %d has magnitude %g instead of %g.", k, bin, cmplx.Abs(v), want)
+		}
+	}
+}
+
+// TestFLACCodec encodes then decodes samples of every size and up to 2 channels, over several
+// frames and a short last one. Decoded samples must be the original ones.
+func TestFLACCodec(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, bits := range []uint32{8, 16, 24} {
+		for _, channels := range []uint32{1, 2} {
+			t.Run(fmt.Sprintf("bits=%d/channels=%d", bits, channels), func(t *testing.T) {
+				var (
+					wave_name = filepath.Join(dir, fmt.Sprintf("pcm%d.%d.wav", bits, channels))
+					flac_name = filepath.Join(dir, fmt.Sprintf("pcm%d.%d.flac", bits, channels))
+					samples   = testSignal(bits, channels, 3*FLAC_BLOCK_SIZE+124)
+				)
+
+				if err := writeTestCarrier(wave_name, "WAVE", bits, channels, samples); err != nil {
+					t.Fatal(err)
+				}
+				wave, err := os.ReadFile(wave_name)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				out, err := os.Create(flac_name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer out.Close()
+				stream := &flac_stream{sample_rate: TEST_RATE, channels: channels, bits: bits}
+				if err = stream.encode(bytes.NewReader(wave[44:]), out); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = out.Seek(0, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+
+				decoded, err := os.Create(wave_name + ".decoded")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer decoded.Close()
+				stream = &flac_stream{}
+				if err = stream.decode(out, decoded); err != nil {
+					t.Fatal(err)
+				}
+				if stream.channels != channels || stream.bits != bits || stream.total_frames != uint64(len(samples))/uint64(channels) {
+					t.Fatalf("Decoded %d channels of %d bits, %d frames.", stream.channels, stream.bits, stream.total_frames)
+				}
+				got, err := os.ReadFile(decoded.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, wave) {
+					t.Fatal("Decoded WAVE file differs from the original one.")
+				}
+			})
+		}
+	}
+}
+
+// TestParseDamaged opens damaged files: tolerated deviations give warnings, others an error.
+func TestParseDamaged(t *testing.T) {
+	var (
+		dir       = t.TempDir()
+		data_size = uint64(4000)
+	)
+
+	tests := []struct {
+		name   string
+		format string
+		damage func(b []byte) []byte
+		fails  bool
+	}{
+		{"WAVE zero channels", "WAVE", func(b []byte) []byte { b[22] = 0; return b }, true},
+		{"WAVE block align", "WAVE", func(b []byte) []byte { b[32] = 3; return b }, true},
+		{"WAVE sample size", "WAVE", func(b []byte) []byte { b[34] = 40; return b }, true},
+		{"AIFF FORM size", "AIFF", func(b []byte) []byte { b[5] ^= 0x10; return b }, false},
+		{"AIFF truncated", "AIFF", func(b []byte) []byte { return b[:len(b)-1000] }, false},
+		{"AIFF zero channels", "AIFF", func(b []byte) []byte { b[21] = 0; return b }, true},
+		{"AIFF sample size", "AIFF", func(b []byte) []byte { b[27] = 40; return b }, true},
+		{"AIFF SSND offset", "AIFF", func(b []byte) []byte { copy(b[46:], []byte{0xFF, 0xFF, 0xFF, 0xFC}); return b }, true},
+		{"W64 riff size", "W64", func(b []byte) []byte { b[17] ^= 0x10; return b }, false},
+		{"W64 truncated", "W64", func(b []byte) []byte { return b[:len(b)-1000] }, false},
+		{"W64 data size wraps", "W64", func(b []byte) []byte { binary.LittleEndian.PutUint64(b[96:], math.MaxUint64-3); return b }, false},
+		{"W64 fmt size wraps", "W64", func(b []byte) []byte { binary.LittleEndian.PutUint64(b[56:], math.MaxUint64-3); return b }, true},
+		{"W64 fmt size 0", "W64", func(b []byte) []byte { binary.LittleEndian.PutUint64(b[56:], 0); return b }, true},
+		{"W64 chunk past end", "W64", func(b []byte) []byte {
+			junk := make([]byte, 32)
+			copy(junk, "JUNK"+W64_GUID_SUFFIX)
+			binary.LittleEndian.PutUint64(junk[16:], 1<<20)
+			return append(b, junk...)
+		}, true},
+		{"AU data offset", "AU", func(b []byte) []byte { b[4] = 0xFF; return b }, true},
+		{"AU zero channels", "AU", func(b []byte) []byte { b[23] = 0; return b }, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, err := testCarrierHeader(test.format, 2, TEST_RATE, 16, data_size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := filepath.Join(dir, strings.ReplaceAll(test.name, " ", "_"))
+			if err = os.WriteFile(name, test.damage(append(header, make([]byte, data_size)...)), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			wh := &wave_handler_struct{algorithm: ALGO_LSB}
+			defer wh.Free()
+			err = wh.OpenWave(name, false)
+			switch {
+			case test.fails && err == nil:
+				t.Fatal("Damaged file is accepted.")
+			case test.fails && exitCode(err, EXIT_FORMAT) != EXIT_FORMAT:
+				t.Fatalf("Exit code is %d instead of %d: %s", exitCode(err, EXIT_FORMAT), EXIT_FORMAT, err)
+			case !test.fails && err != nil:
+				t.Fatal(err)
+			case !test.fails && len(wh.wave_info.warnings) == 0:
+				t.Fatal("Damaged file gives no warning.")
+			}
+		})
+	}
+}
+
+// TestOffsetSpec checks the units accepted by --offset, and the values refused.
+func TestOffsetSpec(t *testing.T) {
+	tests := []struct {
+		text  string
+		unit  string
+		value float64
+		fails bool
+	}{
+		{"0", OFFSET_SAMPLES, 0, false},
+		{"5432", OFFSET_SAMPLES, 5432, false},
+		{"4294967295", OFFSET_SAMPLES, math.MaxUint32, false},
+		{"4294967296", OFFSET_SAMPLES, 0, true},
+		{"-1", OFFSET_SAMPLES, 0, true},
+		{"1000f", OFFSET_FRAMES, 1000, false},
+		{"1.5f", OFFSET_FRAMES, 0, true},
+		{"2.5s", OFFSET_TIME, 2.5, false},
+		{"-2s", OFFSET_TIME, 0, true},
+		{"12.5%", OFFSET_PERCENT, 12.5, false},
+		{"0%", OFFSET_PERCENT, 0, false},
+		{"100%", OFFSET_PERCENT, 0, true},
+		{"-5%", OFFSET_PERCENT, 0, true},
+		{"00:01.250", OFFSET_TIME, 1.25, false},
+		{"01:02:03.5", OFFSET_TIME, 3723.5, false},
+		{"90:00", OFFSET_TIME, 90 * 60, false},
+		{"00:60", OFFSET_TIME, 0, true},
+		{"01:60:00", OFFSET_TIME, 0, true},
+		{"1:2:3:4", OFFSET_TIME, 0, true},
+		{"aa:10", OFFSET_TIME, 0, true},
+		{"x", OFFSET_SAMPLES, 0, true},
+	}
+
+	for _, test := range tests {
+		var offset offset_spec
+
+		err := offset.Set(test.text)
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("\"%s\" is accepted: %+v", test.text, offset)
+		case !test.fails && err != nil:
+			t.Errorf("\"%s\" is refused: %s", test.text, err)
+		case offset.unit != test.unit || offset.text != test.text:
+			t.Errorf("\"%s\" gives unit %s instead of %s.", test.text, offset.unit, test.unit)
+		case !test.fails && math.Abs(offset.value-test.value) > 1e-9:
+			t.Errorf("\"%s\" gives %v instead of %v.", test.text, offset.value, test.value)
+		}
+	}
+
+	// Timestamps without hours nor minutes are only given by callers of parseTimestamp
+	for text, seconds := range map[string]float64{"59.999": 59.999, "0": 0, "60": -1, "1:2:3:4": -1, "-1": -1} {
+		value, err := parseTimestamp(text)
+		switch {
+		case seconds < 0 && err == nil:
+			t.Errorf("Timestamp \"%s\" is accepted: %v", text, value)
+		case seconds >= 0 && (err != nil || math.Abs(value-seconds) > 1e-9):
+			t.Errorf("Timestamp \"%s\" gives %v (%v) instead of %v.", text, value, err, seconds)
+		}
+	}
+}
+
+// TestBatchOrder checks that batch items reading a file written by a previous item wait for it,
+// and that a file written twice is refused.
+func TestBatchOrder(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		wave    = filepath.Join(dir, "carrier.wav")
+		payload = filepath.Join(dir, "payload")
+		output  = filepath.Join(dir, "extracted")
+		offset  = offset_spec{text: "1234", unit: OFFSET_SAMPLES, value: TEST_OFFSET}
+	)
+
+	if err := writeTestCarrier(wave, "WAVE", 16, 2, testSignal(16, 2, TEST_FRAMES)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(payload, testPayload(1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	item := batch_item{wave_file: wave, algorithm: ALGO_LSB, chunk_id: CHUNK_DEFAULT, offset: offset}
+	items := []batch_item{item, item, item, item}
+	items[0].action, items[0].payload_file = "hide", payload
+	items[1].action, items[1].output = "extract", output
+	items[2].action = "info"
+	items[3].action, items[3].output = "extract", output
+
+	report := runBatch(context.Background(), items, len(items))
+	for i, result := range report.Results[0:3] {
+		if !result.Ok {
+			t.Fatalf("Item %d failed: %s", i+1, result.Error)
+		}
+	}
+	if result := report.Results[3]; result.Ok || result.Code != EXIT_USAGE {
+		t.Fatalf("Second item writing \"%s\" is not refused: %+v", output, result)
+	}
+
+	if extracted, err := os.ReadFile(output); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(extracted, testPayload(1000)) {
+		t.Fatal("Extracted payload differs: extract didn't wait for hide.")
+	}
+}
+
+// TestBextRoundTrip checks that hiding into an --output copy keeps bext and iXML chunks byte for byte,
+// leaves the WAVE Audio file untouched, and that --bext updates only the given fields.
+func TestBextRoundTrip(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		wave    = filepath.Join(dir, "carrier.wav")
+		copied  = filepath.Join(dir, "copy.wav")
+		payload = filepath.Join(dir, "payload")
+		offset  = offset_spec{unit: OFFSET_SAMPLES, value: TEST_OFFSET}
+		bext    = make([]byte, 602)
+		ixml    = []byte("<BWFXML><PROJECT>steganoWAV</PROJECT></BWFXML>\n") // Odd size: chunk is padded
+		output  bytes.Buffer
+	)
+
+	copy(bext[0:], "Original description")
+	copy(bext[256:], "Originator")
+	copy(bext[320:], "2012-01-02"+"03:04:05")
+	binary.LittleEndian.PutUint64(bext[338:], 42)
+	bext = append(bext, "A=PCM,F=22050,W=16,M=stereo\r\n"...)
+
+	if err := writeTestCarrier(wave, "WAVE", 16, 2, testSignal(16, 2, TEST_FRAMES)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(payload, testPayload(1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	wh := newTestHandler(ALGO_LSB, offset)
+	defer wh.Free()
+	if err := wh.OpenWave(wave, true); err != nil {
+		t.Fatal(err)
+	}
+	chunked := wh.carrier.(chunk_carrier)
+	if err := chunked.AppendChunk("bext", len(bext), bytes.NewReader(bext)); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunked.AppendChunk("iXML", len(ixml), bytes.NewReader(ixml)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wh.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	wh.Free()
+
+	original, err := os.ReadFile(wave)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hide into a copy, then update bext like --bext
+	wh = newTestHandler(ALGO_LSB, offset)
+	defer wh.Free()
+	if err = wh.OpenWaveOutput(wave, copied); err != nil {
+		t.Fatal(err)
+	}
+	if err = wh.OpenPayload(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err = wh.HidePayload(TEST_OFFSET); err != nil {
+		t.Fatal(err)
+	}
+	if err = wh.UpdateBext([]string{"description=Copy", "time_reference=1234567890123", "coding_history=A=PCM,T=steganoWAV"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = wh.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	wh.Free()
+
+	if unchanged, err := os.ReadFile(wave); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(unchanged, original) {
+		t.Fatal("WAVE Audio file is modified by hiding into a copy.")
+	}
+
+	// Chunks of the copy
+	wh = newTestHandler(ALGO_LSB, offset)
+	defer wh.Free()
+	if err = wh.OpenWave(copied, false); err != nil {
+		t.Fatal(err)
+	}
+	chunked = wh.carrier.(chunk_carrier)
+	chunks, err := chunked.Chunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string][]byte{}
+	for _, c := range chunks {
+		data := make([]byte, c.size)
+		if c.id != "data" {
+			if err = chunked.ReadChunk(c, 0, data); err != nil {
+				t.Fatal(err)
+			}
+			found[c.id] = data
+		}
+	}
+
+	if !bytes.Equal(found["iXML"], ixml) {
+		t.Errorf("iXML chunk differs: %q", found["iXML"])
+	}
+
+	want := append([]byte{}, bext...)
+	copy(want[0:256], append([]byte("Copy"), make([]byte, 252)...))
+	binary.LittleEndian.PutUint64(want[338:], 1234567890123)
+	want = append(want, "A=PCM,T=steganoWAV\r\n"...)
+	if got := found["bext"]; !bytes.Equal(got, want) {
+		t.Errorf("bext chunk differs.\n got: %q\nwant: %q", got, want)
+	}
+
+	// Payload is hidden in the copy
+	if err = wh.ExtractPayload(TEST_OFFSET, &output); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), testPayload(1000)) {
+		t.Fatal("Extracted payload differs.")
+	}
+}
+
+// TestParseArgs checks the action and options read from command lines, and the command lines refused.
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args   string
+		action uint
+		check  func() bool
+		code   int // Exit class of parseArgs error, -1 if none
+	}{
+		{"", ACTION_HELP, nil, -1},
+		{"version", ACTION_VERSION, nil, -1},
+		{"help hide", ACTION_HELP, func() bool { return gd.command == "hide" }, -1},
+		{"hide --help", ACTION_HIDE, nil, EXIT_OK},
+		{"hide --wave a.wav --payload p --offset 10f --density 2", ACTION_HIDE, func() bool {
+			return gd.wave_file == "a.wav" && gd.payload_file == "p" && gd.offset.unit == OFFSET_FRAMES && gd.offset.value == 10 &&
+				gd.density == 2 && gd.algorithm == ALGO_LSB && gd.chunk_id == CHUNK_DEFAULT && gd.format == FORMAT_TEXT
+		}, -1},
+		{"extract --offset 1234 --wave a.wav --format json --output b", ACTION_EXTRACT, func() bool {
+			return gd.wave_file == "a.wav" && gd.offset.value == 1234 && gd.format == FORMAT_JSON && gd.output == "b"
+		}, -1},
+		{"--info --wave a.wav", ACTION_INFO, func() bool { return gd.wave_file == "a.wav" }, -1},
+		{"--hide --data p --wave a.wav --passphrase s --algorithm chunk --chunk abcd", ACTION_HIDE, func() bool {
+			return gd.payload_file == "p" && gd.passphrase == "s" && gd.algorithm == ALGO_CHUNK && gd.chunk_id == "abcd"
+		}, -1},
+		{"plan --size 1K a.wav b.wav", ACTION_PLAN, func() bool {
+			return gd.payload_size == 1024 && len(gd.carriers) == 2 && gd.carriers[1] == "b.wav"
+		}, -1},
+		{"hide --wave a.wav --bext description=x --bext originator=y --payload p --offset 0", ACTION_HIDE, func() bool {
+			return len(gd.bext) == 2 && gd.bext[1] == "originator=y"
+		}, -1},
+		{"batch --glob *.wav --action info --jobs 3", ACTION_BATCH, func() bool {
+			return gd.glob == "*.wav" && gd.batch_action == "info" && gd.jobs == 3
+		}, -1},
+
+		{"unknown", ACTION_HELP, nil, EXIT_USAGE},
+		{"--info --extract --wave a.wav --offset 0", ACTION_INFO, nil, EXIT_USAGE},
+		{"--hide --info --wave a.wav --payload p --offset 0", ACTION_INFO, nil, EXIT_USAGE},
+		{"info --wave a.wav extra", ACTION_INFO, nil, EXIT_USAGE},
+		{"info --wave a.wav --key k", ACTION_INFO, nil, EXIT_USAGE},
+		{"info", ACTION_INFO, nil, EXIT_USAGE},
+		{"info --wave a.wav --density 3", ACTION_INFO, nil, EXIT_USAGE},
+		{"info --wave a.wav --algorithm rot13", ACTION_INFO, nil, EXIT_USAGE},
+		{"info --wave a.wav --format xml", ACTION_INFO, nil, EXIT_USAGE},
+		{"hide --wave a.wav --payload p", ACTION_HIDE, nil, EXIT_USAGE},
+		{"hide --wave a.wav --offset 0", ACTION_HIDE, nil, EXIT_USAGE},
+		{"hide --wave a.wav --payload p --algorithm chunk", ACTION_HIDE, nil, EXIT_USAGE},
+		{"hide --wave a.wav --payload p --passphrase s --chunk data", ACTION_HIDE, nil, EXIT_USAGE},
+		{"hide --wave a.wav --payload p --offset 0 --bext origination_date=today", ACTION_HIDE, nil, EXIT_USAGE},
+		{"hide --wave - --payload - --offset 0 --output b.wav", ACTION_HIDE, nil, EXIT_USAGE},
+		{"hide --wave - --payload p --offset 0", ACTION_HIDE, nil, EXIT_USAGE},
+		{"extract --wave a.wav --offset 0 --algorithm reversible --restore -", ACTION_EXTRACT, nil, EXIT_USAGE},
+		{"verify --wave a.wav --offset 0", ACTION_VERIFY, nil, EXIT_USAGE},
+		{"verify --wave a.wav --offset 0 --sha256 00", ACTION_VERIFY, nil, EXIT_USAGE},
+		{"plan a.wav", ACTION_PLAN, nil, EXIT_USAGE},
+		{"batch --glob *.wav", ACTION_BATCH, nil, EXIT_USAGE},
+		{"batch --glob *.wav --action info --jobs 0", ACTION_BATCH, nil, EXIT_USAGE},
+		{"watermark --wave a.wav --key k", ACTION_WATERMARK, nil, EXIT_USAGE},
+	}
+
+	saved_gd, saved_args, saved_stdout, saved_stderr := gd, os.Args, os.Stdout, os.Stderr
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		gd, os.Args, os.Stdout, os.Stderr = saved_gd, saved_args, saved_stdout, saved_stderr
+		null.Close()
+	}()
+
+	for _, test := range tests {
+		// Usage and messages are not checked
+		gd, os.Args, os.Stdout, os.Stderr = &global_data{}, append([]string{APP}, strings.Fields(test.args)...), null, null
+		err := parseArgs()
+		os.Stdout, os.Stderr = saved_stdout, saved_stderr
+
+		code := -1
+		if err != nil {
+			code = exitCode(err, EXIT_FAILURE)
+		}
+		switch {
+		case code != test.code:
+			t.Errorf("\"%s\" gives exit code %d instead of %d (%v).", test.args, code, test.code, err)
+		case gd.action != test.action:
+			t.Errorf("\"%s\" gives action %d instead of %d.", test.args, gd.action, test.action)
+		case test.check != nil && !test.check():
+			t.Errorf("\"%s\" gives wrong options: %+v", test.args, *gd)
+		}
+	}
+}
+
+// TestExitCode checks the exit code of error classes.
+func TestExitCode(t *testing.T) {
+	_, path_err := os.Open(filepath.Join(t.TempDir(), "missing"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, EXIT_FAILURE},
+		{errors.New("failed"), EXIT_FAILURE},
+		{&exit_error{EXIT_USAGE, errors.New("usage")}, EXIT_USAGE},
+		{fmt.Errorf("wrapped: %w", &exit_error{EXIT_CAPACITY, errors.New("capacity")}), EXIT_CAPACITY},
+		{&exit_error{EXIT_FORMAT, path_err}, EXIT_FORMAT},
+		{path_err, EXIT_IO},
+		{fmt.Errorf("wrapped: %w", path_err), EXIT_IO},
+		{ctx.Err(), EXIT_CANCELED},
+		{fmt.Errorf("wrapped: %w", context.Canceled), EXIT_CANCELED},
+	}
+
+	for i, test := range tests {
+		if code := exitCode(test.err, EXIT_FAILURE); code != test.code {
+			t.Errorf("Error %d (%v) gives exit code %d instead of %d.", i, test.err, code, test.code)
+		}
+	}
+}
+
+// testPayload returns size deterministic bytes.
+func testPayload(size int) (payload []byte) {
+	payload = make([]byte, size)
+	seed := uint64(TEST_OFFSET)
+	for i := range payload {
+		seed = mix64(seed)
+		payload[i] = byte(seed)
+	}
+
+	return payload
+}
+
+// roundTripSupported tells if mode applies to carriers of format and bits: phase coding needs more
+// than 8 bits, and AU and FLAC files have no chunks.
+func roundTripSupported(format string, bits uint32, mode string) bool {
+	return !(mode == ALGO_PHASE && bits == 8) && !(mode == ALGO_CHUNK && (format == "AU" || format == "FLAC"))
+}
+
+// roundTrip writes a carrier of format with channels, hides payload in it with mode, then checks
+// that it is extracted back. Altered 8 bits samples must not reach extreme values. Reversible mode must
+// restore the original samples.
+func roundTrip(dir string, format string, bits uint32, channels uint32, mode string, payload_name string, payload []byte) (err error) {
+	var (
+		name     = filepath.Join(dir, fmt.Sprintf("carrier%d.%d.%s", bits, channels, strings.ToLower(format)))
+		original = testSignal(bits, channels, TEST_FRAMES)
+		output   bytes.Buffer
+	)
+
+	if err = writeTestCarrier(name, format, bits, channels, original); err != nil {
+		return err
+	}
+
+	// Phase coded segment and reversibly hidden data are out of the clipped part
+	offset := offset_spec{unit: OFFSET_SAMPLES, value: TEST_OFFSET}
+	if mode == ALGO_PHASE || mode == ALGO_REVERSIBLE {
+		offset = offset_spec{unit: OFFSET_FRAMES, value: 2 * TEST_LOUD}
+	}
+
+	// Hide
+	wh := newTestHandler(mode, offset)
+	defer wh.Free()
+	if err = wh.OpenWave(name, true); err != nil {
+		return err
+	}
+	if mode != TEST_WM {
+		if err = wh.OpenPayload(payload_name); err != nil {
+			return err
+		}
+	}
+	switch mode {
+	case ALGO_LSB:
+		err = wh.HidePayload(TEST_OFFSET)
+	case TEST_SLOT:
+		err = wh.HidePayloadSlot(nil)
+	case ALGO_PHASE:
+		err = wh.HidePayloadPhase()
+	case ALGO_CHUNK:
+		err = wh.HidePayloadChunk(CHUNK_DEFAULT)
+	case ALGO_REVERSIBLE:
+		err = wh.HidePayloadReversible()
+	case TEST_WM:
+		err = wh.Watermark(APP, TEST_OFFSET)
+	}
+	if err == nil {
+		err = wh.Sync()
+	}
+	wh.Free()
+	if err != nil {
+		return err
+	}
+
+	// Extract. Reversible mode restores samples
+	wh = newTestHandler(mode, offset)
+	defer wh.Free()
+	if err = wh.OpenWave(name, mode == ALGO_REVERSIBLE); err != nil {
+		return err
+	}
+	switch mode {
+	case ALGO_LSB:
+		err = wh.ExtractPayload(TEST_OFFSET, &output)
+	case TEST_SLOT:
+		err = wh.ExtractPayloadSlot(&output)
+	case ALGO_PHASE:
+		err = wh.ExtractPayloadPhase(&output)
+	case ALGO_CHUNK:
+		err = wh.ExtractPayloadChunk(&output)
+	case ALGO_REVERSIBLE:
+		err = wh.ExtractPayloadReversible(&output, true)
+	case TEST_WM:
+		id, _, found, err := wh.DetectWatermark(APP)
+		if err != nil {
+			return err
+		}
+		if !found || id != TEST_OFFSET {
+			return errors.New("Watermark not detected.")
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(output.Bytes(), payload) {
+		return errors.New("Extracted data differs from payload.")
+	}
+
+	if mode == ALGO_REVERSIBLE {
+		samples := make(SamplesBloc, len(original))
+		if err = wh.carrier.ReadSamples(0, samples); err != nil {
+			return err
+		}
+		for i, v := range samples {
+			if v != original[i] {
+				return errors.New(fmt.Sprintf("Sample %d restored to %d instead of %d.", i, v, original[i]))
+			}
+		}
+	}
+
+	// 8 bits samples kept off extremes
+	if bits == 8 && (mode == ALGO_LSB || mode == TEST_SLOT) {
+		samples := make(SamplesBloc, len(original))
+		if err = wh.carrier.ReadSamples(0, samples); err != nil {
+			return err
+		}
+		for i, v := range samples {
+			if v != original[i] && (v == math.MinInt8 || v == math.MaxInt8) {
+				return errors.New(fmt.Sprintf("Sample %d altered to extreme value %d.", i, v))
+			}
+		}
+	}
+
+	return nil
+}
+
+// newTestHandler returns a handler set up for a test mode.
+func newTestHandler(mode string, offset offset_spec) *wave_handler_struct {
+	var wh = &wave_handler_struct{bloc_size: 4096, algorithm: ALGO_LSB, offset: offset}
+
+	switch mode {
+	case ALGO_PHASE, ALGO_REVERSIBLE:
+		wh.algorithm = mode
+	case ALGO_CHUNK:
+		wh.algorithm, wh.passphrase = mode, APP
+	case TEST_SLOT:
+		wh.passphrase = APP
+	}
+	wh.payload_obfuscation_seed = 7
+	wh.obfuscate = true
+	wh.resetObfuscation()
+	wh.workers = 4
+	wh.segment_size = 64 // Several segments hold the small payload
+
+	return wh
+}
+
+// writeTestCarrier writes samples to a new file of format.
+func writeTestCarrier(name string, format string, bits uint32, channels uint32, samples SamplesBloc) (err error) {
+	var (
+		data_size = uint64(len(samples)) * uint64(bits/8)
+		wave_name = name
+	)
+
+	// FLAC files are encoded from a WAVE file
+	if format == "FLAC" {
+		wave_name = name + ".wav"
+		defer os.Remove(wave_name)
+	}
+
+	header, err := testCarrierHeader(format, channels, TEST_RATE, bits, data_size)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(wave_name, append(header, make([]byte, data_size)...), 0600); err != nil {
+		return err
+	}
+
+	// Samples are encoded by the carrier
+	wh := &wave_handler_struct{algorithm: ALGO_LSB, density: 1}
+	defer wh.Free()
+	if err = wh.OpenWave(wave_name, true); err != nil {
+		return err
+	}
+	if err = wh.carrier.WriteSamples(0, samples); err != nil {
+		return err
+	}
+	if err = wh.Sync(); err != nil {
+		return err
+	}
+	if format != "FLAC" {
+		return nil
+	}
+
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	stream := &flac_stream{sample_rate: TEST_RATE, channels: channels, bits: bits}
+	if err = stream.encode(io.NewSectionReader(wh.carrier.(*riff_carrier).file, int64(len(header)), int64(data_size)), out); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+// testSignal returns frames of a deterministic sound: two tones with noise. The first
+// TEST_LOUD frames are clipped at full scale so that extreme and near extreme values are present.
+func testSignal(bits uint32, channels uint32, frames uint32) (samples SamplesBloc) {
+	var (
+		max  = float64(int64(1)<<(bits-1) - 1)
+		seed = uint64(bits)
+	)
+
+	samples = make(SamplesBloc, frames*channels)
+	for f := uint32(0); f < frames; f++ {
+		t := float64(f) / TEST_RATE
+		for c := uint32(0); c < channels; c++ {
+			seed = mix64(seed)
+			v := 0.4*math.Sin(2*math.Pi*440*t+float64(c)) + 0.1*math.Sin(2*math.Pi*1234.5*t)
+			if f < TEST_LOUD {
+				v *= 2.5
+			}
+			v = max*v + 4*(float64(seed>>11)/(1<<53)-0.5)
+			samples[f*channels+c] = int32(math.Max(-max-1, math.Min(max, math.Floor(v+0.5))))
+		}
+	}
+
+	return samples
+}
+
+// testCarrierHeader returns the headers of a file of format holding data_size bytes of PCM samples.
+func testCarrierHeader(format string, channels uint32, rate uint32, bits uint32, data_size uint64) (header []byte, err error) {
+	wave, err := waveHeader(channels, rate, bits, data_size)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "WAVE":
+		return wave, nil
+	case "AIFF":
+		header = make([]byte, 54)
+		copy(header[0:], "FORM")
+		binary.BigEndian.PutUint32(header[4:], uint32(46+data_size))
+		copy(header[8:], "AIFFCOMM")
+		binary.BigEndian.PutUint32(header[16:], 18)
+		binary.BigEndian.PutUint16(header[20:], uint16(channels))
+		binary.BigEndian.PutUint32(header[22:], uint32(data_size/uint64(channels*bits/8)))
+		binary.BigEndian.PutUint16(header[26:], uint16(bits))
+		copy(header[28:], floatToExtended(float64(rate)))
+		copy(header[38:], "SSND")
+		binary.BigEndian.PutUint32(header[42:], uint32(8+data_size))
+	case "W64":
+		header = make([]byte, 120)
+		copy(header[0:], W64_RIFF_GUID)
+		binary.LittleEndian.PutUint64(header[16:], 120+data_size)
+		copy(header[24:], "wave"+W64_GUID_SUFFIX)
+		copy(header[40:], "fmt "+W64_GUID_SUFFIX)
+		binary.LittleEndian.PutUint64(header[56:], 24+16)
+		copy(header[64:], wave[20:36])
+		copy(header[80:], "data"+W64_GUID_SUFFIX)
+		binary.LittleEndian.PutUint64(header[96:], 24+data_size)
+		header = header[0:104]
+		binary.LittleEndian.PutUint64(header[16:], 104+data_size)
+	case "AU":
+		header = make([]byte, 24)
+		copy(header[0:], AU_MAGIC)
+		binary.BigEndian.PutUint32(header[4:], 24)
+		binary.BigEndian.PutUint32(header[8:], uint32(data_size))
+		binary.BigEndian.PutUint32(header[12:], bits/8+1)
+		binary.BigEndian.PutUint32(header[16:], rate)
+		binary.BigEndian.PutUint32(header[20:], channels)
+	case "FLAC":
+		return wave, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown format \"%s\".", format))
+	}
+
+	return header, nil
+}
+
+// floatToExtended returns value (> 0) as a big endian 80 bits IEEE 754 extended precision float.
+func floatToExtended(value float64) (b []byte) {
+	frac, exponent := math.Frexp(value) // value = frac * 2^exponent with 0.5 <= frac < 1
+
+	b = make([]byte, 10)
+	binary.BigEndian.PutUint16(b[0:], uint16(exponent-1+16383))
+	binary.BigEndian.PutUint64(b[2:], uint64(math.Ldexp(frac, 64)))
+
+	return b
+}
+
+//-----------------------------------------------------------------------
+//-- BENCHMARK
+//-----------------------------------------------------------------------
+
+// BenchmarkStegBloc hides a payload bloc with every sample size and density.
+func BenchmarkStegBloc(b *testing.B) {
+	benchKernels(b, false)
+}
+
+// BenchmarkUnstegBloc extracts a payload bloc with every sample size and density.
+func BenchmarkUnstegBloc(b *testing.B) {
+	benchKernels(b, true)
+}
+
+// BenchmarkHide hides -size random bytes end to end in generated 16 and 24 bits stereo carriers,
+// with the bloc by bloc engine (jobs=1) then the parallel engine. Both engines must leave the same samples.
+func BenchmarkHide(b *testing.B) {
+	benchEngines(b, false)
+}
+
+// BenchmarkExtract extracts -size random bytes end to end from generated 16 and 24 bits stereo carriers,
+// with the bloc by bloc engine (jobs=1) then the parallel engine.
+func BenchmarkExtract(b *testing.B) {
+	benchEngines(b, true)
+}
+
+// benchKernels runs a sub-benchmark of StegBloc, or UnstegBloc if unsteg, per sample size and density.
+func benchKernels(b *testing.B, unsteg bool) {
+	for _, bits := range []uint32{8, 16, 24} {
+		for _, density := range []uint32{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("bits=%d/density=%d", bits, density), benchKernel(bits, density, unsteg))
+		}
+	}
+}
+
+// benchKernel returns a benchmark of StegBloc, or UnstegBloc if unsteg, with a payload bloc of
+// obfuscated random bytes hidden with density in noise samples of bits.
+func benchKernel(bits, density uint32, unsteg bool) func(b *testing.B) {
+	return func(b *testing.B) {
+		var wh = &wave_handler_struct{bloc_size: 4096, algorithm: ALGO_LSB, density: density, samples_for_one_byte: 8 / density}
+
+		wh.wave_info.bits_per_sample = bits
+		wh.wave_info.bytes_per_sample = bits >> 3
+		wh.payload_obfuscation_seed = 7
+		wh.obfuscate = true
+		wh.resetObfuscation()
+
+		payload := make(PayloadBloc, wh.bloc_size)
+		samples := make(SamplesBloc, wh.bloc_size*wh.samples_for_one_byte)
+		seed := benchNoise(samples, bits, uint64(density))
+		for i := range payload {
+			seed = mix64(seed)
+			payload[i] = byte(seed)
+		}
+
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if unsteg {
+				wh.UnstegBloc(&samples, &payload)
+			} else {
+				wh.StegBloc(&payload, &samples)
+			}
+		}
+	}
+}
+
+// benchEngines runs a sub-benchmark of Hide, or Extract if extract, per sample size and engine.
+// Carriers are generated once per sample size and shared by both engines.
+func benchEngines(b *testing.B, extract bool) {
+	size, err := parseSize(*bench_size)
+	if err == nil && size > BENCH_MAX_SIZE {
+		err = errors.New(fmt.Sprintf("Bad size (%s). Max is 512M.", *bench_size))
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	dir := b.TempDir()
+	payload_name := filepath.Join(dir, "payload.bin")
+	if err = writeBenchPayload(payload_name, size); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bits := range []uint32{16, 24} {
+		name := filepath.Join(dir, fmt.Sprintf("carrier%d.wav", bits))
+		if err = writeBenchCarrier(name, bits, size); err != nil {
+			b.Fatal(err)
+		}
+
+		var digest string
+		for _, workers := range []int{1, max(runtime.NumCPU(), 2)} {
+			b.Run(fmt.Sprintf("bits=%d/jobs=%d", bits, workers), func(b *testing.B) {
+				sum := benchEngine(b, name, payload_name, workers, extract)
+				if digest != "" && sum != digest {
+					b.Fatalf("%d bits carrier: engines left different samples.", bits)
+				}
+				digest = sum
+			})
+		}
+		os.Remove(name)
+	}
+}
+
+// benchEngine measures hiding, or extracting if extract, payload_name in carrier name with workers
+// goroutines. Payload is hidden once before extracting. Returns the SHA-256 of carrier once payload is hidden.
+func benchEngine(b *testing.B, name, payload_name string, workers int, extract bool) (digest string) {
+	wh := &wave_handler_struct{bloc_size: 4096, algorithm: ALGO_LSB, density: BENCH_DENSITY, workers: workers}
+	defer wh.Free()
+	wh.payload_obfuscation_seed = 7
+	wh.obfuscate = true
+
+	if err := wh.OpenWave(name, true); err != nil {
+		b.Fatal(err)
+	}
+	if err := wh.OpenPayload(payload_name); err != nil {
+		b.Fatal(err)
+	}
+
+	hide := func() {
+		if _, err := wh.payload_file.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if err := wh.HidePayload(0); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(wh.payload_file_size)
+	b.ReportAllocs()
+	if extract {
+		hide()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := wh.ExtractPayload(0, io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	} else {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			hide()
+		}
+	}
+	b.StopTimer()
+
+	if err := wh.Sync(); err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err = io.Copy(sum, f); err != nil {
+		b.Fatal(err)
+	}
+
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// writeBenchPayload writes size random bytes to a new file.
+func writeBenchPayload(name string, size int64) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = io.CopyN(f, rand.Reader, size); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// writeBenchCarrier writes a new stereo WAVE file of bits samples, just large enough to hide size
+// bytes with BENCH_DENSITY. Noise samples are written BENCH_CHUNK at a time, so that multi-GB
+// carriers don't need memory. The same file is written for the same bits and size.
+func writeBenchCarrier(name string, bits uint32, size int64) (err error) {
+	var (
+		samples_count = uint64(size+FRAME_HEADER_SIZE) * (8 / BENCH_DENSITY)
+		data_size     = samples_count * uint64(bits>>3)
+		samples       = make(SamplesBloc, min(samples_count, BENCH_CHUNK))
+		seed          = uint64(bits)
+	)
+
+	header, err := waveHeader(2, TEST_RATE, bits, data_size)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(header); err == nil {
+		err = f.Truncate(int64(len(header)) + int64(data_size))
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	// Samples are encoded by the carrier
+	wh := &wave_handler_struct{algorithm: ALGO_LSB, density: 1}
+	defer wh.Free()
+	if err = wh.OpenWave(name, true); err != nil {
+		return err
+	}
+	for first := uint64(0); first < samples_count; first += uint64(len(samples)) {
+		chunk := samples[0:min(uint64(len(samples)), samples_count-first)]
+		seed = benchNoise(chunk, bits, seed)
+		if err = wh.carrier.WriteSamples(first, chunk); err != nil {
+			return err
+		}
+	}
+
+	return wh.Sync()
+}
+
+// benchNoise fills samples with uniform noise of half the full scale of bits, from seed. Returns
+// the seed of following samples.
+func benchNoise(samples SamplesBloc, bits uint32, seed uint64) uint64 {
+	var max = uint64(1) << (bits - 1)
+
+	for i := range samples {
+		seed = mix64(seed)
+		samples[i] = int32(int64(seed%max) - int64(max/2))
+	}
+
+	return seed
+}